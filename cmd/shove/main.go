@@ -6,15 +6,22 @@ import (
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/mattstrayer/shove/internal/queue/compressed"
+	"github.com/mattstrayer/shove/internal/queue/disk"
+	"github.com/mattstrayer/shove/internal/queue/encrypted"
 	"github.com/mattstrayer/shove/internal/queue/memory"
 	"github.com/mattstrayer/shove/internal/queue/redis"
+	"github.com/mattstrayer/shove/internal/queue/sharded"
+	"github.com/mattstrayer/shove/internal/queue/tenant"
 	"github.com/mattstrayer/shove/internal/server"
 	"github.com/mattstrayer/shove/internal/services"
 	"github.com/mattstrayer/shove/internal/services/apns"
@@ -23,6 +30,7 @@ import (
 	"github.com/mattstrayer/shove/internal/services/telegram"
 	"github.com/mattstrayer/shove/internal/services/webhook"
 	"github.com/mattstrayer/shove/internal/services/webpush"
+	goredis "github.com/redis/go-redis/v9"
 )
 
 // from -> https://www.gmarik.info/blog/2019/12-factor-golang-flag-package/
@@ -58,30 +66,83 @@ func LookupEnvOrBool(key string, defaultVal bool) bool {
 
 var debug = flag.Bool("debug", LookupEnvOrBool("DEBUG", false), "Enable debug logging")
 var apiAddr = flag.String("api-addr", LookupEnvOrString("API_ADDR", ":8322"), "API address to listen to")
+var adminToken = flag.String("admin-token", LookupEnvOrString("ADMIN_TOKEN", ""), "Bearer token required by the queue admin and dead-letter APIs (both are disabled if not set)")
 var workerOnly = flag.Bool("worker-only", LookupEnvOrBool("WORKER_ONLY", false), "Run in worker-only mode (no HTTP server)")
+var dataDir = flag.String("data-dir", LookupEnvOrString("DATA_DIR", ""), "Directory for the on-disk queue and feedback store, used when Redis is not configured")
+var dataSync = flag.String("data-sync", LookupEnvOrString("DATA_SYNC", "interval"), "When to sync the on-disk queue to disk: always, interval or never")
+var dataSyncInterval = flag.Int("data-sync-interval", LookupEnvOrInt("DATA_SYNC_INTERVAL", 1), "Seconds between syncs of the on-disk queue, when syncing at an interval")
+var memoryQueueCapacity = flag.Int("memory-queue-capacity", LookupEnvOrInt("MEMORY_QUEUE_CAPACITY", 0), "Maximum number of messages per in-memory queue (0 for unlimited)")
+var shutdownTimeout = flag.Int("shutdown-timeout", LookupEnvOrInt("SHUTDOWN_TIMEOUT", 30), "Seconds to wait on shutdown for messages being pushed to finish and the others to be requeued")
+var encryptionKeys = flag.String("encryption-keys", LookupEnvOrString("ENCRYPTION_KEYS", ""), "Comma separated id:key pairs of base64 encoded AES keys to encrypt queued payloads with, the first one being used for new messages")
+var compressMinSize = flag.Int("compress-min-size", LookupEnvOrInt("COMPRESS_MIN_SIZE", 0), "Compress queued payloads of at least this many bytes (0 to disable)")
+var tenantQueues = flag.Bool("tenant-queues", LookupEnvOrBool("TENANT_QUEUES", false), "Keep a sub-queue per tenant, served in turn so that no tenant can starve the others")
+var tenantWeights = flag.String("tenant-weights", LookupEnvOrString("TENANT_WEIGHTS", ""), "Comma separated tenant=weight pairs giving tenants a larger share of the workers than the default weight of 1")
+var breakerErrorPercent = flag.Int("breaker-error-percent", LookupEnvOrInt("BREAKER_ERROR_PERCENT", 0), "Percentage of failing pushes at which a service stops pushing for a while (0 to disable the circuit breaker)")
+var breakerMinPushes = flag.Int("breaker-min-pushes", LookupEnvOrInt("BREAKER_MIN_PUSHES", 20), "Number of pushes within the window below which the circuit breaker does not open")
+var breakerWindow = flag.Int("breaker-window", LookupEnvOrInt("BREAKER_WINDOW", 60), "Seconds over which the error rate of the circuit breaker is measured")
+var breakerOpenDuration = flag.Int("breaker-open-duration", LookupEnvOrInt("BREAKER_OPEN_DURATION", 30), "Seconds the circuit breaker stays open before probing the service again")
+var queueBatchSize = flag.Int("queue-batch-size", LookupEnvOrInt("QUEUE_BATCH_SIZE", 0), "Maximum number of messages taken off a queue at a time (0 for the number of workers)")
+var idempotencyWindow = flag.Int("idempotency-window", LookupEnvOrInt("IDEMPOTENCY_WINDOW", 86400), "Seconds during which a message with the same idempotency key is not queued again (0 to disable)")
 
 var apnsWorkers = flag.Int("apns-workers", LookupEnvOrInt("APNS_WORKERS", 4), "The number of workers pushing APNS messages")
+var apnsMaxAttempts = flag.Int("apns-max-attempts", LookupEnvOrInt("APNS_MAX_ATTEMPTS", 10), "Maximum number of attempts to push an APNS message (0 for unlimited)")
+var apnsMaxAge = flag.Int("apns-max-age", LookupEnvOrInt("APNS_MAX_AGE", 0), "Maximum age in seconds up to which an APNS message is retried (0 for unlimited)")
+var apnsThrottleAmount = flag.Int("apns-throttle-amount", LookupEnvOrInt("APNS_THROTTLE_AMOUNT", 0), "Maximum number of APNS messages pushed per throttle period, without squashing them (0 to disable)")
+var apnsThrottlePer = flag.Int("apns-throttle-per", LookupEnvOrInt("APNS_THROTTLE_PER", 1), "APNS throttle period (seconds)")
+var apnsThrottlePerDestination = flag.Bool("apns-throttle-per-destination", LookupEnvOrBool("APNS_THROTTLE_PER_DESTINATION", false), "Throttle APNS messages per destination instead of for the whole service")
 
 // this must be set as an environment variable
 var googleApplicationCredentials = flag.String("google-application-credentials", LookupEnvOrString("GOOGLE_APPLICATION_CREDENTIALS", ""), "Google application credentials path")
 var googleApplicationCredentialsJSON = flag.String("google-application-credentials-json", LookupEnvOrString("GOOGLE_APPLICATION_CREDENTIALS_JSON", ""), "Google application credentials (base64-encoded JSON)")
 var fcmWorkers = flag.Int("fcm-workers", LookupEnvOrInt("FCM_WORKERS", 4), "The number of workers pushing FCM messages")
+var fcmMaxAttempts = flag.Int("fcm-max-attempts", LookupEnvOrInt("FCM_MAX_ATTEMPTS", 10), "Maximum number of attempts to push an FCM message (0 for unlimited)")
+var fcmMaxAge = flag.Int("fcm-max-age", LookupEnvOrInt("FCM_MAX_AGE", 0), "Maximum age in seconds up to which an FCM message is retried (0 for unlimited)")
+var fcmThrottleAmount = flag.Int("fcm-throttle-amount", LookupEnvOrInt("FCM_THROTTLE_AMOUNT", 0), "Maximum number of FCM messages pushed per throttle period, without squashing them (0 to disable)")
+var fcmThrottlePer = flag.Int("fcm-throttle-per", LookupEnvOrInt("FCM_THROTTLE_PER", 1), "FCM throttle period (seconds)")
+var fcmThrottlePerDestination = flag.Bool("fcm-throttle-per-destination", LookupEnvOrBool("FCM_THROTTLE_PER_DESTINATION", false), "Throttle FCM messages per destination instead of for the whole service")
 
 var redisHost = flag.String("redis-host", LookupEnvOrString("REDIS_HOST", ""), "Redis host")
 var redisPort = flag.String("redis-port", LookupEnvOrString("REDIS_PORT", "6379"), "Redis port")
 var redisPassword = flag.String("redis-password", LookupEnvOrString("REDIS_PASSWORD", ""), "Redis password")
 var redisDB = flag.String("redis-db", LookupEnvOrString("REDIS_DB", "0"), "Redis database number")
+var redisSentinelMaster = flag.String("redis-sentinel-master", LookupEnvOrString("REDIS_SENTINEL_MASTER", ""), "Redis Sentinel master name")
+var redisSentinelAddrs = flag.String("redis-sentinel-addrs", LookupEnvOrString("REDIS_SENTINEL_ADDRS", ""), "Comma separated Redis Sentinel addresses (host:port)")
+var redisClusterAddrs = flag.String("redis-cluster-addrs", LookupEnvOrString("REDIS_CLUSTER_ADDRS", ""), "Comma separated Redis Cluster node addresses (host:port)")
+var redisNamespace = flag.String("redis-namespace", LookupEnvOrString("REDIS_NAMESPACE", redis.DefaultNamespace), "Prefix of all Redis keys, allowing several instances to share a Redis database")
+var redisShards = flag.Int("redis-shards", LookupEnvOrInt("REDIS_SHARDS", 1), "Number of shards each Redis queue is spread over")
+var redisShardAddrs = flag.String("redis-shard-addrs", LookupEnvOrString("REDIS_SHARD_ADDRS", ""), "Comma separated addresses (host:port) of additional Redis nodes the shards are spread over")
+var redisReliable = flag.Bool("redis-reliable", LookupEnvOrBool("REDIS_RELIABLE", false), "Keep in-flight messages in a Redis processing list so they survive crashing workers")
+var redisStreams = flag.Bool("redis-streams", LookupEnvOrBool("REDIS_STREAMS", false), "Use Redis Streams with consumer groups instead of lists for the queues")
+var redisStreamGroup = flag.String("redis-stream-group", LookupEnvOrString("REDIS_STREAM_GROUP", "shove"), "Redis Streams consumer group")
+var redisStreamMaxLen = flag.Int("redis-stream-maxlen", LookupEnvOrInt("REDIS_STREAM_MAXLEN", 1000000), "Approximate maximum length of the Redis streams (0 for unlimited)")
+var redisVisibilityTimeout = flag.Int("redis-visibility-timeout", LookupEnvOrInt("REDIS_VISIBILITY_TIMEOUT", 60), "Seconds after which in-flight messages of an unresponsive worker are requeued (or claimed, when using streams)")
 
 var webhookWorkers = flag.Int("webhook-workers", LookupEnvOrInt("WEBHOOK_WORKERS", 0), "The number of workers pushing Webhook messages")
+var webhookMaxAttempts = flag.Int("webhook-max-attempts", LookupEnvOrInt("WEBHOOK_MAX_ATTEMPTS", 10), "Maximum number of attempts to push a Webhook message (0 for unlimited)")
+var webhookMaxAge = flag.Int("webhook-max-age", LookupEnvOrInt("WEBHOOK_MAX_AGE", 0), "Maximum age in seconds up to which a Webhook message is retried (0 for unlimited)")
+var webhookThrottleAmount = flag.Int("webhook-throttle-amount", LookupEnvOrInt("WEBHOOK_THROTTLE_AMOUNT", 0), "Maximum number of Webhook messages pushed per throttle period, without squashing them (0 to disable)")
+var webhookThrottlePer = flag.Int("webhook-throttle-per", LookupEnvOrInt("WEBHOOK_THROTTLE_PER", 1), "Webhook throttle period (seconds)")
+var webhookThrottlePerDestination = flag.Bool("webhook-throttle-per-destination", LookupEnvOrBool("WEBHOOK_THROTTLE_PER_DESTINATION", false), "Throttle Webhook messages per destination instead of for the whole service")
 
 var webPushVAPIDPublicKey = flag.String("webpush-vapid-public-key", LookupEnvOrString("WEBPUSH_VAPID_PUBLIC_KEY", ""), "VAPID public key")
 var webPushVAPIDPrivateKey = flag.String("webpush-vapid-private-key", LookupEnvOrString("WEBPUSH_VAPID_PRIVATE_KEY", ""), "VAPID public key")
 var webPushWorkers = flag.Int("webpush-workers", LookupEnvOrInt("WEBPUSH_WORKERS", 8), "The number of workers pushing Web messages")
+var webPushMaxAttempts = flag.Int("webpush-max-attempts", LookupEnvOrInt("WEBPUSH_MAX_ATTEMPTS", 10), "Maximum number of attempts to push a Web message (0 for unlimited)")
+var webPushMaxAge = flag.Int("webpush-max-age", LookupEnvOrInt("WEBPUSH_MAX_AGE", 0), "Maximum age in seconds up to which a Web message is retried (0 for unlimited)")
+var webPushThrottleAmount = flag.Int("webpush-throttle-amount", LookupEnvOrInt("WEBPUSH_THROTTLE_AMOUNT", 0), "Maximum number of Web messages pushed per throttle period, without squashing them (0 to disable)")
+var webPushThrottlePer = flag.Int("webpush-throttle-per", LookupEnvOrInt("WEBPUSH_THROTTLE_PER", 1), "Web throttle period (seconds)")
+var webPushThrottlePerDestination = flag.Bool("webpush-throttle-per-destination", LookupEnvOrBool("WEBPUSH_THROTTLE_PER_DESTINATION", false), "Throttle Web messages per destination instead of for the whole service")
 
 var telegramBotToken = flag.String("telegram-bot-token", LookupEnvOrString("TELEGRAM_BOT_TOKEN", ""), "Telegram bot token")
 var telegramWorkers = flag.Int("telegram-workers", LookupEnvOrInt("TELEGRAM_WORKERS", 2), "The number of workers pushing Telegram messages")
 var telegramRateAmount = flag.Int("telegram-rate-amount", LookupEnvOrInt("TELEGRAM_RATE_AMOUNT", 0), "Telegram max. rate (amount)")
 var telegramRatePer = flag.Int("telegram-rate-per", LookupEnvOrInt("TELEGRAM_RATE_PER", 0), "Telegram max. rate (per seconds)")
+var telegramSquashMaxAttempts = flag.Int("telegram-squash-max-attempts", LookupEnvOrInt("TELEGRAM_SQUASH_MAX_ATTEMPTS", 3), "Max. attempts to send a squashed Telegram message before retrying the original messages")
+var telegramMaxAttempts = flag.Int("telegram-max-attempts", LookupEnvOrInt("TELEGRAM_MAX_ATTEMPTS", 10), "Maximum number of attempts to push a Telegram message (0 for unlimited)")
+var telegramMaxAge = flag.Int("telegram-max-age", LookupEnvOrInt("TELEGRAM_MAX_AGE", 0), "Maximum age in seconds up to which a Telegram message is retried (0 for unlimited)")
+var telegramThrottleAmount = flag.Int("telegram-throttle-amount", LookupEnvOrInt("TELEGRAM_THROTTLE_AMOUNT", 0), "Maximum number of Telegram messages pushed per throttle period, without squashing them (0 to disable)")
+var telegramThrottlePer = flag.Int("telegram-throttle-per", LookupEnvOrInt("TELEGRAM_THROTTLE_PER", 1), "Telegram throttle period (seconds)")
+var telegramThrottlePerDestination = flag.Bool("telegram-throttle-per-destination", LookupEnvOrBool("TELEGRAM_THROTTLE_PER_DESTINATION", false), "Throttle Telegram messages per destination instead of for the whole service")
 
 var emailHost = flag.String("email-host", LookupEnvOrString("EMAIL_HOST", ""), "Email host")
 var emailPort = flag.Int("email-port", LookupEnvOrInt("EMAIL_PORT", 25), "Email port")
@@ -92,6 +153,12 @@ var emailTLS = flag.Bool("email-tls", LookupEnvOrBool("EMAIL_TLS", false), "Use
 var emailTLSInsecure = flag.Bool("email-tls-insecure", LookupEnvOrBool("EMAIL_TLS_INSECURE", false), "Skip TLS verification")
 var emailRateAmount = flag.Int("email-rate-amount", LookupEnvOrInt("EMAIL_RATE_AMOUNT", 0), "Email max. rate (amount)")
 var emailRatePer = flag.Int("email-rate-per", LookupEnvOrInt("EMAIL_RATE_PER", 0), "Email max. rate (per seconds)")
+var emailSquashMaxAttempts = flag.Int("email-squash-max-attempts", LookupEnvOrInt("EMAIL_SQUASH_MAX_ATTEMPTS", 3), "Max. attempts to send an email digest before retrying the original messages")
+var emailMaxAttempts = flag.Int("email-max-attempts", LookupEnvOrInt("EMAIL_MAX_ATTEMPTS", 10), "Maximum number of attempts to push an email message (0 for unlimited)")
+var emailMaxAge = flag.Int("email-max-age", LookupEnvOrInt("EMAIL_MAX_AGE", 0), "Maximum age in seconds up to which an email message is retried (0 for unlimited)")
+var emailThrottleAmount = flag.Int("email-throttle-amount", LookupEnvOrInt("EMAIL_THROTTLE_AMOUNT", 0), "Maximum number of email messages pushed per throttle period, without squashing them (0 to disable)")
+var emailThrottlePer = flag.Int("email-throttle-per", LookupEnvOrInt("EMAIL_THROTTLE_PER", 1), "Email throttle period (seconds)")
+var emailThrottlePerDestination = flag.Bool("email-throttle-per-destination", LookupEnvOrBool("EMAIL_THROTTLE_PER_DESTINATION", false), "Throttle email messages per destination instead of for the whole service")
 
 var (
 	apnsAuthKeyPath        = flag.String("apns-auth-key-path", LookupEnvOrString("APNS_AUTH_KEY_PATH", ""), "APNS authentication key path (.p8 file)")
@@ -122,12 +189,160 @@ func newServiceLogger(service string) *slog.Logger {
 	)
 }
 
-// buildRedisURL constructs a Redis URL from configuration flags.
-func buildRedisURL() string {
+func newRetryConfig(maxAttempts, maxAge int) services.RetryConfig {
+	return services.RetryConfig{
+		MaxAttempts: maxAttempts,
+		MaxAge:      time.Second * time.Duration(maxAge),
+	}
+}
+
+// squashClient keeps the rate windows and batches of the squashers in Redis,
+// if set, so that the rates hold across all replicas and any replica can send
+// a batch once it is due
+var squashClient goredis.UniversalClient
+
+func newSquashConfig(id string, amount, per, maxAttempts int) services.SquashConfig {
+	config := services.SquashConfig{
+		RateMax:     amount,
+		RatePer:     time.Second * time.Duration(per),
+		MaxAttempts: maxAttempts,
+	}
+	if squashClient != nil && amount > 0 {
+		store, err := redis.NewSquashStore(squashClient, *redisNamespace, id, keyring)
+		if err != nil {
+			slog.Error("Failed to create squash store", "service", id, "error", err)
+			os.Exit(1)
+		}
+		config.Store = store
+	}
+	return config
+}
+
+func newThrottleConfig(amount, per int, perDestination bool) services.ThrottleConfig {
+	return services.ThrottleConfig{
+		Amount:         amount,
+		Per:            time.Second * time.Duration(per),
+		PerDestination: perDestination,
+	}
+}
+
+func newBreakerConfig() services.BreakerConfig {
+	return services.BreakerConfig{
+		ErrorRate:    float64(*breakerErrorPercent) / 100,
+		MinPushes:    *breakerMinPushes,
+		Window:       time.Second * time.Duration(*breakerWindow),
+		OpenDuration: time.Second * time.Duration(*breakerOpenDuration),
+	}
+}
+
+// splitList splits a comma separated flag value.
+func splitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
+// buildRedisConnConfig constructs the Redis connection configuration from
+// configuration flags.
+func buildRedisConnConfig() redis.ConnConfig {
+	db, err := strconv.Atoi(*redisDB)
+	if err != nil {
+		log.Fatalf("Invalid Redis database number %q: %v", *redisDB, err)
+	}
+	config := redis.ConnConfig{
+		SentinelMaster: *redisSentinelMaster,
+		SentinelAddrs:  splitList(*redisSentinelAddrs),
+		ClusterAddrs:   splitList(*redisClusterAddrs),
+		Password:       *redisPassword,
+		DB:             db,
+		PoolSize:       50,
+	}
+	if *redisHost != "" {
+		config.URL = buildRedisURL(net.JoinHostPort(*redisHost, *redisPort))
+	}
+	return config
+}
+
+// buildRedisURL constructs a Redis URL for the node at addr from configuration
+// flags.
+func buildRedisURL(addr string) string {
 	if *redisPassword != "" {
-		return fmt.Sprintf("redis://:%s@%s:%s/%s", *redisPassword, *redisHost, *redisPort, *redisDB)
+		return fmt.Sprintf("redis://:%s@%s/%s", *redisPassword, addr, *redisDB)
+	}
+	return fmt.Sprintf("redis://%s/%s", addr, *redisDB)
+}
+
+// keyring encrypts the queued payloads, if configured
+var keyring *queue.Keyring
+
+// withPayloadEncoding wraps qf to encrypt and compress its payloads, as
+// configured. Payloads are compressed before being encrypted. Compressed
+// payloads, e.g. pushed by clients, are decompressed even if the server does
+// not compress itself.
+func withPayloadEncoding(qf queue.QueueFactory) queue.QueueFactory {
+	if keyring != nil {
+		qf = encrypted.NewQueueFactory(qf, keyring)
+	}
+	return compressed.NewQueueFactory(qf, *compressMinSize)
+}
+
+// parseTenantWeights parses comma separated tenant=weight pairs.
+func parseTenantWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, item := range splitList(s) {
+		t, w, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("weights must be of the form tenant=weight: %q", item)
+		}
+		if err := queue.CheckTenant(t); err != nil {
+			return nil, err
+		}
+		weight, err := strconv.Atoi(w)
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid weight of tenant %s: %q", t, w)
+		}
+		weights[t] = weight
+	}
+	return weights, nil
+}
+
+// tenantConfig configures the tenant queues, if enabled
+var tenantConfig *tenant.Config
+
+// withTenants wraps qf to keep a sub-queue per tenant, if configured, using
+// registry to find the tenants (nil for none).
+func withTenants(qf queue.QueueFactory, registry queue.TenantRegistry) queue.QueueFactory {
+	if tenantConfig == nil {
+		return qf
+	}
+	config := *tenantConfig
+	config.Registry = registry
+	return tenant.NewQueueFactory(qf, config)
+}
+
+// buildShardedQueueFactory spreads the queues over the configured number of
+// shards, which are assigned to the Redis nodes in turn, starting with the
+// main node. newFactory creates the queue factory of a node.
+func buildShardedQueueFactory(client goredis.UniversalClient, newFactory func(goredis.UniversalClient) queue.QueueFactory) (queue.QueueFactory, error) {
+	nodes := []queue.QueueFactory{newFactory(client)}
+	for _, addr := range splitList(*redisShardAddrs) {
+		node, err := redis.Connect(redis.ConnConfig{URL: buildRedisURL(addr), PoolSize: 50})
+		if err != nil {
+			return nil, fmt.Errorf("connecting to shard node %s: %w", addr, err)
+		}
+		nodes = append(nodes, newFactory(node))
+	}
+	if *redisShards <= 1 {
+		return nodes[0], nil
+	}
+	factories := make([]queue.QueueFactory, *redisShards)
+	for i := range factories {
+		factories[i] = nodes[i%len(nodes)]
 	}
-	return fmt.Sprintf("redis://%s:%s/%s", *redisHost, *redisPort, *redisDB)
+	return sharded.NewQueueFactory(factories), nil
 }
 
 func main() {
@@ -142,24 +357,101 @@ func main() {
 	var qf queue.QueueFactory
 	var fs queue.FeedbackStore
 
-	if *redisHost == "" {
-		slog.Warn("REDIS_HOST not set, using non-persistent in-memory queue and feedback store")
-		qf = memory.MemoryQueueFactory{}
-		fs = memory.NewFeedbackStore()
-	} else {
-		redisURL := buildRedisURL()
-		slog.Info("Using Redis queue", "host", *redisHost, "port", *redisPort, "db", *redisDB)
-		qf = redis.NewQueueFactory(redisURL)
-
+	if *encryptionKeys != "" {
 		var err error
-		fs, err = redis.NewFeedbackStoreFromURL(redisURL)
+		if keyring, err = queue.ParseKeyring(*encryptionKeys); err != nil {
+			slog.Error("Invalid encryption keys", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Encrypting queued payloads")
+	}
+	if *tenantQueues {
+		weights, err := parseTenantWeights(*tenantWeights)
 		if err != nil {
-			slog.Error("Failed to create Redis feedback store", "error", err)
+			slog.Error("Invalid tenant weights", "error", err)
 			os.Exit(1)
 		}
-		slog.Info("Using Redis feedback store", "key", "shove:feedback")
+		tenantConfig = &tenant.Config{Weights: weights}
+		slog.Info("Keeping a queue per tenant", "weights", weights)
 	}
-	s := server.NewServer(*apiAddr, qf, fs, *workerOnly)
+
+	redisConfigured := *redisHost != "" || *redisSentinelMaster != "" || *redisClusterAddrs != ""
+	switch {
+	case !redisConfigured && *dataDir != "":
+		syncPolicy, err := disk.ParseSyncPolicy(*dataSync)
+		if err != nil {
+			slog.Error("Invalid sync policy", "error", err)
+			os.Exit(1)
+		}
+		config := disk.Config{
+			Dir:               *dataDir,
+			Sync:              syncPolicy,
+			SyncInterval:      time.Second * time.Duration(*dataSyncInterval),
+			IdempotencyWindow: time.Second * time.Duration(*idempotencyWindow),
+		}
+		slog.Info("Using on-disk queue and feedback store", "dir", *dataDir, "sync", syncPolicy)
+		if qf, err = disk.NewQueueFactory(config); err != nil {
+			slog.Error("Failed to open on-disk queue", "error", err)
+			os.Exit(1)
+		}
+		qf = withTenants(withPayloadEncoding(qf), disk.NewTenantRegistry(config))
+		if fs, err = disk.NewFeedbackStore(config); err != nil {
+			slog.Error("Failed to open on-disk feedback store", "error", err)
+			os.Exit(1)
+		}
+	case !redisConfigured:
+		slog.Warn("Neither REDIS_HOST nor DATA_DIR set, using non-persistent in-memory queue and feedback store")
+		qf = withTenants(withPayloadEncoding(memory.MemoryQueueFactory{
+			IdempotencyWindow: time.Second * time.Duration(*idempotencyWindow),
+			Capacity:          *memoryQueueCapacity,
+		}), nil)
+		fs = memory.NewFeedbackStore()
+	default:
+		client, err := redis.Connect(buildRedisConnConfig())
+		if err != nil {
+			slog.Error("Failed to connect to Redis", "error", err)
+			os.Exit(1)
+		}
+		var newFactory func(goredis.UniversalClient) queue.QueueFactory
+		if *redisStreams {
+			slog.Info("Using Redis stream queue", "host", *redisHost, "port", *redisPort, "db", *redisDB, "group", *redisStreamGroup, "shards", *redisShards)
+			config := redis.StreamConfig{
+				Group:             *redisStreamGroup,
+				ClaimTimeout:      time.Second * time.Duration(*redisVisibilityTimeout),
+				MaxLen:            int64(*redisStreamMaxLen),
+				IdempotencyWindow: time.Second * time.Duration(*idempotencyWindow),
+				Namespace:         *redisNamespace,
+			}
+			newFactory = func(c goredis.UniversalClient) queue.QueueFactory {
+				return withTenants(withPayloadEncoding(redis.NewStreamQueueFactory(c, config)), redis.NewTenantRegistry(c, *redisNamespace))
+			}
+		} else {
+			slog.Info("Using Redis queue", "host", *redisHost, "port", *redisPort, "db", *redisDB, "reliable", *redisReliable, "shards", *redisShards)
+			config := redis.QueueConfig{
+				Reliable:          *redisReliable,
+				VisibilityTimeout: time.Second * time.Duration(*redisVisibilityTimeout),
+				IdempotencyWindow: time.Second * time.Duration(*idempotencyWindow),
+				Namespace:         *redisNamespace,
+			}
+			newFactory = func(c goredis.UniversalClient) queue.QueueFactory {
+				return withTenants(withPayloadEncoding(redis.NewQueueFactory(c, config)), redis.NewTenantRegistry(c, *redisNamespace))
+			}
+		}
+		if qf, err = buildShardedQueueFactory(client, newFactory); err != nil {
+			slog.Error("Failed to set up Redis shards", "error", err)
+			os.Exit(1)
+		}
+
+		squashClient = client
+		fs = redis.NewFeedbackStore(client, *redisNamespace)
+		slog.Info("Using Redis feedback store", "key", redis.FeedbackKey(*redisNamespace))
+	}
+	s := server.NewServer(server.Config{
+		Addr:       *apiAddr,
+		WorkerOnly: *workerOnly,
+		AdminToken: *adminToken,
+		Namespace:  *redisNamespace,
+	}, qf, fs)
 
 	if *apnsAuthKeyPath != "" || *apnsAuthKey != "" {
 		var apnsService *apns.APNS
@@ -173,12 +465,18 @@ func main() {
 			logger.Error("Failed to initialize APNS", "error", err)
 			os.Exit(1)
 		}
-		if err := s.AddService(apnsService, *apnsWorkers, services.SquashConfig{}); err != nil {
+		if err := s.AddService(apnsService, services.PumpConfig{
+			Workers:   *apnsWorkers,
+			BatchSize: *queueBatchSize,
+			Retry:     newRetryConfig(*apnsMaxAttempts, *apnsMaxAge),
+			Breaker:   newBreakerConfig(),
+			Throttle:  newThrottleConfig(*apnsThrottleAmount, *apnsThrottlePer, *apnsThrottlePerDestination),
+		}); err != nil {
 			slog.Error("Failed to add APNS service", "error", err)
 			os.Exit(1)
 		}
 	} else {
-		slog.Warn("APNS_AUTH_KEY_PATH or APNS_AUTH_KEY not set, APNS service will not process messages from shove:apns queue")
+		slog.Warn("APNS_AUTH_KEY_PATH or APNS_AUTH_KEY not set, APNS service will not process messages", "queue", *redisNamespace+":apns")
 	}
 
 	if *apnsSandboxAuthKeyPath != "" || *apnsSandboxAuthKey != "" {
@@ -193,12 +491,18 @@ func main() {
 			logger.Error("Failed to initialize APNS sandbox", "error", err)
 			os.Exit(1)
 		}
-		if err := s.AddService(apnsService, *apnsWorkers, services.SquashConfig{}); err != nil {
+		if err := s.AddService(apnsService, services.PumpConfig{
+			Workers:   *apnsWorkers,
+			BatchSize: *queueBatchSize,
+			Retry:     newRetryConfig(*apnsMaxAttempts, *apnsMaxAge),
+			Breaker:   newBreakerConfig(),
+			Throttle:  newThrottleConfig(*apnsThrottleAmount, *apnsThrottlePer, *apnsThrottlePerDestination),
+		}); err != nil {
 			slog.Error("Failed to add APNS sandbox service", "error", err)
 			os.Exit(1)
 		}
 	} else {
-		slog.Warn("APNS_SANDBOX_AUTH_KEY_PATH or APNS_SANDBOX_AUTH_KEY not set, APNS sandbox service will not process messages from shove:apns-sandbox queue")
+		slog.Warn("APNS_SANDBOX_AUTH_KEY_PATH or APNS_SANDBOX_AUTH_KEY not set, APNS sandbox service will not process messages", "queue", *redisNamespace+":apns-sandbox")
 	}
 
 	if *googleApplicationCredentials != "" || *googleApplicationCredentialsJSON != "" {
@@ -213,12 +517,18 @@ func main() {
 			slog.Error("Failed to setup FCM service", "error", err)
 			os.Exit(1)
 		}
-		if err := s.AddService(fcmService, *fcmWorkers, services.SquashConfig{}); err != nil {
+		if err := s.AddService(fcmService, services.PumpConfig{
+			Workers:   *fcmWorkers,
+			BatchSize: *queueBatchSize,
+			Retry:     newRetryConfig(*fcmMaxAttempts, *fcmMaxAge),
+			Breaker:   newBreakerConfig(),
+			Throttle:  newThrottleConfig(*fcmThrottleAmount, *fcmThrottlePer, *fcmThrottlePerDestination),
+		}); err != nil {
 			slog.Error("Failed to add FCM service", "error", err)
 			os.Exit(1)
 		}
 	} else {
-		slog.Warn("GOOGLE_APPLICATION_CREDENTIALS or GOOGLE_APPLICATION_CREDENTIALS_JSON not set, FCM service will not process messages from shove:fcm queue")
+		slog.Warn("GOOGLE_APPLICATION_CREDENTIALS or GOOGLE_APPLICATION_CREDENTIALS_JSON not set, FCM service will not process messages", "queue", *redisNamespace+":fcm")
 	}
 
 	if *webhookWorkers > 0 {
@@ -227,7 +537,13 @@ func main() {
 			slog.Error("Failed to setup Webhook service", "error", err)
 			os.Exit(1)
 		}
-		if err := s.AddService(wh, *webhookWorkers, services.SquashConfig{}); err != nil {
+		if err := s.AddService(wh, services.PumpConfig{
+			Workers:   *webhookWorkers,
+			BatchSize: *queueBatchSize,
+			Retry:     newRetryConfig(*webhookMaxAttempts, *webhookMaxAge),
+			Breaker:   newBreakerConfig(),
+			Throttle:  newThrottleConfig(*webhookThrottleAmount, *webhookThrottlePer, *webhookThrottlePerDestination),
+		}); err != nil {
 			slog.Error("Failed to add Webhook service", "error", err)
 			os.Exit(1)
 		}
@@ -239,7 +555,13 @@ func main() {
 			slog.Error("Failed to setup WebPush service", "error", err)
 			os.Exit(1)
 		}
-		if err := s.AddService(web, *webPushWorkers, services.SquashConfig{}); err != nil {
+		if err := s.AddService(web, services.PumpConfig{
+			Workers:   *webPushWorkers,
+			BatchSize: *queueBatchSize,
+			Retry:     newRetryConfig(*webPushMaxAttempts, *webPushMaxAge),
+			Breaker:   newBreakerConfig(),
+			Throttle:  newThrottleConfig(*webPushThrottleAmount, *webPushThrottlePer, *webPushThrottlePerDestination),
+		}); err != nil {
 			slog.Error("Failed to add WebPush service", "error", err)
 			os.Exit(1)
 		}
@@ -251,9 +573,13 @@ func main() {
 			slog.Error("Failed to setup Telegram service", "error", err)
 			os.Exit(1)
 		}
-		if err := s.AddService(tg, *telegramWorkers, services.SquashConfig{
-			RateMax: *telegramRateAmount,
-			RatePer: time.Second * time.Duration(*telegramRatePer),
+		if err := s.AddService(tg, services.PumpConfig{
+			Workers:   *telegramWorkers,
+			BatchSize: *queueBatchSize,
+			Squash:    newSquashConfig(tg.ID(), *telegramRateAmount, *telegramRatePer, *telegramSquashMaxAttempts),
+			Retry:     newRetryConfig(*telegramMaxAttempts, *telegramMaxAge),
+			Breaker:   newBreakerConfig(),
+			Throttle:  newThrottleConfig(*telegramThrottleAmount, *telegramThrottlePer, *telegramThrottlePerDestination),
 		}); err != nil {
 			slog.Error("Failed to add Telegram service", "error", err)
 			os.Exit(1)
@@ -276,9 +602,13 @@ func main() {
 			slog.Error("Failed to setup email service", "error", err)
 			os.Exit(1)
 		}
-		if err := s.AddService(email, 1, services.SquashConfig{
-			RateMax: *emailRateAmount,
-			RatePer: time.Second * time.Duration(*emailRatePer),
+		if err := s.AddService(email, services.PumpConfig{
+			Workers:   1,
+			BatchSize: *queueBatchSize,
+			Squash:    newSquashConfig(email.ID(), *emailRateAmount, *emailRatePer, *emailSquashMaxAttempts),
+			Retry:     newRetryConfig(*emailMaxAttempts, *emailMaxAge),
+			Breaker:   newBreakerConfig(),
+			Throttle:  newThrottleConfig(*emailThrottleAmount, *emailThrottlePer, *emailThrottlePerDestination),
 		}); err != nil {
 			slog.Error("Failed to add email service", "error", err)
 			os.Exit(1)
@@ -298,8 +628,11 @@ func main() {
 		}()
 	}
 	<-stop
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	slog.Info("Shutting down", "timeout", *shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(*shutdownTimeout))
 	defer cancel()
-	s.Shutdown(ctx)
+	if err := s.Shutdown(ctx); err != nil {
+		slog.Error("Failed to shut down cleanly", "error", err)
+	}
 	slog.Info("Exiting")
 }
@@ -0,0 +1,183 @@
+package compressed
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	inputBytesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_compression_input_bytes_total",
+		Help: "The total size of the compressed payloads before compression",
+	}, []string{
+		"queue",
+	})
+
+	outputBytesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_compression_output_bytes_total",
+		Help: "The total size of the compressed payloads after compression",
+	}, []string{
+		"queue",
+	})
+)
+
+type queueFactory struct {
+	factory queue.QueueFactory
+	minSize int
+}
+
+// compressedQueue compresses the payloads of the messages before handing them
+// to the underlying queue, and decompresses them when taken off the queue.
+type compressedQueue struct {
+	queue   queue.Queue
+	minSize int
+	input   prometheus.Counter
+	output  prometheus.Counter
+}
+
+// decompressedMessage is a message of the underlying queue with its payload
+// decompressed.
+type decompressedMessage struct {
+	queue.QueuedMessage
+	env queue.Envelope
+}
+
+// NewQueueFactory creates a queue factory compressing the payloads of the
+// queues of factory that are at least minSize bytes long, or none if minSize
+// is 0. Payloads that are not compressed, e.g. queued before compression was
+// enabled, remain readable.
+func NewQueueFactory(factory queue.QueueFactory, minSize int) queue.QueueFactory {
+	return &queueFactory{
+		factory: factory,
+		minSize: minSize,
+	}
+}
+
+func (f *queueFactory) NewQueue(id string) (queue.Queue, error) {
+	q, err := f.factory.NewQueue(id)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedQueue{
+		queue:   q,
+		minSize: f.minSize,
+		input:   inputBytesCounter.WithLabelValues(id),
+		output:  outputBytesCounter.WithLabelValues(id),
+	}, nil
+}
+
+func (f *queueFactory) NewDeadLetterQueue(id string) (queue.DeadLetterQueue, error) {
+	return f.factory.NewDeadLetterQueue(id)
+}
+
+func (m *decompressedMessage) Message() []byte {
+	return m.env.Payload
+}
+
+func (m *decompressedMessage) Envelope() *queue.Envelope {
+	return &m.env
+}
+
+func (q *compressedQueue) Queue(data []byte) error {
+	if q.minSize <= 0 {
+		return q.queue.Queue(data)
+	}
+	env := queue.DecodeEnvelope(data)
+	size := len(env.Payload)
+	compressed, err := queue.Compress(&env, q.minSize)
+	if err != nil {
+		return err
+	}
+	if compressed {
+		q.input.Add(float64(size))
+		q.output.Add(float64(len(env.Payload)))
+		if data, err = env.Encode(); err != nil {
+			return err
+		}
+	}
+	return q.queue.Queue(data)
+}
+
+// decompress wraps a message taken off the underlying queue. Messages that
+// cannot be decompressed are passed on as they are, to end up as dead
+// letters.
+func (q *compressedQueue) decompress(qm queue.QueuedMessage) queue.QueuedMessage {
+	env := *qm.Envelope()
+	if err := queue.Decompress(&env); err != nil {
+		slog.Error("Unable to decompress message", "id", env.Meta.ID, "error", err)
+		return &decompressedMessage{QueuedMessage: qm, env: *qm.Envelope()}
+	}
+	return &decompressedMessage{QueuedMessage: qm, env: env}
+}
+
+func (q *compressedQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
+	qm, err := q.queue.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return q.decompress(qm), nil
+}
+
+func (q *compressedQueue) GetBatch(ctx context.Context, max int) ([]queue.QueuedMessage, error) {
+	batch, err := q.queue.GetBatch(ctx, max)
+	if err != nil {
+		return nil, err
+	}
+	for i, qm := range batch {
+		batch[i] = q.decompress(qm)
+	}
+	return batch, nil
+}
+
+func (q *compressedQueue) Poll(ctx context.Context, max int, wait time.Duration) ([]queue.QueuedMessage, error) {
+	batch, err := queue.Poll(ctx, q.queue, max, wait)
+	if err != nil {
+		return nil, err
+	}
+	for i, qm := range batch {
+		batch[i] = q.decompress(qm)
+	}
+	return batch, nil
+}
+
+func (q *compressedQueue) Remove(qm queue.QueuedMessage) error {
+	return q.queue.Remove(qm.(*decompressedMessage).QueuedMessage)
+}
+
+// Requeue carries changes made to the metadata of the decompressed message
+// over to the still compressed message of the underlying queue.
+func (q *compressedQueue) Requeue(qm queue.QueuedMessage) error {
+	dm := qm.(*decompressedMessage)
+	dm.QueuedMessage.Envelope().Meta = dm.env.Meta
+	return q.queue.Requeue(dm.QueuedMessage)
+}
+
+func (q *compressedQueue) Len(ctx context.Context) (int64, error) {
+	return q.queue.Len(ctx)
+}
+
+func (q *compressedQueue) Peek(ctx context.Context, limit int) ([]queue.Envelope, error) {
+	envs, err := q.queue.Peek(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range envs {
+		if err := queue.Decompress(&envs[i]); err != nil {
+			slog.Error("Unable to decompress message", "id", envs[i].Meta.ID, "error", err)
+		}
+	}
+	return envs, nil
+}
+
+func (q *compressedQueue) Purge(ctx context.Context) (int64, error) {
+	return q.queue.Purge(ctx)
+}
+
+func (q *compressedQueue) Shutdown() error {
+	return q.queue.Shutdown()
+}
@@ -0,0 +1,55 @@
+package compressed
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/mattstrayer/shove/internal/queue/memory"
+)
+
+func TestCompressedQueue(t *testing.T) {
+	q, err := NewQueueFactory(memory.MemoryQueueFactory{}, 100).NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Shutdown()
+	inner := q.(*compressedQueue).queue
+
+	large := `{"body":"` + strings.Repeat("hello ", 200) + `"}`
+	small := `{"body":"hello"}`
+	for _, payload := range []string{large, small} {
+		if err := q.Queue([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	envs, _ := inner.Peek(context.Background(), 2)
+	if len(envs) != 2 || !queue.Compressed(envs[0].Payload) || string(envs[1].Payload) != small {
+		t.Fatal(envs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	batch, err := q.GetBatch(ctx, 2)
+	if err != nil || len(batch) != 2 {
+		t.Fatal(batch, err)
+	}
+	if string(batch[0].Message()) != large || string(batch[1].Message()) != small {
+		t.Fatal(string(batch[0].Message()), string(batch[1].Message()))
+	}
+
+	// Metadata changes survive a requeue, the payload stays compressed
+	batch[0].Envelope().Meta.Attempts = 2
+	if err := q.Requeue(batch[0]); err != nil {
+		t.Fatal(err)
+	}
+	envs, _ = inner.Peek(context.Background(), 1)
+	if len(envs) != 1 || !queue.Compressed(envs[0].Payload) || envs[0].Meta.Attempts != 2 {
+		t.Fatal(envs)
+	}
+	if err := q.Remove(batch[1]); err != nil {
+		t.Fatal(err)
+	}
+}
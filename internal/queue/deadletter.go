@@ -0,0 +1,34 @@
+package queue
+
+import "context"
+
+// DeadLetter represents a message that could not be delivered.
+type DeadLetter struct {
+	Payload   string `json:"payload"`
+	Reason    string `json:"reason"`
+	Response  string `json:"response,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+	// Meta is the metadata the message was queued with, restored when the
+	// dead letter is replayed. Meta.KeyID names the key the payload is
+	// encrypted with, see Keyring.
+	Meta Meta `json:"meta,omitzero"`
+}
+
+// DeadLetterQueue holds the messages of a service that could not be delivered,
+// so that they can be inspected and replayed.
+type DeadLetterQueue interface {
+	// Push adds a dead letter to the queue.
+	Push(ctx context.Context, dl DeadLetter) error
+
+	// Pop retrieves and removes up to limit dead letters, oldest first.
+	Pop(ctx context.Context, limit int) ([]DeadLetter, error)
+
+	// Peek retrieves up to limit dead letters without removing them.
+	Peek(ctx context.Context, limit int) ([]DeadLetter, error)
+
+	// Len returns the number of dead letters in the queue.
+	Len(ctx context.Context) (int64, error)
+
+	// Purge removes all dead letters, returning how many were removed.
+	Purge(ctx context.Context) (int64, error)
+}
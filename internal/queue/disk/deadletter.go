@@ -0,0 +1,88 @@
+package disk
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+// deadLetterQueue is an on-disk implementation of queue.DeadLetterQueue.
+type deadLetterQueue struct {
+	store *store
+}
+
+// Push adds a dead letter to the queue.
+func (q *deadLetterQueue) Push(_ context.Context, dl queue.DeadLetter) error {
+	return pushJSON(q.store, dl)
+}
+
+// Pop retrieves and removes up to limit dead letters, oldest first.
+func (q *deadLetterQueue) Pop(_ context.Context, limit int) ([]queue.DeadLetter, error) {
+	var letters []queue.DeadLetter
+	return letters, popJSON(q.store, limit, &letters)
+}
+
+// Peek retrieves up to limit dead letters without removing them.
+func (q *deadLetterQueue) Peek(_ context.Context, limit int) ([]queue.DeadLetter, error) {
+	var letters []queue.DeadLetter
+	_, err := decodeJSON(q.store.entries(limit), &letters)
+	return letters, err
+}
+
+// Len returns the number of dead letters in the queue.
+func (q *deadLetterQueue) Len(_ context.Context) (int64, error) {
+	return int64(q.store.len()), nil
+}
+
+// Purge removes all dead letters.
+func (q *deadLetterQueue) Purge(_ context.Context) (int64, error) {
+	entries := q.store.entries(0)
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.id
+	}
+	return int64(len(ids)), q.store.del(ids...)
+}
+
+// pushJSON appends v to a store used as a list.
+func pushJSON(s *store, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	id, err := queue.NewID()
+	if err != nil {
+		return err
+	}
+	return s.put(id, data)
+}
+
+// popJSON removes up to limit entries from the front of a store used as a
+// list, decoding them into the slice pointed to by v.
+func popJSON(s *store, limit int, v any) error {
+	ids, err := decodeJSON(s.entries(limit), v)
+	if err != nil {
+		return err
+	}
+	return s.del(ids...)
+}
+
+// decodeJSON decodes entries into the slice pointed to by v, returning the IDs
+// of the entries.
+func decodeJSON(entries []entry, v any) (ids []string, err error) {
+	items := make([]json.RawMessage, len(entries))
+	ids = make([]string, len(entries))
+	for i, e := range entries {
+		items[i] = e.data
+		ids[i] = e.id
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	return ids, json.Unmarshal(data, v)
+}
+
+// Ensure deadLetterQueue implements queue.DeadLetterQueue
+var _ queue.DeadLetterQueue = (*deadLetterQueue)(nil)
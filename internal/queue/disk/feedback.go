@@ -0,0 +1,57 @@
+package disk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+// FeedbackStore is an on-disk implementation of queue.FeedbackStore.
+type FeedbackStore struct {
+	store *store
+}
+
+// NewFeedbackStore opens the feedback store in the configured directory.
+func NewFeedbackStore(config Config) (*FeedbackStore, error) {
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	s, err := openStore(filepath.Join(config.Dir, "feedback.log"), config)
+	if err != nil {
+		return nil, err
+	}
+	return &FeedbackStore{store: s}, nil
+}
+
+// Push adds a feedback entry to the store.
+func (s *FeedbackStore) Push(_ context.Context, feedback queue.TokenFeedback) error {
+	return pushJSON(s.store, feedback)
+}
+
+// Pop retrieves and removes up to limit feedback entries from the store.
+func (s *FeedbackStore) Pop(_ context.Context, limit int) ([]queue.TokenFeedback, error) {
+	feedback := []queue.TokenFeedback{}
+	return feedback, popJSON(s.store, limit, &feedback)
+}
+
+// Peek retrieves up to limit feedback entries without removing them.
+func (s *FeedbackStore) Peek(_ context.Context, limit int) ([]queue.TokenFeedback, error) {
+	feedback := []queue.TokenFeedback{}
+	_, err := decodeJSON(s.store.entries(limit), &feedback)
+	return feedback, err
+}
+
+// Len returns the number of feedback entries in the store.
+func (s *FeedbackStore) Len(_ context.Context) (int64, error) {
+	return int64(s.store.len()), nil
+}
+
+// Close syncs and closes the store.
+func (s *FeedbackStore) Close() error {
+	return s.store.close()
+}
+
+// Ensure FeedbackStore implements queue.FeedbackStore
+var _ queue.FeedbackStore = (*FeedbackStore)(nil)
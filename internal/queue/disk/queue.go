@@ -0,0 +1,172 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/mattstrayer/shove/internal/queue/memory"
+)
+
+type diskQueueFactory struct {
+	config Config
+	memory memory.MemoryQueueFactory
+}
+
+// diskQueue is an in-memory queue whose messages are journaled to a log on
+// disk, from which it is restored on startup.
+type diskQueue struct {
+	// lock keeps the journal and the in-memory queue in the same order
+	lock  sync.Mutex
+	mem   queue.Queue
+	store *store
+}
+
+// NewQueueFactory creates a queue factory keeping its queues in log files in
+// the configured directory.
+func NewQueueFactory(config Config) (queue.QueueFactory, error) {
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &diskQueueFactory{
+		config: config,
+		memory: memory.MemoryQueueFactory{
+			IdempotencyWindow: config.IdempotencyWindow,
+		},
+	}, nil
+}
+
+func (f *diskQueueFactory) NewQueue(id string) (queue.Queue, error) {
+	path := filepath.Join(f.config.Dir, id+".log")
+	s, err := openStore(path, f.config)
+	if err != nil {
+		return nil, err
+	}
+	mf := f.memory
+	mf.OnPurge = func(envs []queue.Envelope) {
+		ids := make([]string, len(envs))
+		for i, env := range envs {
+			ids[i] = env.Meta.ID
+		}
+		if err := s.del(ids...); err != nil {
+			slog.Error("Unable to delete purged messages", "path", path, "error", err)
+		}
+	}
+	mem, err := mf.NewQueue(id)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	entries := s.entries(0)
+	for _, e := range entries {
+		err := mem.Queue(e.data)
+		if errors.Is(err, queue.ErrDuplicate) {
+			// Journaled twice due to a crash in between queueing a duplicate
+			// and deleting it again
+			err = s.del(e.id)
+		}
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	slog.Info("Opened on-disk queue", "path", path, "count", len(entries))
+	return &diskQueue{
+		mem:   mem,
+		store: s,
+	}, nil
+}
+
+func (f *diskQueueFactory) NewDeadLetterQueue(id string) (queue.DeadLetterQueue, error) {
+	s, err := openStore(filepath.Join(f.config.Dir, id+".dead.log"), f.config)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterQueue{store: s}, nil
+}
+
+func (q *diskQueue) Queue(data []byte) (err error) {
+	env := queue.DecodeEnvelope(data)
+	// Stamp now, so that the journaled message is the one being queued
+	env.Stamp(time.Now())
+	if env.Meta.ID == "" {
+		if env.Meta.ID, err = queue.NewID(); err != nil {
+			return
+		}
+	}
+	if data, err = env.Encode(); err != nil {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err = q.store.put(env.Meta.ID, data); err != nil {
+		return
+	}
+	if err = q.mem.Queue(data); err != nil {
+		if err := q.store.del(env.Meta.ID); err != nil {
+			slog.Error("Unable to delete rejected message", "path", q.store.path, "error", err)
+		}
+	}
+	return
+}
+
+func (q *diskQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
+	return q.mem.Get(ctx)
+}
+
+func (q *diskQueue) GetBatch(ctx context.Context, max int) ([]queue.QueuedMessage, error) {
+	return q.mem.GetBatch(ctx, max)
+}
+
+func (q *diskQueue) Poll(ctx context.Context, max int, wait time.Duration) ([]queue.QueuedMessage, error) {
+	return queue.Poll(ctx, q.mem, max, wait)
+}
+
+func (q *diskQueue) Remove(qm queue.QueuedMessage) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.store.del(qm.Envelope().Meta.ID); err != nil {
+		return err
+	}
+	return q.mem.Remove(qm)
+}
+
+func (q *diskQueue) Requeue(qm queue.QueuedMessage) error {
+	data, err := qm.Envelope().Encode()
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.store.put(qm.Envelope().Meta.ID, data); err != nil {
+		return err
+	}
+	return q.mem.Requeue(qm)
+}
+
+func (q *diskQueue) Len(ctx context.Context) (int64, error) {
+	return q.mem.Len(ctx)
+}
+
+func (q *diskQueue) Peek(ctx context.Context, limit int) ([]queue.Envelope, error) {
+	return q.mem.Peek(ctx, limit)
+}
+
+func (q *diskQueue) Purge(ctx context.Context) (int64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.mem.Purge(ctx)
+}
+
+// Shutdown stops the queue. The journal stays open, so that messages that are
+// still being pushed can be removed.
+func (q *diskQueue) Shutdown() error {
+	err := q.mem.Shutdown()
+	q.store.shutdown()
+	return err
+}
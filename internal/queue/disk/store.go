@@ -0,0 +1,369 @@
+package disk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SyncPolicy determines when writes are flushed to stable storage.
+type SyncPolicy string
+
+const (
+	// SyncAlways syncs the log after every write
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval syncs the log periodically, so that a crash of the machine
+	// (not just of shove) loses at most the writes of the last interval
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves syncing to the operating system
+	SyncNever SyncPolicy = "never"
+)
+
+const (
+	opPut byte = 1
+	opDel byte = 2
+
+	// headerSize is the size of op, ID length, data length and checksum
+	headerSize = 1 + 2 + 4 + 4
+	// maxRecordSize guards against reading garbage lengths
+	maxRecordSize = 64 << 20
+	// compactMinGarbage is the number of obsolete records that must have piled
+	// up before the log is compacted
+	compactMinGarbage = 1000
+)
+
+// Config configures the on-disk backend.
+type Config struct {
+	// Dir is the directory holding the log files.
+	Dir string
+	// Sync is the sync policy, SyncInterval by default.
+	Sync SyncPolicy
+	// SyncInterval is how often the logs are synced using SyncInterval.
+	SyncInterval time.Duration
+	// IdempotencyWindow is how long idempotency keys are remembered (0 to
+	// ignore them). Keys are kept in memory only, and forgotten on restart.
+	IdempotencyWindow time.Duration
+}
+
+// ParseSyncPolicy checks a sync policy given as string.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch p := SyncPolicy(s); p {
+	case SyncAlways, SyncInterval, SyncNever:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown sync policy %q", s)
+}
+
+type entry struct {
+	id   string
+	seq  uint64
+	data []byte
+}
+
+// store is a set of records keyed by ID, kept in memory and backed by an
+// append-only log of puts and deletes. Replacing a record keeps its position
+// in the insertion order. The log is compacted once it consists mostly of
+// obsolete records.
+type store struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	policy  SyncPolicy
+	live    map[string]*entry
+	seq     uint64
+	garbage int
+	dirty   bool
+	closed  bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func openStore(path string, config Config) (s *store, err error) {
+	s = &store{
+		path:   path,
+		policy: config.Sync,
+		live:   make(map[string]*entry),
+		stop:   make(chan struct{}),
+	}
+	if s.policy == "" {
+		s.policy = SyncInterval
+	}
+	if s.f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600); err != nil {
+		return nil, err
+	}
+	if err = s.replay(); err != nil {
+		s.f.Close()
+		return nil, err
+	}
+	if s.policy == SyncInterval {
+		interval := config.SyncInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		s.wg.Add(1)
+		go s.syncLoop(interval)
+	}
+	return s, nil
+}
+
+// replay rebuilds the records from the log. A torn record at the end of the
+// log, as left behind by a crash, is cut off.
+func (s *store) replay() error {
+	r := bufio.NewReader(s.f)
+	var offset int64
+	for {
+		op, id, data, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			slog.Warn("Truncating damaged file", "path", s.path, "offset", offset, "error", err)
+			if err := s.f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset += n
+		s.apply(op, id, data)
+	}
+	_, err := s.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (s *store) apply(op byte, id string, data []byte) {
+	e, ok := s.live[id]
+	if ok {
+		s.garbage++
+	}
+	switch op {
+	case opPut:
+		if !ok {
+			s.seq++
+			e = &entry{id: id, seq: s.seq}
+			s.live[id] = e
+		}
+		e.data = data
+	case opDel:
+		if ok {
+			delete(s.live, id)
+			// The delete record itself is obsolete as well
+			s.garbage++
+		}
+	}
+}
+
+func readRecord(r io.Reader) (op byte, id string, data []byte, n int64, err error) {
+	var header [headerSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("torn record header")
+		}
+		return
+	}
+	op = header[0]
+	idLen := int(binary.BigEndian.Uint16(header[1:3]))
+	dataLen := int(binary.BigEndian.Uint32(header[3:7]))
+	sum := binary.BigEndian.Uint32(header[7:11])
+	if (op != opPut && op != opDel) || dataLen > maxRecordSize {
+		err = errors.New("corrupt record header")
+		return
+	}
+	body := make([]byte, idLen+dataLen)
+	if _, err = io.ReadFull(r, body); err != nil {
+		err = errors.New("torn record")
+		return
+	}
+	if crc32.ChecksumIEEE(body) != sum {
+		err = errors.New("checksum mismatch")
+		return
+	}
+	id = string(body[:idLen])
+	data = body[idLen:]
+	n = int64(headerSize + len(body))
+	return
+}
+
+func appendRecord(buf []byte, op byte, id string, data []byte) []byte {
+	var header [headerSize]byte
+	header[0] = op
+	binary.BigEndian.PutUint16(header[1:3], uint16(len(id)))
+	binary.BigEndian.PutUint32(header[3:7], uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(id))
+	crc.Write(data)
+	binary.BigEndian.PutUint32(header[7:11], crc.Sum32())
+	buf = append(buf, header[:]...)
+	buf = append(buf, id...)
+	return append(buf, data...)
+}
+
+// put adds or replaces a record.
+func (s *store) put(id string, data []byte) error {
+	if len(id) > 0xffff || len(data) > maxRecordSize {
+		return errors.New("record too large")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(appendRecord(nil, opPut, id, data)); err != nil {
+		return err
+	}
+	s.apply(opPut, id, data)
+	return s.maybeCompact()
+}
+
+// del removes records. Unknown IDs are ignored.
+func (s *store) del(ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf []byte
+	for _, id := range ids {
+		if _, ok := s.live[id]; ok {
+			buf = appendRecord(buf, opDel, id, nil)
+		}
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if err := s.write(buf); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		s.apply(opDel, id, nil)
+	}
+	return s.maybeCompact()
+}
+
+// entries returns up to limit records (all if limit <= 0) in insertion order.
+func (s *store) entries(limit int) []entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]entry, 0, len(s.live))
+	for _, e := range s.live {
+		all = append(all, *e)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].seq < all[j].seq })
+	if limit > 0 && limit < len(all) {
+		all = all[:limit]
+	}
+	return all
+}
+
+func (s *store) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.live)
+}
+
+// write appends to the log. Must be called with the lock held.
+func (s *store) write(buf []byte) error {
+	if _, err := s.f.Write(buf); err != nil {
+		return err
+	}
+	if s.policy == SyncAlways || s.closed {
+		return s.f.Sync()
+	}
+	s.dirty = true
+	return nil
+}
+
+// maybeCompact rewrites the log once most of it is obsolete. Must be called
+// with the lock held.
+func (s *store) maybeCompact() error {
+	if s.garbage < compactMinGarbage || s.garbage < len(s.live) {
+		return nil
+	}
+	all := make([]*entry, 0, len(s.live))
+	for _, e := range s.live {
+		all = append(all, e)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].seq < all[j].seq })
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, e := range all {
+		if _, err = w.Write(appendRecord(nil, opPut, e.id, e.data)); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	s.f.Close()
+	s.f = tmp
+	s.garbage = 0
+	s.dirty = false
+	return nil
+}
+
+func (s *store) syncLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sync()
+		}
+	}
+}
+
+func (s *store) sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return
+	}
+	if err := s.f.Sync(); err != nil {
+		slog.Error("Unable to sync file", "path", s.path, "error", err)
+		return
+	}
+	s.dirty = false
+}
+
+// shutdown stops periodic syncing and syncs what has been written so far.
+// The store remains usable, but every further write is synced right away.
+func (s *store) shutdown() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stop)
+	s.wg.Wait()
+	s.sync()
+}
+
+// close shuts the store down and closes the log.
+func (s *store) close() error {
+	s.shutdown()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
@@ -0,0 +1,147 @@
+package disk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	s, err := openStore(path, Config{Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.put("a", []byte("1"))
+	s.put("b", []byte("2"))
+	s.put("c", []byte("3"))
+	s.del("b")
+	s.put("a", []byte("4"))
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openStore(path, Config{Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	entries := s.entries(0)
+	if len(entries) != 2 || entries[0].id != "a" || string(entries[0].data) != "4" || entries[1].id != "c" {
+		t.Fatal(entries)
+	}
+}
+
+func TestStoreTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	s, err := openStore(path, Config{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.put("a", []byte("1"))
+	s.put("b", []byte("2"))
+	s.close()
+
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	s, err = openStore(path, Config{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := s.entries(0); len(entries) != 1 || entries[0].id != "a" {
+		t.Fatal(entries)
+	}
+	// Appending after the truncated record must produce a readable log
+	s.put("c", []byte("3"))
+	s.close()
+	s, _ = openStore(path, Config{Sync: SyncAlways})
+	defer s.close()
+	if entries := s.entries(0); len(entries) != 2 || entries[1].id != "c" {
+		t.Fatal(entries)
+	}
+}
+
+func TestStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	s, err := openStore(path, Config{Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.put("keep", []byte("x"))
+	for i := range compactMinGarbage {
+		id := fmt.Sprint(i)
+		s.put(id, []byte("y"))
+		s.del(id)
+	}
+	if s.garbage >= compactMinGarbage {
+		t.Fatal("not compacted", s.garbage)
+	}
+	s.close()
+
+	s, _ = openStore(path, Config{Sync: SyncNever})
+	defer s.close()
+	if entries := s.entries(0); len(entries) != 1 || entries[0].id != "keep" {
+		t.Fatal(entries)
+	}
+}
+
+func TestQueueRestore(t *testing.T) {
+	config := Config{Dir: t.TempDir(), Sync: SyncAlways}
+	qf, err := NewQueueFactory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := qf.NewQueue("test")
+	q.Queue([]byte(`"first"`))
+	q.Queue([]byte(`"second"`))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qm, err := q.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Remove(qm)
+	qm, _ = q.Get(ctx)
+	qm.Envelope().Meta.Attempts++
+	q.Requeue(qm)
+	q.Shutdown()
+
+	qf, _ = NewQueueFactory(config)
+	q, _ = qf.NewQueue("test")
+	defer q.Shutdown()
+	qm, err = q.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(qm.Message()) != `"second"` || qm.Envelope().Meta.Attempts != 1 {
+		t.Fatal(string(qm.Message()), qm.Envelope().Meta)
+	}
+}
+
+func TestQueuePurge(t *testing.T) {
+	config := Config{Dir: t.TempDir(), Sync: SyncAlways}
+	qf, _ := NewQueueFactory(config)
+	q, _ := qf.NewQueue("test")
+	q.Queue([]byte(`"first"`))
+	q.Queue([]byte(`"second"`))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qm, _ := q.Get(ctx)
+	if n, err := q.Purge(ctx); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	q.Requeue(qm)
+	q.Shutdown()
+
+	qf, _ = NewQueueFactory(config)
+	q, _ = qf.NewQueue("test")
+	defer q.Shutdown()
+	if n, _ := q.Len(ctx); n != 1 {
+		t.Fatal(n)
+	}
+}
@@ -0,0 +1,46 @@
+package disk
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+// TenantRegistry is an implementation of queue.TenantRegistry finding the
+// tenants of a queue by the log files of their sub-queues.
+type TenantRegistry struct {
+	dir string
+}
+
+// NewTenantRegistry creates a tenant registry for the queues kept in the
+// configured directory.
+func NewTenantRegistry(config Config) *TenantRegistry {
+	return &TenantRegistry{dir: config.Dir}
+}
+
+func (r *TenantRegistry) Tenants(_ context.Context, id string) ([]string, error) {
+	prefix := queue.TenantPrefix(id)
+	paths, err := filepath.Glob(filepath.Join(r.dir, glob.Replace(prefix)+"*.log"))
+	if err != nil {
+		return nil, err
+	}
+	var tenants []string
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".log")
+		if strings.HasSuffix(name, ".dead") {
+			continue
+		}
+		tenants = append(tenants, strings.TrimPrefix(name, prefix))
+	}
+	return tenants, nil
+}
+
+// AddTenant does nothing, the log file of the sub-queue records the tenant.
+func (r *TenantRegistry) AddTenant(_ context.Context, id, tenant string) error {
+	return nil
+}
+
+// glob escapes the characters having a meaning in patterns.
+var glob = strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`)
@@ -0,0 +1,26 @@
+package disk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestTenantRegistry(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"apns.log", "apns.dead.log", "apns:tenant:a.log", "apns:tenant:a.dead.log", "apns:tenant:b.log", "fcm:tenant:c.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tenants, err := NewTenantRegistry(Config{Dir: dir}).Tenants(context.Background(), "apns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(tenants)
+	if !slices.Equal(tenants, []string{"a", "b"}) {
+		t.Fatal(tenants)
+	}
+}
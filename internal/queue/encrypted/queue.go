@@ -0,0 +1,214 @@
+package encrypted
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+type queueFactory struct {
+	factory queue.QueueFactory
+	keyring *queue.Keyring
+}
+
+// encryptedQueue encrypts the payloads of the messages before handing them to
+// the underlying queue, and decrypts them when taken off the queue. The
+// metadata is left readable, as the queue needs it for scheduling and routing.
+type encryptedQueue struct {
+	queue   queue.Queue
+	keyring *queue.Keyring
+}
+
+// decryptedMessage is a message of the underlying queue with its payload
+// decrypted.
+type decryptedMessage struct {
+	queue.QueuedMessage
+	env queue.Envelope
+}
+
+type deadLetterQueue struct {
+	queue.DeadLetterQueue
+	keyring *queue.Keyring
+}
+
+// NewQueueFactory creates a queue factory encrypting the payloads of the
+// queues and dead-letter queues of factory using keyring. Payloads queued
+// unencrypted, e.g. before encryption was enabled, remain readable.
+func NewQueueFactory(factory queue.QueueFactory, keyring *queue.Keyring) queue.QueueFactory {
+	return &queueFactory{
+		factory: factory,
+		keyring: keyring,
+	}
+}
+
+func (f *queueFactory) NewQueue(id string) (queue.Queue, error) {
+	q, err := f.factory.NewQueue(id)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedQueue{queue: q, keyring: f.keyring}, nil
+}
+
+func (f *queueFactory) NewDeadLetterQueue(id string) (queue.DeadLetterQueue, error) {
+	dlq, err := f.factory.NewDeadLetterQueue(id)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterQueue{DeadLetterQueue: dlq, keyring: f.keyring}, nil
+}
+
+func (m *decryptedMessage) Message() []byte {
+	return m.env.Payload
+}
+
+func (m *decryptedMessage) Envelope() *queue.Envelope {
+	return &m.env
+}
+
+func (q *encryptedQueue) Queue(data []byte) error {
+	env := queue.DecodeEnvelope(data)
+	if err := q.keyring.Encrypt(&env); err != nil {
+		return err
+	}
+	data, err := env.Encode()
+	if err != nil {
+		return err
+	}
+	return q.queue.Queue(data)
+}
+
+// decrypt wraps a message taken off the underlying queue. Messages that
+// cannot be decrypted, e.g. because their key has been removed from the
+// keyring, are passed on as they are, to end up as dead letters.
+func (q *encryptedQueue) decrypt(qm queue.QueuedMessage) queue.QueuedMessage {
+	env := *qm.Envelope()
+	if err := q.keyring.Decrypt(&env); err != nil {
+		slog.Error("Unable to decrypt message", "id", env.Meta.ID, "key_id", env.Meta.KeyID, "error", err)
+		return &decryptedMessage{QueuedMessage: qm, env: *qm.Envelope()}
+	}
+	return &decryptedMessage{QueuedMessage: qm, env: env}
+}
+
+func (q *encryptedQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
+	qm, err := q.queue.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return q.decrypt(qm), nil
+}
+
+func (q *encryptedQueue) GetBatch(ctx context.Context, max int) ([]queue.QueuedMessage, error) {
+	batch, err := q.queue.GetBatch(ctx, max)
+	if err != nil {
+		return nil, err
+	}
+	for i, qm := range batch {
+		batch[i] = q.decrypt(qm)
+	}
+	return batch, nil
+}
+
+func (q *encryptedQueue) Poll(ctx context.Context, max int, wait time.Duration) ([]queue.QueuedMessage, error) {
+	batch, err := queue.Poll(ctx, q.queue, max, wait)
+	if err != nil {
+		return nil, err
+	}
+	for i, qm := range batch {
+		batch[i] = q.decrypt(qm)
+	}
+	return batch, nil
+}
+
+func (q *encryptedQueue) Remove(qm queue.QueuedMessage) error {
+	return q.queue.Remove(qm.(*decryptedMessage).QueuedMessage)
+}
+
+// Requeue carries changes made to the metadata of the decrypted message over
+// to the still encrypted message of the underlying queue.
+func (q *encryptedQueue) Requeue(qm queue.QueuedMessage) error {
+	dm := qm.(*decryptedMessage)
+	env := dm.QueuedMessage.Envelope()
+	keyID := env.Meta.KeyID
+	env.Meta = dm.env.Meta
+	env.Meta.KeyID = keyID
+	return q.queue.Requeue(dm.QueuedMessage)
+}
+
+func (q *encryptedQueue) Len(ctx context.Context) (int64, error) {
+	return q.queue.Len(ctx)
+}
+
+func (q *encryptedQueue) Peek(ctx context.Context, limit int) ([]queue.Envelope, error) {
+	envs, err := q.queue.Peek(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range envs {
+		if err := q.keyring.Decrypt(&envs[i]); err != nil {
+			slog.Error("Unable to decrypt message", "id", envs[i].Meta.ID, "key_id", envs[i].Meta.KeyID, "error", err)
+		}
+	}
+	return envs, nil
+}
+
+func (q *encryptedQueue) Purge(ctx context.Context) (int64, error) {
+	return q.queue.Purge(ctx)
+}
+
+func (q *encryptedQueue) Shutdown() error {
+	return q.queue.Shutdown()
+}
+
+func (q *deadLetterQueue) Push(ctx context.Context, dl queue.DeadLetter) error {
+	if err := encryptDeadLetter(q.keyring, &dl); err != nil {
+		return err
+	}
+	return q.DeadLetterQueue.Push(ctx, dl)
+}
+
+func (q *deadLetterQueue) Pop(ctx context.Context, limit int) ([]queue.DeadLetter, error) {
+	return q.decrypt(q.DeadLetterQueue.Pop(ctx, limit))
+}
+
+func (q *deadLetterQueue) Peek(ctx context.Context, limit int) ([]queue.DeadLetter, error) {
+	return q.decrypt(q.DeadLetterQueue.Peek(ctx, limit))
+}
+
+// decrypt decrypts the payloads of dead letters. Dead letters that cannot be
+// decrypted are returned as they are.
+func (q *deadLetterQueue) decrypt(dls []queue.DeadLetter, err error) ([]queue.DeadLetter, error) {
+	for i := range dls {
+		if err := decryptDeadLetter(q.keyring, &dls[i]); err != nil {
+			slog.Error("Unable to decrypt dead letter", "id", dls[i].Meta.ID, "key_id", dls[i].Meta.KeyID, "error", err)
+		}
+	}
+	return dls, err
+}
+
+// encryptDeadLetter encrypts the payload of a dead letter like the payload of
+// the message it was, with the key ID in its metadata. Dead letters of
+// messages that could not be decrypted are left as they are, so that they
+// keep the key they were encrypted with.
+func encryptDeadLetter(k *queue.Keyring, dl *queue.DeadLetter) error {
+	env := queue.Envelope{Meta: dl.Meta, Payload: []byte(dl.Payload)}
+	if err := k.Encrypt(&env); err != nil {
+		return err
+	}
+	dl.Meta = env.Meta
+	dl.Payload = string(env.Payload)
+	return nil
+}
+
+// decryptDeadLetter restores the payload of a dead letter encrypted by
+// encryptDeadLetter.
+func decryptDeadLetter(k *queue.Keyring, dl *queue.DeadLetter) error {
+	env := queue.Envelope{Meta: dl.Meta, Payload: []byte(dl.Payload)}
+	if err := k.Decrypt(&env); err != nil {
+		return err
+	}
+	dl.Meta = env.Meta
+	dl.Payload = string(env.Payload)
+	return nil
+}
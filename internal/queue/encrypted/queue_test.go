@@ -0,0 +1,155 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/mattstrayer/shove/internal/queue/memory"
+)
+
+func TestEncryptedQueue(t *testing.T) {
+	keyring, err := queue.ParseKeyring("k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewQueueFactory(memory.MemoryQueueFactory{}, keyring)
+	q, err := f.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Shutdown()
+	inner := q.(*encryptedQueue).queue
+
+	if err := q.Queue([]byte(`{"text":"secret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	envs, _ := inner.Peek(context.Background(), 1)
+	if len(envs) != 1 || envs[0].Meta.KeyID != "k1" || bytes.Contains(envs[0].Payload, []byte("secret")) {
+		t.Fatal("stored unencrypted", envs)
+	}
+	envs, _ = q.Peek(context.Background(), 1)
+	if len(envs) != 1 || string(envs[0].Payload) != `{"text":"secret"}` {
+		t.Fatal(envs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qm, err := q.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(qm.Message()) != `{"text":"secret"}` {
+		t.Fatal(string(qm.Message()))
+	}
+
+	// Metadata changes survive a requeue, the payload stays encrypted
+	qm.Envelope().Meta.Attempts = 3
+	if err := q.Requeue(qm); err != nil {
+		t.Fatal(err)
+	}
+	envs, _ = inner.Peek(context.Background(), 1)
+	if len(envs) != 1 || envs[0].Meta.KeyID != "k1" || envs[0].Meta.Attempts != 3 {
+		t.Fatal(envs)
+	}
+	if qm, err = q.Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if string(qm.Message()) != `{"text":"secret"}` || qm.Envelope().Meta.Attempts != 3 {
+		t.Fatal(qm.Envelope())
+	}
+	if err := q.Remove(qm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedDeadLetterQueue(t *testing.T) {
+	keyring, err := queue.ParseKeyring("k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dlq, err := NewQueueFactory(memory.MemoryQueueFactory{}, keyring).NewDeadLetterQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := dlq.Push(ctx, queue.DeadLetter{Payload: "secret", Reason: "push failed"}); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := dlq.(*deadLetterQueue).DeadLetterQueue.Peek(ctx, 1)
+	if len(stored) != 1 || stored[0].Payload == "secret" || stored[0].Reason != "push failed" {
+		t.Fatal("stored unencrypted", stored)
+	}
+	dls, err := dlq.Pop(ctx, 1)
+	if err != nil || len(dls) != 1 || dls[0].Payload != "secret" {
+		t.Fatal(dls, err)
+	}
+}
+
+func TestDeadLetterPlaintext(t *testing.T) {
+	k, err := queue.ParseKeyring("k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := queue.DeadLetter{Payload: "legacy"}
+	if err := decryptDeadLetter(k, &dl); err != nil || dl.Payload != "legacy" {
+		t.Fatal(dl, err)
+	}
+	if err := encryptDeadLetter(k, &dl); err != nil || dl.Meta.KeyID != "k1" || strings.Contains(dl.Payload, "legacy") {
+		t.Fatal(dl, err)
+	}
+	if err := decryptDeadLetter(k, &dl); err != nil || dl.Payload != "legacy" {
+		t.Fatal(dl, err)
+	}
+}
+
+func TestUndecryptableDeadLetter(t *testing.T) {
+	old, err := queue.ParseKeyring("k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := queue.ParseKeyring("k2:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := memory.MemoryQueueFactory{}
+	inner, _ := f.NewQueue("test")
+	defer inner.Shutdown()
+	innerDLQ, _ := f.NewDeadLetterQueue("test")
+	if err := (&encryptedQueue{queue: inner, keyring: old}).Queue([]byte(`"secret"`)); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := inner.Peek(context.Background(), 1)
+
+	// The key has been dropped from the keyring since the message was queued
+	q := &encryptedQueue{queue: inner, keyring: rotated}
+	dlq := &deadLetterQueue{DeadLetterQueue: innerDLQ, keyring: rotated}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qm, err := q.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := qm.Envelope()
+	if err := dlq.Push(ctx, queue.DeadLetter{Payload: string(env.Payload), Meta: env.Meta}); err != nil {
+		t.Fatal(err)
+	}
+	dls, _ := innerDLQ.Peek(ctx, 1)
+	if len(dls) != 1 || dls[0].Meta.KeyID != "k1" || dls[0].Payload != string(stored[0].Payload) {
+		t.Fatal("encrypted again", dls)
+	}
+
+	// Readable again once the key is back
+	dlq.keyring, err = queue.ParseKeyring("k2:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)) +
+		",k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dls, _ = dlq.Pop(ctx, 1); len(dls) != 1 || dls[0].Payload != `"secret"` || dls[0].Meta.KeyID != "" {
+		t.Fatal(dls)
+	}
+}
@@ -0,0 +1,77 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+// deadLetterQueue is an in-memory implementation of queue.DeadLetterQueue.
+type deadLetterQueue struct {
+	mu      sync.Mutex
+	letters []queue.DeadLetter
+}
+
+// NewDeadLetterQueue ...
+func (mqf MemoryQueueFactory) NewDeadLetterQueue(id string) (queue.DeadLetterQueue, error) {
+	return &deadLetterQueue{}, nil
+}
+
+// Push adds a dead letter to the in-memory queue.
+func (q *deadLetterQueue) Push(_ context.Context, dl queue.DeadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.letters = append(q.letters, dl)
+	return nil
+}
+
+// Pop retrieves and removes up to limit dead letters, oldest first.
+func (q *deadLetterQueue) Pop(_ context.Context, limit int) ([]queue.DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := limit
+	if count > len(q.letters) || count <= 0 {
+		count = len(q.letters)
+	}
+
+	result := make([]queue.DeadLetter, count)
+	copy(result, q.letters[:count])
+	q.letters = q.letters[count:]
+	return result, nil
+}
+
+// Peek retrieves up to limit dead letters without removing them.
+func (q *deadLetterQueue) Peek(_ context.Context, limit int) ([]queue.DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := limit
+	if count > len(q.letters) || count <= 0 {
+		count = len(q.letters)
+	}
+
+	result := make([]queue.DeadLetter, count)
+	copy(result, q.letters[:count])
+	return result, nil
+}
+
+// Len returns the number of dead letters in the queue.
+func (q *deadLetterQueue) Len(_ context.Context) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int64(len(q.letters)), nil
+}
+
+// Purge removes all dead letters.
+func (q *deadLetterQueue) Purge(_ context.Context) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := int64(len(q.letters))
+	q.letters = nil
+	return n, nil
+}
+
+// Ensure deadLetterQueue implements queue.DeadLetterQueue
+var _ queue.DeadLetterQueue = (*deadLetterQueue)(nil)
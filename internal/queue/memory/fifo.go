@@ -0,0 +1,50 @@
+package memory
+
+// fifo is a first-in, first-out queue of messages with amortized O(1) push
+// and pop.
+type fifo struct {
+	items []*memoryQueuedMessage
+	head  int
+}
+
+func (f *fifo) len() int {
+	return len(f.items) - f.head
+}
+
+func (f *fifo) push(qm *memoryQueuedMessage) {
+	f.items = append(f.items, qm)
+}
+
+func (f *fifo) pop() *memoryQueuedMessage {
+	if f.len() == 0 {
+		return nil
+	}
+	qm := f.items[f.head]
+	f.items[f.head] = nil
+	f.head++
+	if f.head == len(f.items) {
+		// Empty, start over
+		f.items = f.items[:0]
+		f.head = 0
+	} else if f.head >= 1024 && f.head*2 >= len(f.items) {
+		// Reclaim the space in front of the head
+		n := copy(f.items, f.items[f.head:])
+		clear(f.items[n:])
+		f.items = f.items[:n]
+		f.head = 0
+	}
+	return qm
+}
+
+// peek returns up to limit messages from the head without removing them.
+func (f *fifo) peek(limit int) []*memoryQueuedMessage {
+	return f.items[f.head:min(f.head+limit, len(f.items))]
+}
+
+// drain removes and returns all messages.
+func (f *fifo) drain() []*memoryQueuedMessage {
+	items := f.items[f.head:]
+	f.items = nil
+	f.head = 0
+	return items
+}
@@ -0,0 +1,30 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+// remember records the idempotency key of env, if any. Returns false if the
+// key has already been seen within the idempotency window. Must be called
+// with the lock held.
+func (mq *memoryQueue) remember(env queue.Envelope, now time.Time) bool {
+	key := env.Meta.IdempotencyKey
+	if key == "" || mq.idempotencyWindow <= 0 {
+		return true
+	}
+	if now.Sub(mq.lastSweep) > time.Minute {
+		for k, until := range mq.seen {
+			if now.After(until) {
+				delete(mq.seen, k)
+			}
+		}
+		mq.lastSweep = now
+	}
+	if until, ok := mq.seen[key]; ok && !now.After(until) {
+		return false
+	}
+	mq.seen[key] = now.Add(mq.idempotencyWindow)
+	return true
+}
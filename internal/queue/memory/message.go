@@ -1,11 +1,18 @@
 package memory
 
+import "github.com/mattstrayer/shove/internal/queue"
+
 type memoryQueuedMessage struct {
-	msg     []byte
-	pending bool
-	idx     int
+	env  queue.Envelope
+	lane int
+	// inFlight is set while the message is handed out by Get
+	inFlight bool
 }
 
 func (qm *memoryQueuedMessage) Message() []byte {
-	return qm.msg
+	return qm.env.Payload
+}
+
+func (qm *memoryQueuedMessage) Envelope() *queue.Envelope {
+	return &qm.env
 }
@@ -3,46 +3,95 @@ package memory
 import (
 	"context"
 	"errors"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/mattstrayer/shove/internal/queue"
 )
 
 // MemoryQueueFactory ...
-type MemoryQueueFactory struct{}
+type MemoryQueueFactory struct {
+	// IdempotencyWindow is how long idempotency keys are remembered (0 to
+	// ignore them). Keys are remembered per queue, and lost on restart.
+	IdempotencyWindow time.Duration
+	// Capacity limits the number of messages a queue holds, including
+	// scheduled and in-flight messages (0 for unlimited).
+	Capacity int
+	// OnPurge, if set, is called with the messages removed by Purge, while the
+	// queue is locked.
+	OnPurge func([]queue.Envelope)
+}
 
 type memoryQueue struct {
-	buf          []*memoryQueuedMessage
+	// ready holds the messages waiting to be handed out, per priority lane
+	ready        []fifo
+	lanes        queue.LaneScheduler
+	inFlight     int
+	capacity     int
 	lock         sync.Mutex
 	cond         *sync.Cond
 	shuttingDown bool
+	scheduled    scheduledHeap
+	timer        *time.Timer
+
+	idempotencyWindow time.Duration
+	seen              map[string]time.Time
+	lastSweep         time.Time
+
+	onPurge func([]queue.Envelope)
 }
 
 func (mq *memoryQueue) Queue(msg []byte) (err error) {
+	now := time.Now()
+	env := queue.DecodeEnvelope(msg)
+	env.Stamp(now)
 	mq.lock.Lock()
-	qm := &memoryQueuedMessage{
-		msg: msg,
-		idx: -1,
-	}
-	for i := 0; i < len(mq.buf); i++ {
-		if mq.buf[i] == nil {
-			qm.idx = i
-			mq.buf[i] = qm
-			break
-		}
+	if mq.capacity > 0 && mq.len() >= mq.capacity {
+		mq.lock.Unlock()
+		return queue.ErrQueueFull
+	}
+	if !mq.remember(env, now) {
+		mq.lock.Unlock()
+		return queue.ErrDuplicate
 	}
-	if qm.idx < 0 {
-		qm.idx = len(mq.buf)
-		mq.buf = append(mq.buf, qm)
+	if due := env.Meta.Due(); due > now.Unix() {
+		mq.schedule(env, time.Unix(due, 0))
+		mq.lock.Unlock()
+		return nil
 	}
+	mq.enqueue(&memoryQueuedMessage{
+		env:  env,
+		lane: env.Meta.Priority.Lane(),
+	})
 	mq.lock.Unlock()
 	mq.cond.Signal()
 	return nil
 }
 
+// len returns the number of messages held by the queue. Must be called with
+// the lock held.
+func (mq *memoryQueue) len() int {
+	n := mq.inFlight + len(mq.scheduled)
+	for i := range mq.ready {
+		n += mq.ready[i].len()
+	}
+	return n
+}
+
+// enqueue appends qm to the ready messages of its lane. Must be called with
+// the lock held.
+func (mq *memoryQueue) enqueue(qm *memoryQueuedMessage) {
+	mq.ready[qm.lane].push(qm)
+}
+
 func (mq *memoryQueue) Shutdown() (err error) {
 	mq.lock.Lock()
 	mq.shuttingDown = true
+	if mq.timer != nil {
+		mq.timer.Stop()
+	}
 	mq.cond.Broadcast()
 	mq.lock.Unlock()
 	return
@@ -50,52 +99,165 @@ func (mq *memoryQueue) Shutdown() (err error) {
 
 func (mq *memoryQueue) Remove(qm queue.QueuedMessage) (err error) {
 	mq.lock.Lock()
+	defer mq.lock.Unlock()
 	mqm := qm.(*memoryQueuedMessage)
-	mq.buf[mqm.idx] = nil
-	mq.lock.Unlock()
+	if !mqm.inFlight {
+		return errors.New("message not in flight")
+	}
+	mqm.inFlight = false
+	mq.inFlight--
 	return nil
 }
 
+// Requeue puts the message at the back of its lane, so that a failing message
+// does not block the ones queued after it. Messages that are to be retried
+// later are scheduled instead.
 func (mq *memoryQueue) Requeue(qm queue.QueuedMessage) (err error) {
 	mq.lock.Lock()
 	mqm := qm.(*memoryQueuedMessage)
-	mqm.pending = false
+	if !mqm.inFlight {
+		mq.lock.Unlock()
+		return errors.New("message not in flight")
+	}
+	mqm.inFlight = false
+	mq.inFlight--
+	if due := mqm.env.Meta.Due(); due > time.Now().Unix() {
+		mq.schedule(mqm.env, time.Unix(due, 0))
+		mq.lock.Unlock()
+		return
+	}
+	mq.enqueue(mqm)
 	mq.lock.Unlock()
 	mq.cond.Signal()
 	return
 }
 
+// getNextMessage takes the next ready message, looking at the lanes in the
+// order given by the lane scheduler. Must be called with the lock held.
 func (mq *memoryQueue) getNextMessage() *memoryQueuedMessage {
-	for i := 0; i < len(mq.buf); i++ {
-		m := mq.buf[i]
-		if m != nil && !m.pending {
-			m.pending = true
-			return m
+	for _, lane := range mq.lanes.Order() {
+		if qm := mq.ready[lane].pop(); qm != nil {
+			qm.inFlight = true
+			mq.inFlight++
+			mq.lanes.Served()
+			return qm
 		}
 	}
 	return nil
 }
 
 func (mq *memoryQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
+	qms, err := mq.GetBatch(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return qms[0], nil
+}
+
+func (mq *memoryQueue) GetBatch(ctx context.Context, max int) ([]queue.QueuedMessage, error) {
+	return mq.getBatch(ctx, ctx, max)
+}
+
+// Poll returns up to max ready messages, waiting at most wait for the first
+// one.
+func (mq *memoryQueue) Poll(ctx context.Context, max int, wait time.Duration) ([]queue.QueuedMessage, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	return mq.getBatch(ctx, waitCtx, max)
+}
+
+// getBatch takes up to max ready messages, waiting for the first one until
+// ctx is done, or until waitCtx is done, in which case it returns no messages
+// and no error.
+func (mq *memoryQueue) getBatch(ctx, waitCtx context.Context, max int) ([]queue.QueuedMessage, error) {
 	mq.cond.L.Lock()
 	defer mq.cond.L.Unlock()
+	// Wake up when the wait is over, rather than at the next message
+	stop := context.AfterFunc(waitCtx, func() {
+		mq.cond.L.Lock()
+		mq.cond.Broadcast()
+		mq.cond.L.Unlock()
+	})
+	defer stop()
 	for ctx.Err() == nil {
 		if mq.shuttingDown {
-			break
+			return nil, errors.New("queue shut down")
 		}
 		msg := mq.getNextMessage()
 		if msg == nil {
+			if waitCtx.Err() != nil {
+				return nil, nil
+			}
 			mq.cond.Wait()
 			continue
 		}
-		return msg, nil
+		batch := []queue.QueuedMessage{msg}
+		for len(batch) < max {
+			if msg = mq.getNextMessage(); msg == nil {
+				break
+			}
+			batch = append(batch, msg)
+		}
+		return batch, nil
+	}
+	return nil, ctx.Err()
+}
+
+func (mq *memoryQueue) Len(ctx context.Context) (int64, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	return int64(mq.len() - mq.inFlight), nil
+}
+
+// Peek returns the ready messages by lane, highest priority first, followed by
+// the scheduled messages by due time.
+func (mq *memoryQueue) Peek(ctx context.Context, limit int) ([]queue.Envelope, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	var envs []queue.Envelope
+	for i := range mq.ready {
+		for _, qm := range mq.ready[i].peek(limit - len(envs)) {
+			envs = append(envs, qm.env)
+		}
 	}
-	return nil, errors.New("queue shut down")
+	if len(envs) < limit && len(mq.scheduled) > 0 {
+		scheduled := slices.Clone(mq.scheduled)
+		sort.Sort(scheduled)
+		for _, sm := range scheduled[:min(limit-len(envs), len(scheduled))] {
+			envs = append(envs, sm.env)
+		}
+	}
+	return envs, nil
+}
+
+func (mq *memoryQueue) Purge(ctx context.Context) (int64, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	var purged []queue.Envelope
+	for i := range mq.ready {
+		for _, qm := range mq.ready[i].drain() {
+			purged = append(purged, qm.env)
+		}
+	}
+	for _, sm := range mq.scheduled {
+		purged = append(purged, sm.env)
+	}
+	mq.scheduled = nil
+	if mq.onPurge != nil && len(purged) > 0 {
+		mq.onPurge(purged)
+	}
+	return int64(len(purged)), nil
 }
 
 // NewQueue ...
 func (mqf MemoryQueueFactory) NewQueue(id string) (q queue.Queue, err error) {
-	mq := &memoryQueue{}
+	mq := &memoryQueue{
+		ready:             make([]fifo, len(queue.Priorities)),
+		capacity:          mqf.Capacity,
+		idempotencyWindow: mqf.IdempotencyWindow,
+		seen:              make(map[string]time.Time),
+		onPurge:           mqf.OnPurge,
+	}
 	mq.cond = sync.NewCond(&mq.lock)
 	q = mq
 	return
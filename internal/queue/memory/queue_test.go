@@ -0,0 +1,175 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+func get(t *testing.T, q queue.Queue) queue.QueuedMessage {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qm, err := q.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qm
+}
+
+func TestRequeueToBack(t *testing.T) {
+	q, _ := MemoryQueueFactory{}.NewQueue("test")
+	q.Queue([]byte("a"))
+	q.Queue([]byte("b"))
+	qm := get(t, q)
+	if string(qm.Message()) != "a" {
+		t.Fatal(string(qm.Message()))
+	}
+	q.Requeue(qm)
+	for _, expected := range []string{"b", "a"} {
+		qm = get(t, q)
+		if string(qm.Message()) != expected {
+			t.Fatal(string(qm.Message()), expected)
+		}
+		if err := q.Remove(qm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Remove(qm); err == nil {
+		t.Fatal("removed twice")
+	}
+}
+
+func TestRequeueRetryAt(t *testing.T) {
+	q, _ := MemoryQueueFactory{}.NewQueue("test")
+	q.Queue([]byte("a"))
+	q.Queue([]byte("b"))
+	qm := get(t, q)
+	qm.Envelope().Meta.RetryAt = time.Now().Add(2 * time.Second).Unix()
+	q.Requeue(qm)
+	if qm = get(t, q); string(qm.Message()) != "b" {
+		t.Fatal(string(qm.Message()))
+	}
+	q.Remove(qm)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := q.Get(ctx); err == nil {
+		t.Fatal("retried too early")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	qm, err := q.Get(ctx)
+	if err != nil || string(qm.Message()) != "a" {
+		t.Fatal(err)
+	}
+}
+
+func TestGetBatch(t *testing.T) {
+	q, _ := MemoryQueueFactory{}.NewQueue("test")
+	for _, msg := range []string{"a", "b", "c"} {
+		q.Queue([]byte(msg))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qms, err := q.GetBatch(ctx, 2)
+	if err != nil || len(qms) != 2 {
+		t.Fatal(len(qms), err)
+	}
+	if qms, err = q.GetBatch(ctx, 2); err != nil || len(qms) != 1 || string(qms[0].Message()) != "c" {
+		t.Fatal(len(qms), err)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	q, _ := MemoryQueueFactory{}.NewQueue("test")
+	p := q.(queue.Poller)
+	ctx := context.Background()
+	if qms, err := p.Poll(ctx, 2, 0); err != nil || len(qms) != 0 {
+		t.Fatal(len(qms), err)
+	}
+	if qms, err := p.Poll(ctx, 2, 50*time.Millisecond); err != nil || len(qms) != 0 {
+		t.Fatal(len(qms), err)
+	}
+	q.Queue([]byte("a"))
+	if qms, err := p.Poll(ctx, 2, 0); err != nil || len(qms) != 1 {
+		t.Fatal(len(qms), err)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	q, _ := MemoryQueueFactory{Capacity: 2}.NewQueue("test")
+	q.Queue([]byte("a"))
+	q.Queue([]byte(`{"shove": {"send_at": 4102444800}, "payload": "b"}`))
+	if err := q.Queue([]byte("c")); !errors.Is(err, queue.ErrQueueFull) {
+		t.Fatal(err)
+	}
+	// In-flight messages still count
+	qm := get(t, q)
+	if err := q.Queue([]byte("c")); !errors.Is(err, queue.ErrQueueFull) {
+		t.Fatal(err)
+	}
+	q.Remove(qm)
+	if err := q.Queue([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeekPurge(t *testing.T) {
+	var purged []queue.Envelope
+	q, _ := MemoryQueueFactory{
+		OnPurge: func(envs []queue.Envelope) { purged = envs },
+	}.NewQueue("test")
+	q.Queue([]byte(`{"shove": {"send_at": 4102444800}, "payload": "d"}`))
+	q.Queue([]byte("b"))
+	q.Queue([]byte("c"))
+	q.Queue([]byte(`{"shove": {"priority": "high"}, "payload": "a"}`))
+	qm := get(t, q)
+	q.Queue([]byte("e"))
+	ctx := context.Background()
+	if n, _ := q.Len(ctx); n != 4 {
+		t.Fatal(n)
+	}
+	envs, _ := q.Peek(ctx, 10)
+	var payloads []string
+	for _, env := range envs {
+		payloads = append(payloads, string(env.Payload))
+	}
+	if got := strings.Join(payloads, ","); got != `b,c,e,"d"` {
+		t.Fatal(got, string(qm.Message()))
+	}
+	if envs, _ := q.Peek(ctx, 1); len(envs) != 1 {
+		t.Fatal(len(envs))
+	}
+	if n, _ := q.Purge(ctx); n != 4 || len(purged) != 4 {
+		t.Fatal(n, len(purged))
+	}
+	if n, _ := q.Len(ctx); n != 0 {
+		t.Fatal(n)
+	}
+	// In-flight messages survive a purge
+	if err := q.Remove(qm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFifoReclaim(t *testing.T) {
+	var f fifo
+	for i := range 5000 {
+		f.push(&memoryQueuedMessage{lane: i})
+	}
+	for i := range 5000 {
+		if qm := f.pop(); qm.lane != i {
+			t.Fatal(qm.lane, i)
+		}
+		if i == 3000 && len(f.items) > 2500 {
+			t.Fatal("space not reclaimed", len(f.items))
+		}
+	}
+	if f.pop() != nil || f.len() != 0 {
+		t.Fatal("not empty")
+	}
+}
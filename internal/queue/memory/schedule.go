@@ -0,0 +1,70 @@
+package memory
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+type scheduledMessage struct {
+	env queue.Envelope
+	due time.Time
+}
+
+// scheduledHeap orders scheduled messages by due time, earliest first.
+type scheduledHeap []scheduledMessage
+
+func (h scheduledHeap) Len() int           { return len(h) }
+func (h scheduledHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+func (h scheduledHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *scheduledHeap) Push(x any) {
+	*h = append(*h, x.(scheduledMessage))
+}
+
+func (h *scheduledHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// schedule parks env until due. Must be called with the lock held.
+func (mq *memoryQueue) schedule(env queue.Envelope, due time.Time) {
+	heap.Push(&mq.scheduled, scheduledMessage{env: env, due: due})
+	if mq.scheduled[0].due.Equal(due) {
+		mq.armTimer()
+	}
+}
+
+// armTimer makes sure promote runs when the earliest message is due. Must be
+// called with the lock held.
+func (mq *memoryQueue) armTimer() {
+	if len(mq.scheduled) == 0 || mq.shuttingDown {
+		return
+	}
+	d := time.Until(mq.scheduled[0].due)
+	if mq.timer == nil {
+		mq.timer = time.AfterFunc(d, mq.promote)
+	} else {
+		mq.timer.Reset(d)
+	}
+}
+
+// promote moves all scheduled messages that are due into the queue.
+func (mq *memoryQueue) promote() {
+	mq.lock.Lock()
+	now := time.Now()
+	for len(mq.scheduled) > 0 && !mq.scheduled[0].due.After(now) {
+		sm := heap.Pop(&mq.scheduled).(scheduledMessage)
+		mq.enqueue(&memoryQueuedMessage{
+			env:  sm.env,
+			lane: sm.env.Meta.Priority.Lane(),
+		})
+	}
+	mq.armTimer()
+	mq.lock.Unlock()
+	mq.cond.Broadcast()
+}
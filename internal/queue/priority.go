@@ -0,0 +1,76 @@
+package queue
+
+import "sync"
+
+// laneWeights is the share of dequeues each lane gets while all lanes have
+// messages waiting, so that lower lanes never starve completely.
+var laneWeights = []int{8, 3, 1}
+
+// laneSequence is the order in which lanes are preferred, repeated over and
+// over. It interleaves the lanes according to their weight.
+var laneSequence = weightedSequence(laneWeights)
+
+// weightedSequence spreads lane indices according to their weights, using
+// smooth weighted round-robin, e.g. 0 1 0 2 0 1 ... rather than 0 0 0 1 1 2.
+func weightedSequence(weights []int) []int {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	current := make([]int, len(weights))
+	seq := make([]int, 0, total)
+	for range total {
+		best := 0
+		for i, w := range weights {
+			current[i] += w
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		seq = append(seq, best)
+	}
+	return seq
+}
+
+// LaneScheduler decides in which order the consumers of a queue look at its
+// lanes. It is safe for concurrent use.
+type LaneScheduler struct {
+	mu     sync.Mutex
+	served int
+	waits  int
+}
+
+// Order returns the lane indices in the order they should be tried for the
+// next dequeue. The preferred lane comes first, followed by the others from
+// high to low priority.
+func (s *LaneScheduler) Order() []int {
+	s.mu.Lock()
+	preferred := laneSequence[s.served%len(laneSequence)]
+	s.mu.Unlock()
+	order := make([]int, 0, len(Priorities))
+	order = append(order, preferred)
+	for lane := range Priorities {
+		if lane != preferred {
+			order = append(order, lane)
+		}
+	}
+	return order
+}
+
+// Served records that a message has been dequeued.
+func (s *LaneScheduler) Served() {
+	s.mu.Lock()
+	s.served++
+	s.mu.Unlock()
+}
+
+// WaitLane returns the lane to block on when all lanes are empty, for
+// backends that can only wait for a single lane at a time. Successive calls
+// cycle through the lanes, so that idle consumers spread over all of them.
+func (s *LaneScheduler) WaitLane() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waits++
+	return s.waits % len(Priorities)
+}
@@ -0,0 +1,36 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestLaneSequence(t *testing.T) {
+	seq := weightedSequence([]int{8, 3, 1})
+	if len(seq) != 12 {
+		t.Fatal(seq)
+	}
+	counts := make([]int, 3)
+	for _, lane := range seq {
+		counts[lane]++
+	}
+	if counts[0] != 8 || counts[1] != 3 || counts[2] != 1 {
+		t.Fatal(seq)
+	}
+	if seq[0] != 0 || seq[1] == 0 && seq[2] == 0 && seq[3] == 0 {
+		t.Fatal("lanes not interleaved", seq)
+	}
+}
+
+func TestLaneSchedulerOrder(t *testing.T) {
+	var s LaneScheduler
+	for range len(laneSequence) {
+		order := s.Order()
+		if len(order) != len(Priorities) || order[0] != laneSequence[s.served] {
+			t.Fatal(order)
+		}
+		s.Served()
+	}
+	if order := s.Order(); order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Fatal(order)
+	}
+}
@@ -2,23 +2,68 @@ package queue
 
 import (
 	"context"
+	"errors"
+	"time"
 )
 
+// ErrQueueFull is returned when queueing a message to a queue that has reached
+// its capacity.
+var ErrQueueFull = errors.New("queue full")
+
 // Queue ...
 type Queue interface {
 	Queue([]byte) error
 	Get(ctx context.Context) (QueuedMessage, error)
+	// GetBatch waits for the next message like Get, and returns it along
+	// with the messages available right away, up to max messages in total.
+	GetBatch(ctx context.Context, max int) ([]QueuedMessage, error)
 	Remove(QueuedMessage) error
 	Requeue(QueuedMessage) error
 	Shutdown() error
+
+	// Len returns the number of messages waiting to be delivered, including
+	// scheduled ones but not those in flight.
+	Len(ctx context.Context) (int64, error)
+
+	// Peek returns up to limit of the waiting messages without removing them,
+	// in about the order they will be delivered.
+	Peek(ctx context.Context, limit int) ([]Envelope, error)
+
+	// Purge removes all waiting messages, returning how many were removed.
+	// Messages in flight are not affected.
+	Purge(ctx context.Context) (int64, error)
+}
+
+// Poller is implemented by queues that can be read without waiting for the
+// next message indefinitely, which lets a queue spread over others read from
+// them on demand.
+type Poller interface {
+	// Poll returns up to max of the messages available, waiting at most wait
+	// for the first one. It returns no messages and no error if none became
+	// available in time.
+	Poll(ctx context.Context, max int, wait time.Duration) ([]QueuedMessage, error)
+}
+
+// Poll polls q, which must be a Poller.
+func Poll(ctx context.Context, q Queue, max int, wait time.Duration) ([]QueuedMessage, error) {
+	p, ok := q.(Poller)
+	if !ok {
+		return nil, errors.New("queue cannot be polled")
+	}
+	return p.Poll(ctx, max, wait)
 }
 
 // QueuedMessage ...
 type QueuedMessage interface {
+	// Message returns the payload of the message.
 	Message() []byte
+	// Envelope gives access to the payload and its metadata. Changes made to
+	// the metadata are persisted when the message is requeued.
+	Envelope() *Envelope
 }
 
 // QueueFactory ...
 type QueueFactory interface {
 	NewQueue(id string) (Queue, error)
+	NewDeadLetterQueue(id string) (DeadLetterQueue, error)
 }
@@ -0,0 +1,221 @@
+package redis
+
+import (
+	"context"
+	"slices"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/redis/go-redis/v9"
+)
+
+// streamCountBatchSize is the number of entries fetched at a time when
+// counting the entries of a stream
+const streamCountBatchSize = 1000
+
+func (q *redisQueue) Len(ctx context.Context) (int64, error) {
+	cmds, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range q.keys {
+			pipe.LLen(ctx, key)
+		}
+		pipe.ZCard(ctx, scheduledKey(q.key))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sumCounts(cmds), nil
+}
+
+// Peek returns the messages of the lanes, highest priority first, followed by
+// the scheduled messages by due time.
+func (q *redisQueue) Peek(ctx context.Context, limit int) ([]queue.Envelope, error) {
+	var envs []queue.Envelope
+	for _, key := range q.keys {
+		if len(envs) >= limit {
+			break
+		}
+		// Consumers pop from the right
+		values, err := q.client.LRange(ctx, key, int64(len(envs)-limit), -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		slices.Reverse(values)
+		envs = appendEnvelopes(envs, values)
+	}
+	return peekScheduled(ctx, q.client, q.key, envs, limit)
+}
+
+// peekScheduled appends the scheduled messages of the queue stored at key to
+// envs, earliest first, up to a total of limit messages.
+func peekScheduled(ctx context.Context, client redis.Cmdable, key string, envs []queue.Envelope, limit int) ([]queue.Envelope, error) {
+	if len(envs) >= limit {
+		return envs, nil
+	}
+	values, err := client.ZRange(ctx, scheduledKey(key), 0, int64(limit-len(envs)-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return appendEnvelopes(envs, values), nil
+}
+
+func (q *redisQueue) Purge(ctx context.Context) (int64, error) {
+	keys := append([]string{scheduledKey(q.key)}, q.keys...)
+	cmds, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range q.keys {
+			pipe.LLen(ctx, key)
+		}
+		pipe.ZCard(ctx, scheduledKey(q.key))
+		pipe.Del(ctx, keys...)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sumCounts(cmds[:len(cmds)-1]), nil
+}
+
+// sumCounts adds up the results of LLEN and ZCARD commands.
+func sumCounts(cmds []redis.Cmder) (n int64) {
+	for _, cmd := range cmds {
+		n += cmd.(*redis.IntCmd).Val()
+	}
+	return
+}
+
+func appendEnvelopes(envs []queue.Envelope, values []string) []queue.Envelope {
+	for _, value := range values {
+		envs = append(envs, queue.DecodeEnvelope([]byte(value)))
+	}
+	return envs
+}
+
+// group returns the state of the consumer group on the stream at key, or nil
+// if the group does not exist.
+func (q *streamQueue) group(ctx context.Context, key string) (*redis.XInfoGroup, error) {
+	groups, err := q.client.XInfoGroups(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		if groups[i].Name == q.config.Group {
+			return &groups[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// lag returns the number of entries of the stream at key that have not been
+// delivered to the consumer group yet.
+func (q *streamQueue) lag(ctx context.Context, key string, g *redis.XInfoGroup) (int64, error) {
+	if g.Lag > 0 {
+		return g.Lag, nil
+	}
+	// Redis cannot tell the lag once entries have been deleted, count them
+	var n int64
+	start := "(" + g.LastDeliveredID
+	for {
+		msgs, err := q.client.XRangeN(ctx, key, start, "+", streamCountBatchSize).Result()
+		if err != nil {
+			return 0, err
+		}
+		n += int64(len(msgs))
+		if len(msgs) < streamCountBatchSize {
+			return n, nil
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
+
+// Len returns the number of entries not yet delivered to the consumer group,
+// including those of its retry streams, plus the number of scheduled messages
+// and retries.
+func (q *streamQueue) Len(ctx context.Context) (int64, error) {
+	cmds, err := q.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZCard(ctx, scheduledKey(q.key))
+		pipe.ZCard(ctx, scheduledKey(q.retryKey))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := sumCounts(cmds)
+	for _, key := range q.allKeys() {
+		g, err := q.group(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if g == nil {
+			continue
+		}
+		lag, err := q.lag(ctx, key, g)
+		if err != nil {
+			return 0, err
+		}
+		n += lag
+	}
+	return n, nil
+}
+
+func (q *streamQueue) Peek(ctx context.Context, limit int) ([]queue.Envelope, error) {
+	var envs []queue.Envelope
+	for _, key := range q.allKeys() {
+		if len(envs) >= limit {
+			break
+		}
+		g, err := q.group(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if g == nil {
+			continue
+		}
+		msgs, err := q.client.XRangeN(ctx, key, "("+g.LastDeliveredID, "+", int64(limit-len(envs))).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if data, ok := msg.Values[streamField].(string); ok {
+				envs = append(envs, queue.DecodeEnvelope([]byte(data)))
+			}
+		}
+	}
+	envs, err := peekScheduled(ctx, q.client, q.key, envs, limit)
+	if err != nil {
+		return nil, err
+	}
+	return peekScheduled(ctx, q.client, q.retryKey, envs, limit)
+}
+
+// Purge skips the consumer group past all entries it has not been delivered
+// yet, leaving the streams intact for other groups, and removes all scheduled
+// messages and retries.
+func (q *streamQueue) Purge(ctx context.Context) (int64, error) {
+	cmds, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZCard(ctx, scheduledKey(q.key))
+		pipe.ZCard(ctx, scheduledKey(q.retryKey))
+		pipe.Del(ctx, scheduledKey(q.key), scheduledKey(q.retryKey))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := sumCounts(cmds[:2])
+	for _, key := range q.allKeys() {
+		g, err := q.group(ctx, key)
+		if err != nil {
+			return n, err
+		}
+		if g == nil {
+			continue
+		}
+		lag, err := q.lag(ctx, key, g)
+		if err != nil {
+			return n, err
+		}
+		if err := q.client.XGroupSetID(ctx, key, q.config.Group, "$").Err(); err != nil {
+			return n, err
+		}
+		n += lag
+	}
+	return n, nil
+}
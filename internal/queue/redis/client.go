@@ -0,0 +1,120 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	wireredis "github.com/mattstrayer/shove/pkg/wire/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+// ConnConfig describes how to connect to Redis: either a single node (URL), a
+// Sentinel managed master (SentinelMaster and SentinelAddrs) or a cluster
+// (ClusterAddrs).
+type ConnConfig struct {
+	URL            string
+	SentinelMaster string
+	SentinelAddrs  []string
+	ClusterAddrs   []string
+	// Password and DB apply to Sentinel and cluster setups, a URL carries
+	// its own. Clusters only support DB 0.
+	Password string
+	DB       int
+	// PoolSize is the maximum number of connections per node.
+	PoolSize int
+}
+
+// Connect creates a client according to config and verifies that Redis can
+// be reached.
+func Connect(config ConnConfig) (redis.UniversalClient, error) {
+	if config.PoolSize <= 0 {
+		config.PoolSize = 10
+	}
+	minIdleConns := config.PoolSize / 5
+
+	var client redis.UniversalClient
+	var addr string
+	switch {
+	case len(config.ClusterAddrs) > 0:
+		addr = fmt.Sprintf("cluster %v", config.ClusterAddrs)
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        config.ClusterAddrs,
+			Password:     config.Password,
+			PoolSize:     config.PoolSize,
+			MinIdleConns: minIdleConns,
+			PoolTimeout:  time.Second * 30,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			DialTimeout:  5 * time.Second,
+		})
+	case config.SentinelMaster != "":
+		addr = fmt.Sprintf("master %s via sentinels %v", config.SentinelMaster, config.SentinelAddrs)
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    config.SentinelMaster,
+			SentinelAddrs: config.SentinelAddrs,
+			Password:      config.Password,
+			DB:            config.DB,
+			PoolSize:      config.PoolSize,
+			MinIdleConns:  minIdleConns,
+			PoolTimeout:   time.Second * 30,
+			ReadTimeout:   10 * time.Second,
+			WriteTimeout:  10 * time.Second,
+			DialTimeout:   5 * time.Second,
+		})
+	case config.URL != "":
+		opt, err := redis.ParseURL(config.URL)
+		if err != nil {
+			return nil, err
+		}
+		addr = opt.Addr
+		opt.PoolSize = config.PoolSize
+		opt.MinIdleConns = minIdleConns
+		opt.PoolTimeout = time.Second * 30  // Increase timeout for getting connection from pool
+		opt.ReadTimeout = 10 * time.Second  // Timeout for read operations
+		opt.WriteTimeout = 10 * time.Second // Timeout for write operations
+		opt.DialTimeout = 5 * time.Second   // Timeout for establishing connections
+		client = redis.NewClient(opt)
+	default:
+		return nil, errors.New("no Redis address configured")
+	}
+	slog.Info("Connecting to Redis", "address", addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	// Log connection configuration
+	poolStats := client.PoolStats()
+	slog.Info("Successfully connected to Redis", "pool_size", config.PoolSize, "min_idle", minIdleConns,
+		"pool_total", poolStats.TotalConns, "pool_idle", poolStats.IdleConns, "pool_stale", poolStats.StaleConns)
+	return client, nil
+}
+
+// DefaultNamespace prefixes all keys, unless configured otherwise.
+const DefaultNamespace = wireredis.DefaultNamespace
+
+// namespaceOrDefault returns namespace, or DefaultNamespace if it is empty.
+func namespaceOrDefault(namespace string) string {
+	if namespace == "" {
+		return DefaultNamespace
+	}
+	return namespace
+}
+
+// QueueKey returns the key of the queue of a service within namespace (or
+// DefaultNamespace if empty), see wireredis.QueueKey.
+func QueueKey(client redis.UniversalClient, namespace, id string) string {
+	return wireredis.QueueKey(client, namespace, id)
+}
+
+// FeedbackKey returns the key of the feedback list within namespace (or
+// DefaultNamespace if empty).
+func FeedbackKey(namespace string) string {
+	return namespaceOrDefault(namespace) + ":feedback"
+}
@@ -0,0 +1,103 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/redis/go-redis/v9"
+)
+
+// deadLetterQueue is a Redis-backed implementation of queue.DeadLetterQueue.
+// Dead letters are stored in the list "<queue key>:dead", newest first.
+type deadLetterQueue struct {
+	client redis.UniversalClient
+	key    string
+}
+
+func newDeadLetterQueue(client redis.UniversalClient, queueKey string) *deadLetterQueue {
+	return &deadLetterQueue{
+		client: client,
+		key:    queueKey + ":dead",
+	}
+}
+
+func (f *redisQueueFactory) NewDeadLetterQueue(id string) (queue.DeadLetterQueue, error) {
+	return newDeadLetterQueue(f.client, QueueKey(f.client, f.config.Namespace, id)), nil
+}
+
+// Push adds a dead letter to the Redis list.
+func (q *deadLetterQueue) Push(ctx context.Context, dl queue.DeadLetter) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return q.client.LPush(ctx, q.key, data).Err()
+}
+
+// Pop retrieves and removes up to limit dead letters from the tail of the list.
+func (q *deadLetterQueue) Pop(ctx context.Context, limit int) ([]queue.DeadLetter, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	pipe := q.client.TxPipeline()
+	lrangeCmd := pipe.LRange(ctx, q.key, -int64(limit), -1)
+	pipe.LTrim(ctx, q.key, 0, -int64(limit+1))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	items, err := lrangeCmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeDeadLetters(items), nil
+}
+
+// Peek retrieves up to limit dead letters without removing them.
+func (q *deadLetterQueue) Peek(ctx context.Context, limit int) ([]queue.DeadLetter, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	items, err := q.client.LRange(ctx, q.key, -int64(limit), -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeDeadLetters(items), nil
+}
+
+// Len returns the number of dead letters in the list.
+func (q *deadLetterQueue) Len(ctx context.Context) (int64, error) {
+	return q.client.LLen(ctx, q.key).Result()
+}
+
+// Purge deletes the list.
+func (q *deadLetterQueue) Purge(ctx context.Context) (int64, error) {
+	pipe := q.client.TxPipeline()
+	llenCmd := pipe.LLen(ctx, q.key)
+	pipe.Del(ctx, q.key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return llenCmd.Val(), nil
+}
+
+// decodeDeadLetters converts list items to dead letters, oldest first.
+func decodeDeadLetters(items []string) []queue.DeadLetter {
+	result := make([]queue.DeadLetter, 0, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		var dl queue.DeadLetter
+		if err := json.Unmarshal([]byte(items[i]), &dl); err != nil {
+			slog.Warn("Failed to unmarshal dead letter", "error", err)
+			continue
+		}
+		result = append(result, dl)
+	}
+	return result
+}
+
+// Ensure deadLetterQueue implements queue.DeadLetterQueue
+var _ queue.DeadLetterQueue = (*deadLetterQueue)(nil)
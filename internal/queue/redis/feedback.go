@@ -4,49 +4,36 @@ import (
 	"context"
 	"encoding/json"
 	"log/slog"
-	"time"
 
 	"github.com/mattstrayer/shove/internal/queue"
 	"github.com/redis/go-redis/v9"
 )
 
-const feedbackKey = "shove:feedback"
-
 // FeedbackStore is a Redis-backed implementation of queue.FeedbackStore.
 // Feedback is persisted to Redis and survives server restarts.
-// External systems can consume feedback directly from Redis using the key "shove:feedback".
+// External systems can consume feedback directly from Redis using the key
+// "<namespace>:feedback", "shove:feedback" by default.
 type FeedbackStore struct {
-	client *redis.Client
+	client redis.UniversalClient
+	key    string
 }
 
-// NewFeedbackStore creates a new Redis-backed feedback store using an existing client.
-func NewFeedbackStore(client *redis.Client) *FeedbackStore {
-	return &FeedbackStore{client: client}
+// NewFeedbackStore creates a new Redis-backed feedback store using an existing
+// client. An empty namespace selects DefaultNamespace.
+func NewFeedbackStore(client redis.UniversalClient, namespace string) *FeedbackStore {
+	return &FeedbackStore{client: client, key: FeedbackKey(namespace)}
 }
 
 // NewFeedbackStoreFromURL creates a new Redis-backed feedback store from a Redis URL.
-func NewFeedbackStoreFromURL(redisURL string) (*FeedbackStore, error) {
-	opt, err := redis.ParseURL(redisURL)
+func NewFeedbackStoreFromURL(redisURL, namespace string) (*FeedbackStore, error) {
+	client, err := Connect(ConnConfig{URL: redisURL})
 	if err != nil {
 		return nil, err
 	}
 
-	opt.PoolSize = 10
-	opt.MinIdleConns = 2
-	opt.PoolTimeout = time.Second * 30
-	opt.ReadTimeout = 10 * time.Second  // Timeout for read operations
-	opt.WriteTimeout = 10 * time.Second // Timeout for write operations
-	opt.DialTimeout = 5 * time.Second   // Timeout for establishing connections
-
-	client := redis.NewClient(opt)
-
-	ctx := context.Background()
-	if err := client.Ping(ctx).Err(); err != nil {
-		return nil, err
-	}
-
-	slog.Info("Redis feedback store connected", "key", feedbackKey)
-	return &FeedbackStore{client: client}, nil
+	s := NewFeedbackStore(client, namespace)
+	slog.Info("Redis feedback store connected", "key", s.key)
+	return s, nil
 }
 
 // Push adds a feedback entry to the Redis list.
@@ -56,7 +43,7 @@ func (s *FeedbackStore) Push(ctx context.Context, feedback queue.TokenFeedback)
 	if err != nil {
 		return err
 	}
-	return s.client.LPush(ctx, feedbackKey, data).Err()
+	return s.client.LPush(ctx, s.key, data).Err()
 }
 
 // Pop retrieves and removes up to limit feedback entries from the store.
@@ -67,8 +54,8 @@ func (s *FeedbackStore) Pop(ctx context.Context, limit int) ([]queue.TokenFeedba
 	}
 
 	pipe := s.client.Pipeline()
-	lrangeCmd := pipe.LRange(ctx, feedbackKey, -int64(limit), -1)
-	pipe.LTrim(ctx, feedbackKey, 0, -int64(limit+1))
+	lrangeCmd := pipe.LRange(ctx, s.key, -int64(limit), -1)
+	pipe.LTrim(ctx, s.key, 0, -int64(limit+1))
 	_, err := pipe.Exec(ctx)
 	if err != nil {
 		return nil, err
@@ -99,7 +86,7 @@ func (s *FeedbackStore) Peek(ctx context.Context, limit int) ([]queue.TokenFeedb
 		limit = 100
 	}
 
-	items, err := s.client.LRange(ctx, feedbackKey, -int64(limit), -1).Result()
+	items, err := s.client.LRange(ctx, s.key, -int64(limit), -1).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -119,7 +106,7 @@ func (s *FeedbackStore) Peek(ctx context.Context, limit int) ([]queue.TokenFeedb
 
 // Len returns the number of feedback entries in the store.
 func (s *FeedbackStore) Len(ctx context.Context) (int64, error) {
-	return s.client.LLen(ctx, feedbackKey).Result()
+	return s.client.LLen(ctx, s.key).Result()
 }
 
 // Close closes the Redis client connection.
@@ -129,4 +116,3 @@ func (s *FeedbackStore) Close() error {
 
 // Ensure FeedbackStore implements queue.FeedbackStore
 var _ queue.FeedbackStore = (*FeedbackStore)(nil)
-
@@ -0,0 +1,47 @@
+package redis
+
+import (
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	wireredis "github.com/mattstrayer/shove/pkg/wire/redis"
+)
+
+// laneWaitTimeout is how long a consumer blocks on a single lane when all
+// lanes are empty, for operations that cannot wait for several keys at once.
+const laneWaitTimeout = time.Second
+
+// laneLua defines lane(m, high, normal, bulk), which returns the key of the
+// lane an encoded message belongs in. It mirrors queue.Priority.Lane.
+const laneLua = `
+local function lane(m, high, normal, bulk)
+	local ok, env = pcall(cjson.decode, m)
+	if ok and type(env) == 'table' and type(env.shove) == 'table' then
+		if env.shove.priority == 'high' then
+			return high
+		elseif env.shove.priority == 'bulk' then
+			return bulk
+		end
+	end
+	return normal
+end
+`
+
+// laneKeys returns the keys of all lanes of the queue stored at key, indexed
+// by lane.
+func laneKeys(key string) []string {
+	keys := make([]string, len(queue.Priorities))
+	for i, p := range queue.Priorities {
+		keys[i] = wireredis.LaneKey(key, p)
+	}
+	return keys
+}
+
+// orderedKeys returns keys rearranged in the given lane order.
+func orderedKeys(keys []string, order []int) []string {
+	ordered := make([]string, len(order))
+	for i, lane := range order {
+		ordered[i] = keys[lane]
+	}
+	return ordered
+}
@@ -2,12 +2,18 @@ package redis
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mattstrayer/shove/internal/queue"
+	wireredis "github.com/mattstrayer/shove/pkg/wire/redis"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -19,77 +25,281 @@ const (
 	maxRetryDelay = 30 * time.Second
 	// initialRetryDelay is the initial delay before first retry
 	initialRetryDelay = 100 * time.Millisecond
+	// defaultVisibilityTimeout is used in reliable mode when no timeout is configured
+	defaultVisibilityTimeout = 60 * time.Second
 )
 
+// reapScript moves all messages of a dead consumer from its processing list
+// back to the front of their lanes, and forgets about the consumer.
+// KEYS[1]: consumers sorted set, KEYS[2]: processing list, KEYS[3..5]: high,
+// normal and bulk lanes
+// ARGV[1]: consumer ID
+var reapScript = redis.NewScript(laneLua + `
+local n = 0
+while true do
+	local m = redis.call('LPOP', KEYS[2])
+	if not m then
+		break
+	end
+	redis.call('RPUSH', lane(m, KEYS[3], KEYS[4], KEYS[5]), m)
+	n = n + 1
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+return n
+`)
+
+// popScript takes up to ARGV[1] messages off the lanes, without blocking,
+// emptying the first lanes first.
+// KEYS: lanes in the order to try them
+var popScript = redis.NewScript(`
+local batch = {}
+for i = 1, #KEYS do
+	while #batch < tonumber(ARGV[1]) do
+		local m = redis.call('RPOP', KEYS[i])
+		if not m then
+			break
+		end
+		batch[#batch + 1] = m
+	end
+end
+return batch
+`)
+
+// popReliableScript is popScript for reliable mode, moving the messages into
+// the processing list.
+// KEYS[1]: processing list, KEYS[2..]: lanes in the order to try them
+var popReliableScript = redis.NewScript(`
+local batch = {}
+for i = 2, #KEYS do
+	while #batch < tonumber(ARGV[1]) do
+		local m = redis.call('LMOVE', KEYS[i], KEYS[1], 'RIGHT', 'LEFT')
+		if not m then
+			break
+		end
+		batch[#batch + 1] = m
+	end
+end
+return batch
+`)
+
+// QueueConfig configures the Redis queue backend.
+type QueueConfig struct {
+	// Reliable keeps every message in a per-consumer processing list while
+	// it is being pushed, instead of dropping it from Redis on dequeue.
+	Reliable bool
+	// VisibilityTimeout is how long a consumer may go without a heartbeat
+	// before its in-flight messages are returned to the queue.
+	VisibilityTimeout time.Duration
+	// IdempotencyWindow is how long idempotency keys are remembered (0 to
+	// ignore them).
+	IdempotencyWindow time.Duration
+	// Namespace prefixes all keys, DefaultNamespace if empty.
+	Namespace string
+}
+
 type redisQueue struct {
-	client *redis.Client
-	key    string
+	client   redis.UniversalClient
+	key      string
+	keys     []string
+	lanes    queue.LaneScheduler
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	idempotencyWindow time.Duration
+
+	reliable          bool
+	consumerID        string
+	processingKey     string
+	consumersKey      string
+	visibilityTimeout time.Duration
 }
 
 type redisQueueFactory struct {
-	client *redis.Client
+	client redis.UniversalClient
+	config QueueConfig
 }
 
 type queuedMessage struct {
-	data []byte
-	id   string
+	env queue.Envelope
+	// id is the message as stored in Redis
+	id string
 }
 
-func (m queuedMessage) Message() []byte {
-	return m.data
+func (m *queuedMessage) Message() []byte {
+	return m.env.Payload
+}
+
+func (m *queuedMessage) Envelope() *queue.Envelope {
+	return &m.env
 }
 
 // NewQueueFactory creates a new Redis queue factory
-func NewQueueFactory(redisURL string) queue.QueueFactory {
-	opt, err := redis.ParseURL(redisURL)
-	if err != nil {
-		panic(err)
+func NewQueueFactory(client redis.UniversalClient, config QueueConfig) queue.QueueFactory {
+	if config.Reliable && config.VisibilityTimeout <= 0 {
+		config.VisibilityTimeout = defaultVisibilityTimeout
 	}
-	log.Printf("Connecting to Redis at: %s", opt.Addr)
-
-	// Configure connection pool settings
-	opt.PoolSize = 50                  // Increase from default 10
-	opt.MinIdleConns = 10              // Maintain some minimum idle connections
-	opt.PoolTimeout = time.Second * 30 // Increase timeout for getting connection from pool
-	opt.ReadTimeout = 10 * time.Second  // Timeout for read operations
-	opt.WriteTimeout = 10 * time.Second // Timeout for write operations
-	opt.DialTimeout = 5 * time.Second   // Timeout for establishing connections
+	return &redisQueueFactory{client: client, config: config}
+}
 
-	client := redis.NewClient(opt)
+func (f *redisQueueFactory) NewQueue(id string) (queue.Queue, error) {
+	key := QueueKey(f.client, f.config.Namespace, id)
+	slog.Info("Creating new Redis queue", "key", key)
+	q := &redisQueue{
+		client: f.client,
+		key:    key,
+		keys:   laneKeys(key),
+		stop:   make(chan struct{}),
 
-	// Test connection
-	ctx := context.Background()
-	if err := client.Ping(ctx).Err(); err != nil {
-		log.Printf("Redis connection error: %v", err)
-		panic(err)
+		idempotencyWindow: f.config.IdempotencyWindow,
 	}
+	if f.config.Reliable {
+		consumerID, err := newConsumerID()
+		if err != nil {
+			return nil, err
+		}
+		q.reliable = true
+		q.consumerID = consumerID
+		q.processingKey = q.processingKeyOf(consumerID)
+		q.consumersKey = fmt.Sprintf("%s:consumers", key)
+		q.visibilityTimeout = f.config.VisibilityTimeout
+		if err := q.heartbeat(); err != nil {
+			return nil, err
+		}
+		q.wg.Add(2)
+		go q.heartbeatLoop()
+		go q.reapLoop()
+		slog.Info("Reliable mode enabled", "queue", key, "consumer", consumerID, "visibility_timeout", q.visibilityTimeout)
+	}
+	q.wg.Add(1)
+	go q.promoteLoop()
+	return q, nil
+}
 
-	// Log connection configuration
-	poolStats := client.PoolStats()
-	log.Printf("Successfully connected to Redis (pool: size=%d, min_idle=%d, read_timeout=%v, write_timeout=%v, dial_timeout=%v)",
-		opt.PoolSize, opt.MinIdleConns, opt.ReadTimeout, opt.WriteTimeout, opt.DialTimeout)
-	log.Printf("Redis connection pool stats: total=%d, idle=%d, stale=%d",
-		poolStats.TotalConns, poolStats.IdleConns, poolStats.StaleConns)
-
-	return &redisQueueFactory{client: client}
+// newConsumerID returns an identifier that is unique for this process.
+func newConsumerID() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(buf[:])), nil
 }
 
-func (f *redisQueueFactory) NewQueue(id string) (queue.Queue, error) {
-	key := fmt.Sprintf("shove:%s", id)
-	log.Printf("Creating new Redis queue with key: %s", key)
-	return &redisQueue{
-		client: f.client,
-		key:    key,
-	}, nil
+func (q *redisQueue) processingKeyOf(consumerID string) string {
+	return fmt.Sprintf("%s:processing:%s", q.key, consumerID)
 }
 
 func (q *redisQueue) Queue(data []byte) error {
 	ctx := context.Background()
-	log.Printf("Pushing message to queue: %s", q.key)
-	return q.client.LPush(ctx, q.key, data).Err()
+	slog.Debug("Pushing message to queue", "queue", q.key)
+	return wireredis.Push(ctx, q.client, q.key, data, q.idempotencyWindow)
+}
+
+// pop takes up to max messages off the lanes, looking at them in the order
+// given by the lane scheduler. If all lanes are empty, it blocks for at most
+// wait waiting for the next message, or not at all if wait is not positive.
+// In reliable mode the messages are atomically moved into the processing list
+// of this consumer. Returns redis.Nil when no message became available.
+func (q *redisQueue) pop(ctx context.Context, max int, wait time.Duration) ([]queue.QueuedMessage, error) {
+	var values []string
+	var err error
+	order := q.lanes.Order()
+	if q.reliable {
+		values, err = q.popReliable(ctx, order, max, wait)
+	} else {
+		values, err = q.popList(ctx, order, max, wait)
+	}
+	if err != nil {
+		return nil, err
+	}
+	batch := make([]queue.QueuedMessage, len(values))
+	for i, value := range values {
+		q.lanes.Served()
+		batch[i] = &queuedMessage{
+			env: queue.DecodeEnvelope([]byte(value)),
+			id:  value,
+		}
+	}
+	slog.Debug("Received messages from queue", "queue", q.key, "count", len(batch))
+	return batch, nil
+}
+
+// popList takes the messages off the lanes, waiting for a single message
+// using BRPOP if there is none.
+func (q *redisQueue) popList(ctx context.Context, order []int, max int, wait time.Duration) ([]string, error) {
+	keys := orderedKeys(q.keys, order)
+	values, err := popScript.Run(ctx, q.client, keys, max).StringSlice()
+	if err != nil || len(values) > 0 {
+		return values, err
+	}
+	if wait <= 0 {
+		return nil, redis.Nil
+	}
+	values, err = q.client.BRPop(ctx, wait, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	// BRPop returns empty slice on timeout (no messages), continue waiting
+	if len(values) == 0 {
+		return nil, redis.Nil
+	}
+	if len(values) != 2 {
+		return nil, fmt.Errorf("unexpected redis response")
+	}
+	return values[1:], nil
+}
+
+// popReliable moves the messages into the processing list. BLMOVE can only
+// wait for a single list, so when all lanes are empty, it waits for at most
+// laneWaitTimeout on one lane, leaving the others to other consumers.
+func (q *redisQueue) popReliable(ctx context.Context, order []int, max int, wait time.Duration) ([]string, error) {
+	keys := append([]string{q.processingKey}, orderedKeys(q.keys, order)...)
+	values, err := popReliableScript.Run(ctx, q.client, keys, max).StringSlice()
+	if err != nil || len(values) > 0 {
+		return values, err
+	}
+	if wait <= 0 {
+		return nil, redis.Nil
+	}
+	lane := q.keys[q.lanes.WaitLane()]
+	value, err := q.client.BLMove(ctx, lane, q.processingKey, "RIGHT", "LEFT", min(wait, laneWaitTimeout)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return []string{value}, nil
 }
 
 func (q *redisQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
+	batch, err := q.GetBatch(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return batch[0], nil
+}
+
+func (q *redisQueue) GetBatch(ctx context.Context, max int) ([]queue.QueuedMessage, error) {
+	return getWithRetry(ctx, q.client, q.key, func(ctx context.Context) ([]queue.QueuedMessage, error) {
+		return q.pop(ctx, max, brPopTimeout)
+	})
+}
+
+// Poll takes up to max messages off the lanes, waiting at most wait for one
+// if they are all empty.
+func (q *redisQueue) Poll(ctx context.Context, max int, wait time.Duration) ([]queue.QueuedMessage, error) {
+	batch, err := q.pop(ctx, max, wait)
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return batch, err
+}
+
+// getWithRetry keeps calling pop until it returns messages, riding out
+// timeouts (signalled by redis.Nil) and connection errors.
+func getWithRetry(ctx context.Context, client redis.UniversalClient, key string, pop func(context.Context) ([]queue.QueuedMessage, error)) ([]queue.QueuedMessage, error) {
 	retryDelay := initialRetryDelay
 	retryCount := 0
 	wasRetrying := false
@@ -103,11 +313,11 @@ func (q *redisQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
 		if wasRetrying {
 			// Verify connection health before retrying
 			pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
-			if err := q.client.Ping(pingCtx).Err(); err != nil {
-				log.Printf("Redis connection health check failed for queue %s: %v", q.key, err)
+			if err := client.Ping(pingCtx).Err(); err != nil {
+				slog.Warn("Redis connection health check failed", "queue", key, "error", err)
 				cancel()
 			} else {
-				log.Printf("Redis connection restored for queue %s after %d retry attempts", q.key, retryCount)
+				slog.Info("Redis connection restored", "queue", key, "retry_count", retryCount)
 				wasRetrying = false
 				retryCount = 0
 				retryDelay = initialRetryDelay
@@ -115,18 +325,16 @@ func (q *redisQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
 			cancel()
 		}
 
-		// Use a timeout for BRPop to allow periodic context checks and connection health verification
-		result := q.client.BRPop(ctx, brPopTimeout, q.key)
+		// Use a timeout for the blocking pop to allow periodic context checks and connection health verification
+		batch, err := pop(ctx)
 
-		if result.Err() != nil {
+		if err != nil {
 			// Check if context was cancelled
 			if ctx.Err() != nil {
 				return nil, ctx.Err()
 			}
 
-			err := result.Err()
-			
-			// redis.Nil is expected when BRPop times out (no messages available)
+			// redis.Nil is expected when the pop times out (no messages available)
 			// This is not an error, just continue waiting
 			if err == redis.Nil {
 				continue
@@ -136,9 +344,9 @@ func (q *redisQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
 			if isConnectionError(err) {
 				retryCount++
 				wasRetrying = true
-				poolStats := q.client.PoolStats()
-				log.Printf("Connection error getting message from queue %s: %v (retry %d, pool: total=%d idle=%d stale=%d, retrying in %v)",
-					q.key, err, retryCount, poolStats.TotalConns, poolStats.IdleConns, poolStats.StaleConns, retryDelay)
+				poolStats := client.PoolStats()
+				slog.Warn("Connection error getting message from queue", "queue", key, "error", err, "retry_count", retryCount,
+					"pool_total", poolStats.TotalConns, "pool_idle", poolStats.IdleConns, "pool_stale", poolStats.StaleConns, "retry_delay", retryDelay)
 
 				// Wait before retrying, respecting context cancellation
 				select {
@@ -155,33 +363,15 @@ func (q *redisQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
 			}
 
 			// For non-connection errors, return immediately
-			log.Printf("Error getting message from queue %s: %v", q.key, err)
+			slog.Error("Error getting message from queue", "queue", key, "error", err)
 			return nil, err
 		}
 
 		// Reset retry state on success
 		if wasRetrying {
-			log.Printf("Successfully recovered connection for queue %s", q.key)
-			wasRetrying = false
-			retryCount = 0
-		}
-		retryDelay = initialRetryDelay
-
-		values := result.Val()
-		// BRPop returns empty slice on timeout (no messages), continue waiting
-		if len(values) == 0 {
-			continue
+			slog.Info("Successfully recovered connection", "queue", key)
 		}
-
-		if len(values) != 2 {
-			return nil, fmt.Errorf("unexpected redis response")
-		}
-
-		log.Printf("Received message from queue: %s", q.key)
-		return &queuedMessage{
-			data: []byte(values[1]),
-			id:   values[1],
-		}, nil
+		return batch, nil
 	}
 }
 
@@ -199,15 +389,124 @@ func isConnectionError(err error) bool {
 }
 
 func (q *redisQueue) Remove(msg queue.QueuedMessage) error {
-	// Message is already removed by BRPop
-	return nil
+	if !q.reliable {
+		// Message is already removed by BRPop
+		return nil
+	}
+	ctx := context.Background()
+	return q.client.LRem(ctx, q.processingKey, 1, msg.(*queuedMessage).id).Err()
 }
 
+// Requeue puts the message back into its lane, or into the scheduled set if
+// it is to be retried later.
 func (q *redisQueue) Requeue(msg queue.QueuedMessage) error {
 	ctx := context.Background()
-	return q.client.LPush(ctx, q.key, msg.Message()).Err()
+	data, err := msg.Envelope().Encode()
+	if err != nil {
+		return err
+	}
+	_, err = q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if q.reliable {
+			pipe.LRem(ctx, q.processingKey, 1, msg.(*queuedMessage).id)
+		}
+		return wireredis.Push(ctx, pipe, q.key, data, 0)
+	})
+	return err
 }
 
-func (q *redisQueue) Shutdown() error {
+// heartbeat announces that this consumer is alive.
+func (q *redisQueue) heartbeat() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return q.client.ZAdd(ctx, q.consumersKey, redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: q.consumerID,
+	}).Err()
+}
+
+func (q *redisQueue) heartbeatLoop() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.visibilityTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			if err := q.heartbeat(); err != nil {
+				slog.Warn("Heartbeat failed", "queue", q.key, "error", err)
+			}
+		}
+	}
+}
+
+func (q *redisQueue) reapLoop() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.visibilityTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			q.reap()
+		}
+	}
+}
+
+// reap returns the in-flight messages of consumers that stopped sending
+// heartbeats to the queue.
+func (q *redisQueue) reap() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cutoff := time.Now().Add(-q.visibilityTimeout).Unix()
+	consumers, err := q.client.ZRangeByScore(ctx, q.consumersKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(cutoff, 10),
+	}).Result()
+	if err != nil {
+		slog.Error("Unable to list consumers of queue", "queue", q.key, "error", err)
+		return
+	}
+	for _, consumerID := range consumers {
+		keys := append([]string{q.consumersKey, q.processingKeyOf(consumerID)}, q.keys...)
+		n, err := reapScript.Run(ctx, q.client, keys, consumerID).Int()
+		if err != nil {
+			slog.Error("Unable to recover messages of consumer", "queue", q.key, "consumer", consumerID, "error", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("Recovered in-flight messages of dead consumer", "queue", q.key, "consumer", consumerID, "count", n)
+		}
+	}
+}
+
+// Shutdown stops the background loops. In reliable mode, the messages still
+// in the processing list are moved back to their lanes right away, rather
+// than being left for the reaper of another consumer.
+func (q *redisQueue) Shutdown() (err error) {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+		q.wg.Wait()
+		if q.reliable {
+			err = q.release()
+		}
+	})
+	return err
+}
+
+// release returns the messages in the processing list of this consumer to
+// their lanes, and forgets about the consumer.
+func (q *redisQueue) release() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	keys := append([]string{q.consumersKey, q.processingKey}, q.keys...)
+	n, err := reapScript.Run(ctx, q.client, keys, q.consumerID).Int()
+	if err != nil {
+		return fmt.Errorf("unable to requeue in-flight messages of queue %s: %w", q.key, err)
+	}
+	if n > 0 {
+		slog.Info("Requeued in-flight messages on shutdown", "queue", q.key, "count", n)
+	}
 	return nil
 }
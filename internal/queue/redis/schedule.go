@@ -0,0 +1,72 @@
+package redis
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	wireredis "github.com/mattstrayer/shove/pkg/wire/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// promoteInterval is how often due messages are moved into the queue
+	promoteInterval = time.Second
+	// promoteBatchSize is the maximum number of messages moved per script run
+	promoteBatchSize = 100
+)
+
+// promoteScript moves messages that are due from the scheduled set to their
+// lanes of the queue.
+// KEYS[1]: scheduled sorted set, KEYS[2..4]: high, normal and bulk lanes
+// ARGV[1]: current Unix time, ARGV[2]: maximum number of messages to move
+var promoteScript = redis.NewScript(laneLua + `
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, m in ipairs(due) do
+	redis.call('ZREM', KEYS[1], m)
+	redis.call('LPUSH', lane(m, KEYS[2], KEYS[3], KEYS[4]), m)
+end
+return #due
+`)
+
+// scheduledKey returns the key of the scheduled set of the queue stored at
+// key.
+func scheduledKey(key string) string {
+	return wireredis.ScheduledKey(key)
+}
+
+func (q *redisQueue) promoteLoop() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(promoteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			q.promote()
+		}
+	}
+}
+
+// promote moves all scheduled messages that are due into the queue.
+func (q *redisQueue) promote() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	keys := append([]string{scheduledKey(q.key)}, q.keys...)
+	for {
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		n, err := promoteScript.Run(ctx, q.client, keys, now, promoteBatchSize).Int()
+		if err != nil {
+			slog.Error("Unable to promote scheduled messages", "queue", q.key, "error", err)
+			return
+		}
+		if n > 0 {
+			slog.Debug("Promoted scheduled messages", "queue", q.key, "count", n)
+		}
+		if n < promoteBatchSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeLua sets now to the time of the Redis server in milliseconds, so
+// that the clocks of the replicas do not need to agree.
+const redisTimeLua = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+`
+
+// squashRateLua defines allowed_at(pushes, held, max, per), which returns
+// when the next push to a destination may be made, now at the earliest, and
+// record_push(pushes, id, per), which records a push made now.
+const squashRateLua = `
+local function allowed_at(pushes, held, max, per)
+	redis.call('ZREMRANGEBYSCORE', pushes, '-inf', now - per)
+	local at = now
+	local count = redis.call('ZCARD', pushes)
+	if count >= max then
+		local oldest = redis.call('ZRANGE', pushes, count - max, count - max, 'WITHSCORES')
+		at = tonumber(oldest[2]) + per
+	end
+	return math.max(at, tonumber(redis.call('GET', held) or '0'))
+end
+local function record_push(pushes, id, per)
+	redis.call('ZADD', pushes, now, id)
+	redis.call('PEXPIRE', pushes, per)
+end
+`
+
+// squashClaimScript records a push to a destination, unless the rate is
+// exceeded, the destination is held back, or a batch to it is pending.
+// KEYS[1]: sorted set of pushes, KEYS[2]: held until, KEYS[3]: sorted set of
+// destinations with a batch pending, scored by due time
+// ARGV[1]: max. pushes per period, ARGV[2]: period in ms, ARGV[3]:
+// destination, ARGV[4]: push ID
+// Returns -1 if the push has been claimed, or else the ms to wait.
+var squashClaimScript = redis.NewScript(redisTimeLua + squashRateLua + `
+local at = allowed_at(KEYS[1], KEYS[2], tonumber(ARGV[1]), tonumber(ARGV[2]))
+local pending = redis.call('ZSCORE', KEYS[3], ARGV[3])
+if pending then
+	return math.max(at, tonumber(pending)) - now
+end
+if at > now then
+	return at - now
+end
+record_push(KEYS[1], ARGV[4], tonumber(ARGV[2]))
+return -1
+`)
+
+// squashHoldScript holds back a destination, unless it is held back longer
+// already.
+// KEYS[1]: held until
+// ARGV[1]: ms to hold back
+var squashHoldScript = redis.NewScript(redisTimeLua + `
+local till = now + tonumber(ARGV[1])
+if till > tonumber(redis.call('GET', KEYS[1]) or '0') then
+	redis.call('SET', KEYS[1], till, 'PX', ARGV[1])
+end
+return 0
+`)
+
+// squashAddScript adds a message to the batch of a destination, which becomes
+// due after the given time unless pending already.
+// KEYS[1]: sorted set of destinations with a batch pending, KEYS[2]: batch
+// ARGV[1]: destination, ARGV[2]: message, ARGV[3]: ms until due
+var squashAddScript = redis.NewScript(redisTimeLua + `
+redis.call('RPUSH', KEYS[2], ARGV[2])
+redis.call('ZADD', KEYS[1], 'NX', now + tonumber(ARGV[3]), ARGV[1])
+return 0
+`)
+
+// squashTakeScript takes the batch of a destination if it is due, and the
+// rate and hold of the destination allow for a push, which is recorded.
+// Otherwise the batch is postponed until they do, or until the batch taken
+// before is sent. The batch is moved to the taken list of the destination and
+// leased to the caller until it is done with it.
+// KEYS[1]: sorted set of destinations with a batch pending, KEYS[2]: batch,
+// KEYS[3]: attempts of the batch, KEYS[4]: sorted set of pushes, KEYS[5]: held
+// until, KEYS[6]: sorted set of destinations with a batch taken, scored by
+// lease expiry, KEYS[7]: taken batch, KEYS[8]: lease of the taken batch
+// ARGV[1]: destination, ARGV[2]: max. pushes per period, ARGV[3]: period in
+// ms, ARGV[4]: push ID, ARGV[5]: lease in ms
+// Returns {-1, attempts, messages...} if taken, or else {ms to wait}.
+var squashTakeScript = redis.NewScript(redisTimeLua + squashRateLua + `
+local due = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not due then
+	return {0}
+end
+due = tonumber(due)
+if due > now then
+	return {due - now}
+end
+local leased = redis.call('ZSCORE', KEYS[6], ARGV[1])
+if leased then
+	redis.call('ZADD', KEYS[1], leased, ARGV[1])
+	return {0}
+end
+local per = tonumber(ARGV[3])
+local at = allowed_at(KEYS[4], KEYS[5], tonumber(ARGV[2]), per)
+if at > now then
+	redis.call('ZADD', KEYS[1], at, ARGV[1])
+	return {0}
+end
+record_push(KEYS[4], ARGV[4], per)
+redis.call('ZREM', KEYS[1], ARGV[1])
+local attempts = tonumber(redis.call('GET', KEYS[3]) or '0')
+local taken = {-1, attempts}
+for _, m in ipairs(redis.call('LRANGE', KEYS[2], 0, -1)) do
+	taken[#taken + 1] = m
+end
+if #taken > 2 then
+	redis.call('RENAME', KEYS[2], KEYS[7])
+end
+redis.call('DEL', KEYS[3])
+redis.call('HSET', KEYS[8], 'id', ARGV[4], 'attempts', attempts)
+redis.call('ZADD', KEYS[6], now + tonumber(ARGV[5]), ARGV[1])
+return taken
+`)
+
+// squashReleaseLua defines release(leases, taken, lease, destination),
+// which drops a taken batch and its lease.
+const squashReleaseLua = `
+local function release(leases, taken, lease, destination)
+	redis.call('DEL', taken, lease)
+	redis.call('ZREM', leases, destination)
+end
+`
+
+// squashPostponeScript puts back a batch ahead of the messages squashed in
+// the meantime, releasing it, unless the lease of the caller has expired.
+// KEYS[1]: sorted set of destinations with a batch pending, KEYS[2]: batch,
+// KEYS[3]: attempts of the batch, KEYS[4]: sorted set of destinations with a
+// batch taken, KEYS[5]: taken batch, KEYS[6]: lease of the taken batch
+// ARGV[1]: destination, ARGV[2]: ms until due, ARGV[3]: attempts, ARGV[4]:
+// ID the batch was taken with, ARGV[5..]: messages
+var squashPostponeScript = redis.NewScript(redisTimeLua + squashReleaseLua + `
+if redis.call('HGET', KEYS[6], 'id') ~= ARGV[4] then
+	return 0
+end
+release(KEYS[4], KEYS[5], KEYS[6], ARGV[1])
+for i = #ARGV, 5, -1 do
+	redis.call('LPUSH', KEYS[2], ARGV[i])
+end
+redis.call('SET', KEYS[3], ARGV[3])
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+return 0
+`)
+
+// squashDoneScript releases a batch that has been dealt with, unless the
+// lease of the caller has expired. The batch squashed to the destination in
+// the meantime may be taken right away.
+// KEYS[1]: sorted set of destinations with a batch pending, KEYS[2]: sorted
+// set of destinations with a batch taken, KEYS[3]: taken batch, KEYS[4]: lease
+// of the taken batch
+// ARGV[1]: destination, ARGV[2]: ID the batch was taken with
+var squashDoneScript = redis.NewScript(redisTimeLua + squashReleaseLua + `
+if redis.call('HGET', KEYS[4], 'id') ~= ARGV[2] then
+	return 0
+end
+release(KEYS[2], KEYS[3], KEYS[4], ARGV[1])
+local due = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if due and tonumber(due) > now then
+	redis.call('ZADD', KEYS[1], now, ARGV[1])
+end
+return 0
+`)
+
+// squashExpiredScript returns the destinations whose taken batch has not been
+// released in time.
+// KEYS[1]: sorted set of destinations with a batch taken
+var squashExpiredScript = redis.NewScript(redisTimeLua + `
+return redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now)
+`)
+
+// squashReapScript puts back a taken batch whose lease has expired ahead of
+// the messages squashed in the meantime, to be sent right away.
+// KEYS[1]: sorted set of destinations with a batch pending, KEYS[2]: batch,
+// KEYS[3]: attempts of the batch, KEYS[4]: sorted set of destinations with a
+// batch taken, KEYS[5]: taken batch, KEYS[6]: lease of the taken batch
+// ARGV[1]: destination
+// Returns the number of messages put back.
+var squashReapScript = redis.NewScript(redisTimeLua + squashReleaseLua + `
+local expiry = redis.call('ZSCORE', KEYS[4], ARGV[1])
+if not expiry or tonumber(expiry) > now then
+	return 0
+end
+local taken = redis.call('LRANGE', KEYS[5], 0, -1)
+for i = #taken, 1, -1 do
+	redis.call('LPUSH', KEYS[2], taken[i])
+end
+if #taken > 0 then
+	redis.call('SET', KEYS[3], redis.call('HGET', KEYS[6], 'attempts') or '0')
+	redis.call('ZADD', KEYS[1], now, ARGV[1])
+end
+release(KEYS[4], KEYS[5], KEYS[6], ARGV[1])
+return #taken
+`)
+
+// squashLease is how long a replica may take to send a batch before it is put
+// back to be sent by another.
+const squashLease = 5 * time.Minute
+
+// SquashKey returns the prefix of the keys keeping the rate window and the
+// batch of a destination of the squasher of a service within namespace (or
+// DefaultNamespace if empty).
+func SquashKey(client redis.UniversalClient, namespace, id, destination string) string {
+	return QueueKey(client, namespace, id) + ":squash:" + destination
+}
+
+// squashedKey returns the key of the sorted set of the destinations of a
+// service with a batch pending.
+func squashedKey(client redis.UniversalClient, namespace, id string) string {
+	return QueueKey(client, namespace, id) + ":squashed"
+}
+
+// leasesKey returns the key of the sorted set of the destinations of a service
+// with a batch taken.
+func leasesKey(client redis.UniversalClient, namespace, id string) string {
+	return QueueKey(client, namespace, id) + ":squash-leases"
+}
+
+// SquashStore is a Redis-backed implementation of services.SquashStore,
+// shared by all replicas consuming the queue of a service. The pushes to a
+// destination are kept in the sorted set "<squash key>:pushes", and the time
+// it is held back until in "<squash key>:held". Squashed messages are moved
+// out of their queue into the list "<squash key>:batch", and the destinations
+// with a batch pending are kept in the sorted set "<queue key>:squashed",
+// scored by due time, so that any replica can send a batch once it is due.
+// A batch being sent is kept in the list "<squash key>:taken" until the
+// replica sending it is done with it. Its lease is kept in the hash
+// "<squash key>:lease" and the sorted set "<queue key>:squash-leases", scored
+// by expiry, from which batches not released in time, e.g. as their replica
+// died, are put back to be sent again.
+type SquashStore struct {
+	client    redis.UniversalClient
+	namespace string
+	id        string
+	keyring   *queue.Keyring
+	// replica identifies this replica among those sharing the store
+	replica string
+	pushes  atomic.Uint64
+	// lease is how long a replica may take to send a batch
+	lease time.Duration
+
+	lock sync.Mutex
+	// taken holds the IDs the batches being sent by this replica were taken
+	// with, by destination
+	taken map[string]string
+}
+
+// squashedMessage is a message of a batch taken off the store.
+type squashedMessage struct {
+	env queue.Envelope
+}
+
+func (m *squashedMessage) Message() []byte {
+	return m.env.Payload
+}
+
+func (m *squashedMessage) Envelope() *queue.Envelope {
+	return &m.env
+}
+
+// NewSquashStore creates a squash store for the service id within namespace
+// (or DefaultNamespace if empty). The payloads of the squashed messages are
+// encrypted using keyring, if not nil.
+func NewSquashStore(client redis.UniversalClient, namespace, id string, keyring *queue.Keyring) (*SquashStore, error) {
+	replica, err := queue.NewID()
+	if err != nil {
+		return nil, err
+	}
+	return &SquashStore{
+		client:    client,
+		namespace: namespace,
+		id:        id,
+		keyring:   keyring,
+		replica:   replica,
+		lease:     squashLease,
+		taken:     make(map[string]string),
+	}, nil
+}
+
+func (s *SquashStore) pushID() string {
+	return s.replica + ":" + strconv.FormatUint(s.pushes.Add(1), 10)
+}
+
+// encode encodes a message to be kept in a batch. The idempotency key is
+// dropped, as the message has been accepted already.
+func (s *SquashStore) encode(qm queue.QueuedMessage) (string, error) {
+	env := *qm.Envelope()
+	env.Meta.IdempotencyKey = ""
+	if s.keyring != nil {
+		if err := s.keyring.Encrypt(&env); err != nil {
+			return "", err
+		}
+	}
+	data, err := env.Encode()
+	return string(data), err
+}
+
+func (s *SquashStore) decode(data string) (queue.QueuedMessage, error) {
+	env := queue.DecodeEnvelope([]byte(data))
+	if s.keyring != nil {
+		if err := s.keyring.Decrypt(&env); err != nil {
+			return nil, err
+		}
+	}
+	return &squashedMessage{env: env}, nil
+}
+
+func (s *SquashStore) Claim(ctx context.Context, key string, max int, per time.Duration) (claimed bool, wait time.Duration, err error) {
+	prefix := SquashKey(s.client, s.namespace, s.id, key)
+	keys := []string{prefix + ":pushes", prefix + ":held", squashedKey(s.client, s.namespace, s.id)}
+	ms, err := squashClaimScript.Run(ctx, s.client, keys, max, per.Milliseconds(), key, s.pushID()).Int64()
+	if err != nil || ms < 0 {
+		return err == nil, 0, err
+	}
+	return false, time.Duration(ms) * time.Millisecond, nil
+}
+
+func (s *SquashStore) Hold(ctx context.Context, key string, wait time.Duration) error {
+	keys := []string{SquashKey(s.client, s.namespace, s.id, key) + ":held"}
+	return squashHoldScript.Run(ctx, s.client, keys, max(wait.Milliseconds(), 1)).Err()
+}
+
+// Squash moves the message out of q into the batch of the destination.
+func (s *SquashStore) Squash(ctx context.Context, q queue.Queue, key string, qm queue.QueuedMessage, wait time.Duration) error {
+	data, err := s.encode(qm)
+	if err != nil {
+		return err
+	}
+	keys := []string{squashedKey(s.client, s.namespace, s.id), SquashKey(s.client, s.namespace, s.id, key) + ":batch"}
+	if err := squashAddScript.Run(ctx, s.client, keys, key, data, wait.Milliseconds()).Err(); err != nil {
+		return err
+	}
+	return q.Remove(qm)
+}
+
+// Take takes the next batch that is due, after putting back the batches whose
+// lease has expired.
+func (s *SquashStore) Take(ctx context.Context, max int, per time.Duration) (key string, qms []queue.QueuedMessage, attempts int, wait time.Duration, err error) {
+	if err = s.reap(ctx); err != nil {
+		return "", nil, 0, 0, err
+	}
+	squashed := squashedKey(s.client, s.namespace, s.id)
+	next, err := s.client.ZRange(ctx, squashed, 0, 0).Result()
+	if err != nil || len(next) == 0 {
+		return "", nil, 0, -1, err
+	}
+	key = next[0]
+	prefix := SquashKey(s.client, s.namespace, s.id, key)
+	keys := []string{squashed, prefix + ":batch", prefix + ":attempts", prefix + ":pushes", prefix + ":held",
+		leasesKey(s.client, s.namespace, s.id), prefix + ":taken", prefix + ":lease"}
+	pushID := s.pushID()
+	taken, err := squashTakeScript.Run(ctx, s.client, keys, key, max, per.Milliseconds(), pushID, s.lease.Milliseconds()).Slice()
+	if err != nil {
+		return "", nil, 0, 0, err
+	}
+	if ms, ok := taken[0].(int64); !ok || ms >= 0 {
+		return "", nil, 0, time.Duration(ms) * time.Millisecond, nil
+	}
+	if len(taken) < 2 {
+		return "", nil, 0, 0, fmt.Errorf("unexpected redis response")
+	}
+	s.lock.Lock()
+	s.taken[key] = pushID
+	s.lock.Unlock()
+	n, _ := taken[1].(int64)
+	for _, v := range taken[2:] {
+		data, _ := v.(string)
+		qm, err := s.decode(data)
+		if err != nil {
+			// Pass it on as it is, to end up as dead letter
+			qm = &squashedMessage{env: queue.DecodeEnvelope([]byte(data))}
+		}
+		qms = append(qms, qm)
+	}
+	return key, qms, int(n), 0, nil
+}
+
+// reap puts back the batches whose lease has expired.
+func (s *SquashStore) reap(ctx context.Context) error {
+	leases := leasesKey(s.client, s.namespace, s.id)
+	expired, err := squashExpiredScript.Run(ctx, s.client, []string{leases}).StringSlice()
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		prefix := SquashKey(s.client, s.namespace, s.id, key)
+		keys := []string{squashedKey(s.client, s.namespace, s.id), prefix + ":batch", prefix + ":attempts",
+			leases, prefix + ":taken", prefix + ":lease"}
+		n, err := squashReapScript.Run(ctx, s.client, keys, key).Int()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			slog.Warn("Batch not sent in time, putting it back", "queue", QueueKey(s.client, s.namespace, s.id), "destination", key, "count", n)
+		}
+	}
+	return nil
+}
+
+// takenWith returns the ID a batch being sent by this replica was taken with.
+func (s *SquashStore) takenWith(key string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.taken[key]
+}
+
+// forget forgets a batch this replica is done with.
+func (s *SquashStore) forget(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.taken, key)
+}
+
+// Postpone puts back a batch taken by this replica. If its lease has expired,
+// the batch has been put back already and is left as it is.
+func (s *SquashStore) Postpone(ctx context.Context, key string, qms []queue.QueuedMessage, attempts int, wait time.Duration) error {
+	prefix := SquashKey(s.client, s.namespace, s.id, key)
+	keys := []string{squashedKey(s.client, s.namespace, s.id), prefix + ":batch", prefix + ":attempts",
+		leasesKey(s.client, s.namespace, s.id), prefix + ":taken", prefix + ":lease"}
+	args := []interface{}{key, wait.Milliseconds(), attempts, s.takenWith(key)}
+	for _, qm := range qms {
+		data, err := s.encode(qm)
+		if err != nil {
+			return err
+		}
+		args = append(args, data)
+	}
+	if err := squashPostponeScript.Run(ctx, s.client, keys, args...).Err(); err != nil {
+		return err
+	}
+	s.forget(key)
+	return nil
+}
+
+// Done drops a batch taken by this replica, unless its lease has expired.
+func (s *SquashStore) Done(ctx context.Context, key string) error {
+	prefix := SquashKey(s.client, s.namespace, s.id, key)
+	keys := []string{squashedKey(s.client, s.namespace, s.id), leasesKey(s.client, s.namespace, s.id),
+		prefix + ":taken", prefix + ":lease"}
+	if err := squashDoneScript.Run(ctx, s.client, keys, key, s.takenWith(key)).Err(); err != nil {
+		return err
+	}
+	s.forget(key)
+	return nil
+}
+
+// Remove does nothing, as the message has been taken off the store already.
+func (s *SquashStore) Remove(q queue.Queue, qm queue.QueuedMessage) error {
+	return nil
+}
+
+// Requeue queues the message to q again.
+func (s *SquashStore) Requeue(q queue.Queue, qm queue.QueuedMessage) error {
+	data, err := qm.Envelope().Encode()
+	if err != nil {
+		return err
+	}
+	return q.Queue(data)
+}
@@ -0,0 +1,223 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestSquashStore(t *testing.T, client redis.UniversalClient, keyring *queue.Keyring) *SquashStore {
+	t.Helper()
+	s, err := NewSquashStore(client, "", "test", keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSquashClaim(t *testing.T) {
+	client := newTestClient(t)
+	a := newTestSquashStore(t, client, nil)
+	b := newTestSquashStore(t, client, nil)
+	ctx := context.Background()
+
+	// The rate holds across replicas
+	for _, s := range []*SquashStore{a, b} {
+		if claimed, _, err := s.Claim(ctx, "dest", 2, time.Hour); err != nil || !claimed {
+			t.Fatal("push below the rate not claimed", err)
+		}
+	}
+	claimed, wait, err := a.Claim(ctx, "dest", 2, time.Hour)
+	if err != nil || claimed {
+		t.Fatal("push above the rate claimed", err)
+	}
+	if wait < 59*time.Minute || wait > time.Hour {
+		t.Errorf("waiting %v for the rate window", wait)
+	}
+
+	// A hold applies to all replicas
+	if err := b.Hold(ctx, "held", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	claimed, wait, err = a.Claim(ctx, "held", 2, time.Hour)
+	if err != nil || claimed {
+		t.Fatal("push to held destination claimed", err)
+	}
+	if wait < 59*time.Second || wait > time.Minute {
+		t.Errorf("waiting %v for the hold", wait)
+	}
+
+	// A pending batch is not overtaken
+	q := newTestListQueue(t, client)
+	qm := queueAndGet(t, q, `{"text":"a"}`)
+	if err := a.Squash(ctx, q, "pending", qm, 0); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, _, err := b.Claim(ctx, "pending", 2, time.Hour); err != nil || claimed {
+		t.Fatal("push overtaking a pending batch claimed", err)
+	}
+}
+
+func newTestListQueue(t *testing.T, client redis.UniversalClient) queue.Queue {
+	t.Helper()
+	q, err := NewQueueFactory(client, QueueConfig{}).NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Shutdown() })
+	return q
+}
+
+func queueAndGet(t *testing.T, q queue.Queue, data string) queue.QueuedMessage {
+	t.Helper()
+	if err := q.Queue([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	qm := getMessage(t, q, time.Second)
+	if qm == nil {
+		t.Fatal("message not delivered")
+	}
+	return qm
+}
+
+func TestSquashBatchSharedByReplicas(t *testing.T) {
+	client := newTestClient(t)
+	keyring, err := queue.NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestSquashStore(t, client, keyring)
+	b := newTestSquashStore(t, client, keyring)
+	q := newTestListQueue(t, client)
+	ctx := context.Background()
+
+	// Replica a squashes the messages, moving them out of the queue
+	for _, data := range []string{`{"text":"a"}`, `{"text":"b"}`} {
+		if err := a.Squash(ctx, q, "dest", queueAndGet(t, q, data), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := q.Len(ctx); n != 0 {
+		t.Fatalf("%d messages left in the queue", n)
+	}
+	stored, err := client.LRange(ctx, SquashKey(client, "", "test", "dest")+":batch", 0, -1).Result()
+	if err != nil || len(stored) != 2 {
+		t.Fatal(len(stored), err)
+	}
+	if strings.Contains(stored[0], "text") {
+		t.Error("squashed payload stored unencrypted")
+	}
+
+	// Replica b takes the batch once due
+	key, qms, attempts, _, err := b.Take(ctx, 10, time.Hour)
+	if err != nil || key != "dest" || len(qms) != 2 || attempts != 0 {
+		t.Fatal("batch not taken", key, len(qms), attempts, err)
+	}
+	if string(qms[0].Message()) != `{"text":"a"}` || string(qms[1].Message()) != `{"text":"b"}` {
+		t.Fatal("batch out of order", string(qms[0].Message()), string(qms[1].Message()))
+	}
+	if key, _, _, wait, err := a.Take(ctx, 10, time.Hour); err != nil || key != "" || wait >= 0 {
+		t.Fatal("batch taken twice", key, wait, err)
+	}
+
+	// A postponed batch goes ahead of the messages squashed in the meantime
+	if err := a.Squash(ctx, q, "dest", queueAndGet(t, q, `{"text":"c"}`), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Postpone(ctx, "dest", qms, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	key, qms, attempts, _, err = a.Take(ctx, 10, time.Hour)
+	if err != nil || key != "dest" || len(qms) != 3 || attempts != 1 {
+		t.Fatal("postponed batch not taken", key, len(qms), attempts, err)
+	}
+	if string(qms[2].Message()) != `{"text":"c"}` {
+		t.Fatal("postponed batch not ahead", string(qms[2].Message()))
+	}
+
+	// Messages retried on their own go back to the queue
+	if err := a.Requeue(q, qms[0]); err != nil {
+		t.Fatal(err)
+	}
+	if qm := getMessage(t, q, time.Second); qm == nil || string(qm.Message()) != `{"text":"a"}` {
+		t.Fatal("message not requeued")
+	}
+}
+
+func TestSquashTakeHonorsRate(t *testing.T) {
+	client := newTestClient(t)
+	s := newTestSquashStore(t, client, nil)
+	q := newTestListQueue(t, client)
+	ctx := context.Background()
+
+	if claimed, _, err := s.Claim(ctx, "dest", 1, time.Hour); err != nil || !claimed {
+		t.Fatal("push below the rate not claimed", err)
+	}
+	if err := s.Squash(ctx, q, "dest", queueAndGet(t, q, `{"text":"a"}`), 0); err != nil {
+		t.Fatal(err)
+	}
+	// The batch is due, but the rate does not allow for it yet
+	if key, _, _, _, err := s.Take(ctx, 1, time.Hour); err != nil || key != "" {
+		t.Fatal("batch taken above the rate", key, err)
+	}
+	if key, _, _, wait, err := s.Take(ctx, 1, time.Hour); err != nil || key != "" || wait < 59*time.Minute {
+		t.Fatal("batch not postponed until the rate allows", key, wait, err)
+	}
+}
+
+func TestSquashLease(t *testing.T) {
+	client := newTestClient(t)
+	a := newTestSquashStore(t, client, nil)
+	b := newTestSquashStore(t, client, nil)
+	q := newTestListQueue(t, client)
+	ctx := context.Background()
+	prefix := SquashKey(client, "", "test", "dest")
+
+	// Replica a takes the batch and dies before sending it
+	a.lease = time.Millisecond
+	if err := a.Squash(ctx, q, "dest", queueAndGet(t, q, `{"text":"a"}`), 0); err != nil {
+		t.Fatal(err)
+	}
+	if key, _, _, _, err := a.Take(ctx, 10, time.Hour); err != nil || key != "dest" {
+		t.Fatal("batch not taken", key, err)
+	}
+	if n, _ := client.LLen(ctx, prefix+":taken").Result(); n != 1 {
+		t.Fatalf("%d messages kept while sending, expected 1", n)
+	}
+
+	// Once the lease has expired, the batch is sent by replica b
+	time.Sleep(10 * time.Millisecond)
+	key, qms, _, _, err := b.Take(ctx, 10, time.Hour)
+	if err != nil || key != "dest" || len(qms) != 1 || string(qms[0].Message()) != `{"text":"a"}` {
+		t.Fatal("expired batch not taken again", key, len(qms), err)
+	}
+	if err := a.Done(ctx, "dest"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := client.LLen(ctx, prefix+":taken").Result(); n != 1 {
+		t.Fatal("batch released by a replica whose lease expired")
+	}
+
+	// A batch squashed in the meantime waits for the one being sent
+	if err := a.Squash(ctx, q, "dest", queueAndGet(t, q, `{"text":"b"}`), 0); err != nil {
+		t.Fatal(err)
+	}
+	if key, _, _, _, err := a.Take(ctx, 10, time.Hour); err != nil || key != "" {
+		t.Fatal("batch taken while another is sent", key, err)
+	}
+	if err := b.Done(ctx, "dest"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := client.Exists(ctx, prefix+":taken", prefix+":lease").Result(); n != 0 {
+		t.Fatal("batch kept once done")
+	}
+	key, qms, _, _, err = a.Take(ctx, 10, time.Hour)
+	if err != nil || key != "dest" || len(qms) != 1 || string(qms[0].Message()) != `{"text":"b"}` {
+		t.Fatal("batch not taken once the one before was sent", key, len(qms), err)
+	}
+}
@@ -0,0 +1,425 @@
+package redis
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	wireredis "github.com/mattstrayer/shove/pkg/wire/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// streamField is the name of the stream entry field holding the message
+	streamField = wireredis.StreamField
+	// defaultStreamGroup is used when no consumer group is configured
+	defaultStreamGroup = "shove"
+)
+
+// promoteStreamScript moves messages that are due from the scheduled set to
+// the streams of their lanes.
+// KEYS[1]: scheduled sorted set, KEYS[2..4]: high, normal and bulk lane streams
+// ARGV[1]: current Unix time, ARGV[2]: maximum number of messages to move,
+// ARGV[3]: approximate maximum stream length (0 for unlimited)
+var promoteStreamScript = redis.NewScript(laneLua + `
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, m in ipairs(due) do
+	redis.call('ZREM', KEYS[1], m)
+	local stream = lane(m, KEYS[2], KEYS[3], KEYS[4])
+	if tonumber(ARGV[3]) > 0 then
+		redis.call('XADD', stream, 'MAXLEN', '~', ARGV[3], '*', 'data', m)
+	else
+		redis.call('XADD', stream, '*', 'data', m)
+	end
+end
+return #due
+`)
+
+// StreamConfig configures the Redis Streams queue backend.
+type StreamConfig struct {
+	// Group is the consumer group. Deployments sharing a stream each track
+	// their own progress by using a different group.
+	Group string
+	// ClaimTimeout is how long a message may stay unacknowledged before
+	// another consumer claims it.
+	ClaimTimeout time.Duration
+	// MaxLen approximately caps the length of the stream (0 for unlimited).
+	MaxLen int64
+	// IdempotencyWindow is how long idempotency keys are remembered (0 to
+	// ignore them).
+	IdempotencyWindow time.Duration
+	// Namespace prefixes all keys, DefaultNamespace if empty.
+	Namespace string
+}
+
+type streamQueue struct {
+	client redis.UniversalClient
+	key    string
+	keys   []string
+	// retryKey is the key of the streams of the messages requeued by the
+	// consumer group, which other groups must not see again
+	retryKey   string
+	retryKeys  []string
+	lanes      queue.LaneScheduler
+	config     StreamConfig
+	consumerID string
+	stop       chan struct{}
+	stopOnce   sync.Once
+	wg         sync.WaitGroup
+
+	claimLock sync.Mutex
+	claims    []streamClaim
+}
+
+// streamClaim tracks the scan for stale messages of a lane.
+type streamClaim struct {
+	cursor string
+	last   time.Time
+}
+
+type streamQueueFactory struct {
+	client redis.UniversalClient
+	config StreamConfig
+}
+
+type streamMessage struct {
+	env queue.Envelope
+	// key is the stream the message was read from
+	key string
+	id  string
+	// retry tells whether key is a retry stream of the consumer group
+	retry bool
+}
+
+func (m *streamMessage) Message() []byte {
+	return m.env.Payload
+}
+
+func (m *streamMessage) Envelope() *queue.Envelope {
+	return &m.env
+}
+
+// NewStreamQueueFactory creates a queue factory backed by Redis Streams, using
+// consumer groups for at-least-once delivery.
+func NewStreamQueueFactory(client redis.UniversalClient, config StreamConfig) queue.QueueFactory {
+	if config.Group == "" {
+		config.Group = defaultStreamGroup
+	}
+	if config.ClaimTimeout <= 0 {
+		config.ClaimTimeout = defaultVisibilityTimeout
+	}
+	return &streamQueueFactory{client: client, config: config}
+}
+
+// streamRetryKey returns the key of the streams holding the messages requeued
+// by a consumer group of the stream at key, along with its scheduled set. As
+// the messages are added to the streams of the group only, other groups
+// sharing the stream do not get them again.
+func streamRetryKey(key, group string) string {
+	return key + ":retry:" + group
+}
+
+func (f *streamQueueFactory) NewQueue(id string) (queue.Queue, error) {
+	consumerID, err := newConsumerID()
+	if err != nil {
+		return nil, err
+	}
+	key := wireredis.StreamKey(f.client, f.config.Namespace, id)
+	retryKey := streamRetryKey(key, f.config.Group)
+	q := &streamQueue{
+		client:     f.client,
+		key:        key,
+		keys:       laneKeys(key),
+		retryKey:   retryKey,
+		retryKeys:  laneKeys(retryKey),
+		config:     f.config,
+		consumerID: consumerID,
+		stop:       make(chan struct{}),
+		claims:     make([]streamClaim, 2*len(queue.Priorities)),
+	}
+	for i := range q.claims {
+		q.claims[i].cursor = "0-0"
+	}
+	if err := q.createGroup(context.Background()); err != nil {
+		return nil, err
+	}
+	slog.Info("Creating new Redis stream queue", "key", q.key, "group", q.config.Group, "consumer", consumerID)
+	q.wg.Add(1)
+	go q.promoteLoop()
+	return q, nil
+}
+
+func (f *streamQueueFactory) NewDeadLetterQueue(id string) (queue.DeadLetterQueue, error) {
+	return newDeadLetterQueue(f.client, QueueKey(f.client, f.config.Namespace, id)), nil
+}
+
+// allKeys returns the streams of all lanes, followed by the retry streams of
+// the consumer group.
+func (q *streamQueue) allKeys() []string {
+	return append(append([]string(nil), q.keys...), q.retryKeys...)
+}
+
+// createGroup creates the consumer group on the streams of all lanes,
+// starting at the beginning of the streams so that messages added before the
+// first start are not missed.
+func (q *streamQueue) createGroup(ctx context.Context) error {
+	for _, key := range q.allKeys() {
+		err := q.client.XGroupCreateMkStream(ctx, key, q.config.Group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *streamQueue) Queue(data []byte) error {
+	ctx := context.Background()
+	slog.Debug("Pushing message to stream", "queue", q.key)
+	return wireredis.StreamPush(ctx, q.client, q.key, data, q.config.MaxLen, q.config.IdempotencyWindow)
+}
+
+func (q *streamQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
+	batch, err := q.GetBatch(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return batch[0], nil
+}
+
+func (q *streamQueue) GetBatch(ctx context.Context, max int) ([]queue.QueuedMessage, error) {
+	return getWithRetry(ctx, q.client, q.key, func(ctx context.Context) ([]queue.QueuedMessage, error) {
+		return q.read(ctx, max, laneWaitTimeout)
+	})
+}
+
+// Poll reads up to max messages, waiting at most wait for one if all lanes
+// are empty.
+func (q *streamQueue) Poll(ctx context.Context, max int, wait time.Duration) ([]queue.QueuedMessage, error) {
+	batch, err := q.read(ctx, max, wait)
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return batch, err
+}
+
+// read returns up to max stale messages claimed from other consumers, if any,
+// or else the new messages of the first non-empty lane, looking at the lanes
+// in the order given by the lane scheduler, and at the retry stream of a lane
+// before its stream. When all lanes are empty, it blocks for at most wait, up
+// to laneWaitTimeout, waiting on one of them, or not at all if wait is not
+// positive. Returns redis.Nil when no message became available.
+func (q *streamQueue) read(ctx context.Context, max int, wait time.Duration) ([]queue.QueuedMessage, error) {
+	batch, err := q.claim(ctx, max)
+	if len(batch) > 0 || err != nil {
+		return batch, err
+	}
+	for _, lane := range q.lanes.Order() {
+		for _, key := range []string{q.retryKeys[lane], q.keys[lane]} {
+			batch, err = q.readStream(ctx, key, max, -1)
+			if err != redis.Nil {
+				return batch, err
+			}
+		}
+	}
+	if wait <= 0 {
+		return nil, redis.Nil
+	}
+	return q.readStream(ctx, q.keys[q.lanes.WaitLane()], max, min(wait, laneWaitTimeout))
+}
+
+// readStream reads up to max new messages from the stream at key, blocking
+// for at most block, or not at all if block is negative.
+func (q *streamQueue) readStream(ctx context.Context, key string, max int, block time.Duration) ([]queue.QueuedMessage, error) {
+	streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.config.Group,
+		Consumer: q.consumerID,
+		Streams:  []string{key, ">"},
+		Count:    int64(max),
+		Block:    block,
+	}).Result()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			// The stream was deleted, start over
+			if err = q.createGroup(ctx); err == nil {
+				err = redis.Nil
+			}
+		}
+		return nil, err
+	}
+	var batch []queue.QueuedMessage
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			q.lanes.Served()
+			qm, err := q.toQueuedMessage(ctx, key, msg)
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return batch, err
+			}
+			batch = append(batch, qm)
+		}
+	}
+	if len(batch) == 0 {
+		return nil, redis.Nil
+	}
+	slog.Debug("Received messages from stream", "queue", key, "count", len(batch))
+	return batch, nil
+}
+
+// claim takes over up to max messages that have been pending for longer than
+// the claim timeout, trying the lanes from high to low priority, and then the
+// retry streams. The pending entries of a stream are scanned at most every
+// half claim timeout.
+func (q *streamQueue) claim(ctx context.Context, max int) ([]queue.QueuedMessage, error) {
+	q.claimLock.Lock()
+	defer q.claimLock.Unlock()
+	for i, key := range q.allKeys() {
+		c := &q.claims[i]
+		if c.cursor == "0-0" && time.Since(c.last) < q.config.ClaimTimeout/2 {
+			continue
+		}
+		msgs, cursor, err := q.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   key,
+			Group:    q.config.Group,
+			Consumer: q.consumerID,
+			MinIdle:  q.config.ClaimTimeout,
+			Start:    c.cursor,
+			Count:    int64(max),
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		c.cursor = cursor
+		if cursor == "0-0" {
+			c.last = time.Now()
+		}
+		var batch []queue.QueuedMessage
+		for _, msg := range msgs {
+			slog.Info("Claimed stale message from stream", "stream", key, "entry", msg.ID)
+			qm, err := q.toQueuedMessage(ctx, key, msg)
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return batch, err
+			}
+			batch = append(batch, qm)
+		}
+		if len(batch) > 0 {
+			return batch, nil
+		}
+	}
+	return nil, nil
+}
+
+func (q *streamQueue) toQueuedMessage(ctx context.Context, key string, msg redis.XMessage) (queue.QueuedMessage, error) {
+	data, ok := msg.Values[streamField].(string)
+	if !ok {
+		// Entries that were trimmed while pending come back without values
+		slog.Warn("Dropping malformed entry from stream", "stream", key, "entry", msg.ID)
+		if err := q.client.XAck(ctx, key, q.config.Group, msg.ID).Err(); err != nil {
+			return nil, err
+		}
+		return nil, redis.Nil
+	}
+	return &streamMessage{
+		env:   queue.DecodeEnvelope([]byte(data)),
+		key:   key,
+		id:    msg.ID,
+		retry: strings.HasPrefix(key, q.retryKey),
+	}, nil
+}
+
+// ack acknowledges a message. Entries of the retry streams are of no use to
+// other groups, and deleted right away.
+func (q *streamQueue) ack(ctx context.Context, pipe redis.Pipeliner, sm *streamMessage) {
+	pipe.XAck(ctx, sm.key, q.config.Group, sm.id)
+	if sm.retry {
+		pipe.XDel(ctx, sm.key, sm.id)
+	}
+}
+
+func (q *streamQueue) Remove(msg queue.QueuedMessage) error {
+	ctx := context.Background()
+	_, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		q.ack(ctx, pipe, msg.(*streamMessage))
+		return nil
+	})
+	return err
+}
+
+// Requeue adds the message to the retry stream of its lane, or to the
+// scheduled set of the retry streams if it is to be retried later. Either is
+// only seen by the consumer group, unlike the stream the message came from.
+func (q *streamQueue) Requeue(msg queue.QueuedMessage) error {
+	ctx := context.Background()
+	sm := msg.(*streamMessage)
+	data, err := sm.env.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if err := wireredis.StreamPush(ctx, pipe, q.retryKey, data, 0, 0); err != nil {
+			return err
+		}
+		q.ack(ctx, pipe, sm)
+		return nil
+	})
+	return err
+}
+
+func (q *streamQueue) promoteLoop() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(promoteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			q.promote()
+		}
+	}
+}
+
+// promote moves all scheduled messages that are due into the streams, and
+// the retries of the consumer group that are due into its retry streams.
+func (q *streamQueue) promote() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q.promoteTo(ctx, q.key, q.keys, q.config.MaxLen)
+	q.promoteTo(ctx, q.retryKey, q.retryKeys, 0)
+}
+
+// promoteTo moves the due messages of the scheduled set of the streams at key
+// to the streams of their lanes.
+func (q *streamQueue) promoteTo(ctx context.Context, key string, lanes []string, maxLen int64) {
+	keys := append([]string{scheduledKey(key)}, lanes...)
+	for {
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		n, err := promoteStreamScript.Run(ctx, q.client, keys, now, promoteBatchSize, maxLen).Int()
+		if err != nil {
+			slog.Error("Unable to promote scheduled messages", "stream", key, "error", err)
+			return
+		}
+		if n > 0 {
+			slog.Debug("Promoted scheduled messages", "stream", key, "count", n)
+		}
+		if n < promoteBatchSize {
+			return
+		}
+	}
+}
+
+func (q *streamQueue) Shutdown() error {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+	q.wg.Wait()
+	return nil
+}
@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestClient(t *testing.T) redis.UniversalClient {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func newTestStreamQueue(t *testing.T, client redis.UniversalClient, group string) *streamQueue {
+	t.Helper()
+	q, err := NewStreamQueueFactory(client, StreamConfig{Group: group}).NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Shutdown() })
+	return q.(*streamQueue)
+}
+
+// getMessage returns the next message of q, or nil if there is none within
+// wait.
+func getMessage(t *testing.T, q queue.Queue, wait time.Duration) queue.QueuedMessage {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	qm, err := q.Get(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qm
+}
+
+func TestStreamRetryStaysInGroup(t *testing.T) {
+	client := newTestClient(t)
+	a := newTestStreamQueue(t, client, "a")
+	b := newTestStreamQueue(t, client, "b")
+	if err := a.Queue([]byte(`{"text":"hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both groups get the message
+	qmA := getMessage(t, a, time.Second)
+	qmB := getMessage(t, b, time.Second)
+	if qmA == nil || qmB == nil {
+		t.Fatal("message not delivered to both groups")
+	}
+	if err := b.Remove(qmB); err != nil {
+		t.Fatal(err)
+	}
+
+	// A retry of group a is due right away, and then a second one later
+	if err := a.Requeue(qmA); err != nil {
+		t.Fatal(err)
+	}
+	qmA = getMessage(t, a, time.Second)
+	if qmA == nil || string(qmA.Message()) != `{"text":"hello"}` {
+		t.Fatal("retry not delivered to the group")
+	}
+	qmA.Envelope().Meta.RetryAt = time.Now().Add(2 * time.Second).Unix()
+	if err := a.Requeue(qmA); err != nil {
+		t.Fatal(err)
+	}
+	if qm := getMessage(t, a, 500*time.Millisecond); qm != nil {
+		t.Fatal("retry delivered before it is due")
+	}
+	time.Sleep(time.Until(time.Unix(qmA.Envelope().Meta.RetryAt+1, 0)))
+	a.promote()
+	b.promote()
+	if qmA = getMessage(t, a, time.Second); qmA == nil {
+		t.Fatal("scheduled retry not delivered to the group")
+	}
+	if err := a.Remove(qmA); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other group never sees the retries
+	if qm := getMessage(t, b, time.Second); qm != nil {
+		t.Fatal("retry of group a delivered to group b")
+	}
+	if qm := getMessage(t, a, time.Second); qm != nil {
+		t.Fatal("retry delivered twice")
+	}
+}
@@ -0,0 +1,29 @@
+package redis
+
+import (
+	"context"
+
+	wireredis "github.com/mattstrayer/shove/pkg/wire/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+// TenantRegistry is a Redis-backed implementation of queue.TenantRegistry,
+// keeping the tenants of a queue in the set "<queue key>:tenants".
+type TenantRegistry struct {
+	client    redis.UniversalClient
+	namespace string
+}
+
+// NewTenantRegistry creates a tenant registry for the queues within namespace
+// (or DefaultNamespace if empty).
+func NewTenantRegistry(client redis.UniversalClient, namespace string) *TenantRegistry {
+	return &TenantRegistry{client: client, namespace: namespace}
+}
+
+func (r *TenantRegistry) Tenants(ctx context.Context, id string) ([]string, error) {
+	return r.client.SMembers(ctx, wireredis.TenantsKey(QueueKey(r.client, r.namespace, id))).Result()
+}
+
+func (r *TenantRegistry) AddTenant(ctx context.Context, id, tenant string) error {
+	return wireredis.RegisterTenant(ctx, r.client, QueueKey(r.client, r.namespace, id), tenant)
+}
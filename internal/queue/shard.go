@@ -0,0 +1,7 @@
+package queue
+
+// Sharded is implemented by queues that spread their messages over several
+// shards, using Meta.ShardKey if set.
+type Sharded interface {
+	Shards() int
+}
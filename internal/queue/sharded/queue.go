@@ -0,0 +1,213 @@
+package sharded
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+const (
+	// pollWaitTimeout is how long a consumer waits on a single shard when all
+	// shards are empty
+	pollWaitTimeout = time.Second
+	// pollRetryDelay is how long to wait before reading from the shards again
+	// when none could be read
+	pollRetryDelay = time.Second
+)
+
+type queueFactory struct {
+	factories []queue.QueueFactory
+}
+
+// shardedQueue spreads messages over the queues of its shards. Consumers read
+// from the shards on demand, starting at the next shard in turn, so that they
+// are served by all shards.
+type shardedQueue struct {
+	shards []queue.Queue
+	picker *queue.ShardPicker
+	next   atomic.Uint32
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type shardMessage struct {
+	queue.QueuedMessage
+	shard int
+}
+
+// NewQueueFactory creates a queue factory spreading every queue over the
+// queues of factories, one per shard. Shard i of a queue uses the queue ID
+// queue.ShardID(id, i). Dead letters are kept by the first shard.
+func NewQueueFactory(factories []queue.QueueFactory) queue.QueueFactory {
+	return &queueFactory{factories: factories}
+}
+
+func (f *queueFactory) NewQueue(id string) (queue.Queue, error) {
+	shards := make([]queue.Queue, len(f.factories))
+	for i, qf := range f.factories {
+		var err error
+		if shards[i], err = qf.NewQueue(queue.ShardID(id, i)); err != nil {
+			for _, q := range shards[:i] {
+				q.Shutdown()
+			}
+			return nil, err
+		}
+	}
+	q := &shardedQueue{
+		shards: shards,
+		picker: queue.NewShardPicker(len(shards)),
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	slog.Info("Sharded queue", "queue", id, "shards", len(shards))
+	return q, nil
+}
+
+func (f *queueFactory) NewDeadLetterQueue(id string) (queue.DeadLetterQueue, error) {
+	return f.factories[0].NewDeadLetterQueue(id)
+}
+
+func (q *shardedQueue) Shards() int {
+	return len(q.shards)
+}
+
+// Queue adds the message to the shard chosen by the shard picker. The shard
+// key is dropped, as it is of no use once the message is in its shard.
+func (q *shardedQueue) Queue(data []byte) (err error) {
+	env := queue.DecodeEnvelope(data)
+	shard := q.picker.Pick(env.Meta)
+	if env.Meta.ShardKey != "" {
+		env.Meta.ShardKey = ""
+		if data, err = env.Encode(); err != nil {
+			return
+		}
+	}
+	return q.shards[shard].Queue(data)
+}
+
+func (q *shardedQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
+	batch, err := q.GetBatch(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return batch[0], nil
+}
+
+// GetBatch takes the messages available off the shards, starting at the next
+// shard in turn. When all shards are empty, it waits for pollWaitTimeout on
+// that shard before looking at all of them again.
+func (q *shardedQueue) GetBatch(ctx context.Context, max int) ([]queue.QueuedMessage, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if q.ctx.Err() != nil {
+			return nil, errors.New("queue shut down")
+		}
+		first := int(q.next.Add(1)-1) % len(q.shards)
+		batch, failed := q.poll(ctx, first, max, 0)
+		if len(batch) > 0 {
+			return batch, nil
+		}
+		if failed == len(q.shards) {
+			select {
+			case <-ctx.Done():
+			case <-q.ctx.Done():
+			case <-time.After(pollRetryDelay):
+			}
+			continue
+		}
+		if batch, _ = q.poll(ctx, first, max, pollWaitTimeout); len(batch) > 0 {
+			return batch, nil
+		}
+	}
+}
+
+// poll takes up to max messages off the shards, starting at shard first. With
+// a wait, it only waits on shard first. Returns the number of shards that
+// could not be read.
+func (q *shardedQueue) poll(ctx context.Context, first, max int, wait time.Duration) (batch []queue.QueuedMessage, failed int) {
+	n := len(q.shards)
+	if wait > 0 {
+		n = 1
+	}
+	for i := range n {
+		shard := (first + i) % len(q.shards)
+		qms, err := queue.Poll(ctx, q.shards[shard], max-len(batch), wait)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Unable to read from shard", "shard", shard, "error", err)
+			}
+			failed++
+			continue
+		}
+		for _, qm := range qms {
+			batch = append(batch, &shardMessage{QueuedMessage: qm, shard: shard})
+		}
+		if len(batch) >= max {
+			break
+		}
+	}
+	return batch, failed
+}
+
+func (q *shardedQueue) Remove(qm queue.QueuedMessage) error {
+	sm := qm.(*shardMessage)
+	return q.shards[sm.shard].Remove(sm.QueuedMessage)
+}
+
+func (q *shardedQueue) Requeue(qm queue.QueuedMessage) error {
+	sm := qm.(*shardMessage)
+	return q.shards[sm.shard].Requeue(sm.QueuedMessage)
+}
+
+func (q *shardedQueue) Len(ctx context.Context) (n int64, err error) {
+	for _, shard := range q.shards {
+		l, err := shard.Len(ctx)
+		if err != nil {
+			return 0, err
+		}
+		n += l
+	}
+	return n, nil
+}
+
+// Peek returns the waiting messages shard by shard.
+func (q *shardedQueue) Peek(ctx context.Context, limit int) ([]queue.Envelope, error) {
+	var envs []queue.Envelope
+	for _, shard := range q.shards {
+		if len(envs) >= limit {
+			break
+		}
+		peeked, err := shard.Peek(ctx, limit-len(envs))
+		if err != nil {
+			return nil, err
+		}
+		envs = append(envs, peeked...)
+	}
+	return envs, nil
+}
+
+func (q *shardedQueue) Purge(ctx context.Context) (n int64, err error) {
+	for _, shard := range q.shards {
+		purged, err := shard.Purge(ctx)
+		n += purged
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Shutdown shuts the shards down.
+func (q *shardedQueue) Shutdown() error {
+	q.cancel()
+	var errs []error
+	for _, shard := range q.shards {
+		errs = append(errs, shard.Shutdown())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,154 @@
+package sharded
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/mattstrayer/shove/internal/queue/memory"
+	"github.com/mattstrayer/shove/internal/queue/tenant"
+)
+
+func newTestQueue(t *testing.T, n int) queue.Queue {
+	t.Helper()
+	factories := make([]queue.QueueFactory, n)
+	for i := range factories {
+		factories[i] = memory.MemoryQueueFactory{}
+	}
+	return newTestQueueOver(t, factories)
+}
+
+func newTestQueueOver(t *testing.T, factories []queue.QueueFactory) queue.Queue {
+	t.Helper()
+	q, err := NewQueueFactory(factories).NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Shutdown() })
+	return q
+}
+
+func TestSpreadAndCollect(t *testing.T) {
+	q := newTestQueue(t, 3)
+	for range 6 {
+		if err := q.Queue([]byte(`"x"`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sq := q.(*shardedQueue)
+	for i, shard := range sq.shards {
+		if n, _ := shard.Len(context.Background()); n != 2 {
+			t.Fatal(i, n)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	seen := make(map[int]int)
+	for range 6 {
+		qm, err := q.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[qm.(*shardMessage).shard]++
+		if err := q.Remove(qm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(seen) != 3 {
+		t.Fatal(seen)
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	q := newTestQueue(t, 4)
+	for range 3 {
+		q.Queue([]byte(`{"shove": {"shard_key": "token"}, "payload": "x"}`))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for range 3 {
+		qm, err := q.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shard := qm.(*shardMessage).shard; shard != queue.ShardOf("token", 4) {
+			t.Fatal(shard)
+		}
+		if qm.Envelope().Meta.ShardKey != "" {
+			t.Fatal("shard key stored")
+		}
+		q.Remove(qm)
+	}
+}
+
+func TestReadOnDemand(t *testing.T) {
+	q := newTestQueue(t, 3)
+	for range 6 {
+		q.Queue([]byte(`"x"`))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	batch, err := q.GetBatch(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 4 {
+		t.Fatal(len(batch))
+	}
+	// Nothing is taken off the shards beyond what was asked for
+	if n, _ := q.Len(ctx); n != 2 {
+		t.Fatal(n)
+	}
+}
+
+func TestWaitForShard(t *testing.T) {
+	q := newTestQueue(t, 3)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		q.Queue([]byte(`"x"`))
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := q.Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardedTenants(t *testing.T) {
+	factories := make([]queue.QueueFactory, 2)
+	for i := range factories {
+		factories[i] = tenant.NewQueueFactory(memory.MemoryQueueFactory{}, tenant.Config{})
+	}
+	q := newTestQueueOver(t, factories)
+	for _, tenant := range []string{"a", "b", "a", "b"} {
+		if err := q.Queue([]byte(`{"shove": {"tenant": "` + tenant + `"}, "payload": "x"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	seen := make(map[int]int)
+	for range 4 {
+		qm, err := q.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[qm.(*shardMessage).shard]++
+		if err := q.Remove(qm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seen[0] != 2 || seen[1] != 2 {
+		t.Fatal(seen)
+	}
+
+	// Waiting for the next message works through the tenant queues as well
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		q.Queue([]byte(`{"shove": {"tenant": "c"}, "payload": "x"}`))
+	}()
+	if _, err := q.Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
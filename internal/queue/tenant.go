@@ -0,0 +1,13 @@
+package queue
+
+import "context"
+
+// TenantRegistry records the tenants of the queues, so that the sub-queues of
+// tenants are found again after a restart, or when filled by producers that
+// bypass the server.
+type TenantRegistry interface {
+	// Tenants returns the tenants of the queue with the given ID.
+	Tenants(ctx context.Context, id string) ([]string, error)
+	// AddTenant records a tenant of the queue with the given ID.
+	AddTenant(ctx context.Context, id, tenant string) error
+}
@@ -0,0 +1,438 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// discoverInterval is how often the registry is checked for new tenants,
+	// and the depth metrics are updated
+	discoverInterval = time.Second
+	// pollWaitTimeout is how long a consumer waits on a single sub-queue when
+	// all sub-queues are empty
+	pollWaitTimeout = time.Second
+	// pollRetryDelay is how long to wait before reading from the sub-queues
+	// again when none could be read
+	pollRetryDelay = time.Second
+)
+
+var depthGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "shove_queue_depth",
+	Help: "The number of messages waiting to be delivered, by tenant",
+}, []string{
+	"queue",
+	"tenant",
+})
+
+// Config configures tenant queues.
+type Config struct {
+	// Weights sets the share of the messages handed out of tenants relative
+	// to the others, which have a weight of 1.
+	Weights map[string]int
+	// Registry records the tenants, nil to only know the tenants that have
+	// been queued to since the start.
+	Registry queue.TenantRegistry
+}
+
+type queueFactory struct {
+	factory queue.QueueFactory
+	config  Config
+}
+
+// subQueue is the queue of a tenant.
+type subQueue struct {
+	tenant string
+	queue  queue.Queue
+	depth  prometheus.Gauge
+	weight int
+	// current is the smooth weighted round-robin state
+	current int
+}
+
+// tenantQueue keeps a sub-queue per tenant. Consumers read from the
+// sub-queues on demand, sharing their batches among the tenants that have
+// messages by smooth weighted round-robin.
+type tenantQueue struct {
+	id      string
+	factory queue.QueueFactory
+	config  Config
+
+	lock sync.Mutex
+	subs map[string]*subQueue
+	// order holds the sub-queues in the order of creation
+	order []*subQueue
+	// waitNext picks the sub-queue to wait on when all are empty
+	waitNext atomic.Uint32
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type tenantMessage struct {
+	queue.QueuedMessage
+	sub *subQueue
+}
+
+// NewQueueFactory creates a queue factory keeping a sub-queue per tenant for
+// each queue, using factory. The sub-queue of a tenant has the queue ID
+// queue.TenantID(id, tenant), messages without tenant are kept in the queue
+// with the ID itself. Dead letters are not kept by tenant.
+func NewQueueFactory(factory queue.QueueFactory, config Config) queue.QueueFactory {
+	return &queueFactory{
+		factory: factory,
+		config:  config,
+	}
+}
+
+func (f *queueFactory) NewQueue(id string) (queue.Queue, error) {
+	q := &tenantQueue{
+		id:      id,
+		factory: f.factory,
+		config:  f.config,
+		subs:    make(map[string]*subQueue),
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	if _, err := q.sub(""); err != nil {
+		return nil, err
+	}
+	if err := q.discover(); err != nil {
+		q.Shutdown()
+		return nil, err
+	}
+	q.wg.Add(1)
+	go q.discoverLoop()
+	return q, nil
+}
+
+func (f *queueFactory) NewDeadLetterQueue(id string) (queue.DeadLetterQueue, error) {
+	return f.factory.NewDeadLetterQueue(id)
+}
+
+// sub returns the sub-queue of a tenant, creating it if necessary.
+func (q *tenantQueue) sub(tenant string) (*subQueue, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if sub, ok := q.subs[tenant]; ok {
+		return sub, nil
+	}
+	if q.ctx.Err() != nil {
+		return nil, errors.New("queue shut down")
+	}
+	if tenant != "" && q.config.Registry != nil {
+		if err := q.config.Registry.AddTenant(q.ctx, q.id, tenant); err != nil {
+			return nil, err
+		}
+	}
+	sq, err := q.factory.NewQueue(queue.TenantID(q.id, tenant))
+	if err != nil {
+		return nil, err
+	}
+	weight := 1
+	if w, ok := q.config.Weights[tenant]; ok && w > 0 {
+		weight = w
+	}
+	sub := &subQueue{
+		tenant: tenant,
+		queue:  sq,
+		depth:  depthGauge.WithLabelValues(q.id, tenant),
+		weight: weight,
+	}
+	q.subs[tenant] = sub
+	q.order = append(q.order, sub)
+	if tenant != "" {
+		slog.Info("Added tenant to queue", "queue", q.id, "tenant", tenant)
+	}
+	return sub, nil
+}
+
+// snapshot returns the sub-queues created so far.
+func (q *tenantQueue) snapshot() []*subQueue {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]*subQueue(nil), q.order...)
+}
+
+// discover creates the sub-queues of the tenants in the registry.
+func (q *tenantQueue) discover() error {
+	if q.config.Registry == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(q.ctx, 10*time.Second)
+	defer cancel()
+	tenants, err := q.config.Registry.Tenants(ctx, q.id)
+	if err != nil {
+		return err
+	}
+	for _, tenant := range tenants {
+		if err := queue.CheckTenant(tenant); err != nil {
+			slog.Warn("Ignoring tenant of queue", "queue", q.id, "error", err)
+			continue
+		}
+		if _, err := q.sub(tenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discoverLoop picks up new tenants and updates the depth metrics.
+func (q *tenantQueue) discoverLoop() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(discoverInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := q.discover(); err != nil && q.ctx.Err() == nil {
+			slog.Error("Unable to discover tenants of queue", "queue", q.id, "error", err)
+		}
+		for _, sub := range q.snapshot() {
+			n, err := sub.queue.Len(q.ctx)
+			if err != nil {
+				continue
+			}
+			sub.depth.Set(float64(n))
+		}
+	}
+}
+
+// charge records n messages handed out of sub in the smooth weighted
+// round-robin among subs. A negative n takes back messages that were shared
+// out to sub but not handed out. The lock must be held.
+func charge(subs []*subQueue, sub *subQueue, n int) {
+	total := 0
+	for _, s := range subs {
+		s.current += n * s.weight
+		total += s.weight
+	}
+	sub.current -= n * total
+}
+
+// share shares max messages out among subs by smooth weighted round-robin,
+// returning the sub-queue of every message in turn, and how many go to each.
+func (q *tenantQueue) share(subs []*subQueue, max int) (turns []*subQueue, shares map[*subQueue]int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	shares = make(map[*subQueue]int)
+	for range max {
+		var best *subQueue
+		for _, sub := range subs {
+			if best == nil || sub.current+sub.weight > best.current+best.weight {
+				best = sub
+			}
+		}
+		charge(subs, best, 1)
+		turns = append(turns, best)
+		shares[best]++
+	}
+	return turns, shares
+}
+
+// take takes up to max messages off subs without waiting, in the order of
+// their turns. Tenants that have fewer messages than their share leave the
+// rest to the others. Returns the number of sub-queues that could not be read.
+func (q *tenantQueue) take(ctx context.Context, subs []*subQueue, max int) (batch []queue.QueuedMessage, failed int) {
+	for len(subs) > 0 && len(batch) < max {
+		turns, shares := q.share(subs, max-len(batch))
+		taken := make(map[*subQueue][]queue.QueuedMessage)
+		var left []*subQueue
+		for _, sub := range subs {
+			share := shares[sub]
+			if share == 0 {
+				left = append(left, sub)
+				continue
+			}
+			qms, err := queue.Poll(ctx, sub.queue, share, 0)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("Unable to read from queue of tenant", "queue", q.id, "tenant", sub.tenant, "error", err)
+				}
+				failed++
+			}
+			taken[sub] = wrap(sub, qms)
+			if len(qms) < share {
+				q.lock.Lock()
+				charge(subs, sub, len(qms)-share)
+				q.lock.Unlock()
+				continue
+			}
+			left = append(left, sub)
+		}
+		for _, sub := range turns {
+			if qms := taken[sub]; len(qms) > 0 {
+				batch = append(batch, qms[0])
+				taken[sub] = qms[1:]
+			}
+		}
+		subs = left
+	}
+	return batch, failed
+}
+
+func wrap(sub *subQueue, qms []queue.QueuedMessage) []queue.QueuedMessage {
+	wrapped := make([]queue.QueuedMessage, len(qms))
+	for i, qm := range qms {
+		wrapped[i] = &tenantMessage{QueuedMessage: qm, sub: sub}
+	}
+	return wrapped
+}
+
+// Queue adds the message to the sub-queue of its tenant.
+func (q *tenantQueue) Queue(data []byte) error {
+	env := queue.DecodeEnvelope(data)
+	if err := queue.CheckTenant(env.Meta.Tenant); err != nil {
+		return err
+	}
+	sub, err := q.sub(env.Meta.Tenant)
+	if err != nil {
+		return err
+	}
+	return sub.queue.Queue(data)
+}
+
+func (q *tenantQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
+	batch, err := q.GetBatch(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return batch[0], nil
+}
+
+// GetBatch takes the messages available off the sub-queues, taking turns
+// among the tenants. When all sub-queues are empty, it waits for
+// pollWaitTimeout on one of them before looking at all of them again.
+func (q *tenantQueue) GetBatch(ctx context.Context, max int) ([]queue.QueuedMessage, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if q.ctx.Err() != nil {
+			return nil, errors.New("queue shut down")
+		}
+		batch, err := q.Poll(ctx, max, pollWaitTimeout)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			case <-q.ctx.Done():
+			case <-time.After(pollRetryDelay):
+			}
+			continue
+		}
+		if len(batch) > 0 {
+			return batch, nil
+		}
+	}
+}
+
+// Poll takes the messages available off the sub-queues, taking turns among
+// the tenants. When all sub-queues are empty, it waits at most wait on one of
+// them, so that a queue spread over tenant queues can read from them on
+// demand.
+func (q *tenantQueue) Poll(ctx context.Context, max int, wait time.Duration) ([]queue.QueuedMessage, error) {
+	if q.ctx.Err() != nil {
+		return nil, errors.New("queue shut down")
+	}
+	subs := q.snapshot()
+	batch, failed := q.take(ctx, subs, max)
+	if len(batch) > 0 {
+		return batch, nil
+	}
+	if failed == len(subs) {
+		return nil, errors.New("unable to read from the queues of the tenants")
+	}
+	if wait <= 0 {
+		return nil, nil
+	}
+	sub := subs[int(q.waitNext.Add(1)-1)%len(subs)]
+	qms, err := queue.Poll(ctx, sub.queue, max, wait)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("Unable to read from queue of tenant", "queue", q.id, "tenant", sub.tenant, "error", err)
+		}
+		return nil, err
+	}
+	if len(qms) == 0 {
+		return nil, nil
+	}
+	q.lock.Lock()
+	charge(subs, sub, len(qms))
+	q.lock.Unlock()
+	return wrap(sub, qms), nil
+}
+
+func (q *tenantQueue) Remove(qm queue.QueuedMessage) error {
+	tm := qm.(*tenantMessage)
+	return tm.sub.queue.Remove(tm.QueuedMessage)
+}
+
+func (q *tenantQueue) Requeue(qm queue.QueuedMessage) error {
+	tm := qm.(*tenantMessage)
+	return tm.sub.queue.Requeue(tm.QueuedMessage)
+}
+
+// Len returns the number of waiting messages of all tenants.
+func (q *tenantQueue) Len(ctx context.Context) (n int64, err error) {
+	for _, sub := range q.snapshot() {
+		l, err := sub.queue.Len(ctx)
+		if err != nil {
+			return 0, err
+		}
+		n += l
+	}
+	return n, nil
+}
+
+// Peek returns the waiting messages tenant by tenant, starting with the
+// messages without tenant.
+func (q *tenantQueue) Peek(ctx context.Context, limit int) ([]queue.Envelope, error) {
+	var envs []queue.Envelope
+	for _, sub := range q.snapshot() {
+		if len(envs) >= limit {
+			break
+		}
+		peeked, err := sub.queue.Peek(ctx, limit-len(envs))
+		if err != nil {
+			return nil, err
+		}
+		envs = append(envs, peeked...)
+	}
+	return envs, nil
+}
+
+// Purge removes the waiting messages of all tenants.
+func (q *tenantQueue) Purge(ctx context.Context) (n int64, err error) {
+	for _, sub := range q.snapshot() {
+		purged, err := sub.queue.Purge(ctx)
+		n += purged
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Shutdown stops discovering tenants and shuts the sub-queues down.
+func (q *tenantQueue) Shutdown() error {
+	q.lock.Lock()
+	q.cancel()
+	q.lock.Unlock()
+	q.wg.Wait()
+	var errs []error
+	for _, sub := range q.snapshot() {
+		errs = append(errs, sub.queue.Shutdown())
+	}
+	return errors.Join(errs...)
+}
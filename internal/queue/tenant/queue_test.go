@@ -0,0 +1,141 @@
+package tenant
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/mattstrayer/shove/internal/queue/memory"
+)
+
+type testRegistry struct {
+	lock    sync.Mutex
+	tenants []string
+}
+
+func (r *testRegistry) Tenants(ctx context.Context, id string) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return slices.Clone(r.tenants), nil
+}
+
+func (r *testRegistry) AddTenant(ctx context.Context, id, tenant string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !slices.Contains(r.tenants, tenant) {
+		r.tenants = append(r.tenants, tenant)
+	}
+	return nil
+}
+
+func newTestQueue(t *testing.T, config Config) *tenantQueue {
+	t.Helper()
+	q, err := NewQueueFactory(memory.MemoryQueueFactory{}, config).NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Shutdown() })
+	return q.(*tenantQueue)
+}
+
+func queueTenants(t *testing.T, q queue.Queue, tenants ...string) {
+	t.Helper()
+	for _, tenant := range tenants {
+		data, _ := queue.Envelope{Meta: queue.Meta{Tenant: tenant}, Payload: []byte(`"x"`)}.Encode()
+		if err := q.Queue(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// handOut returns the tenants of the next n messages in the order they are
+// handed out.
+func handOut(t *testing.T, q *tenantQueue, n int) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	batch, err := q.GetBatch(ctx, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tenants []string
+	for _, qm := range batch {
+		tenants = append(tenants, qm.Envelope().Meta.Tenant)
+		if err := q.Remove(qm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tenants
+}
+
+func TestRoundRobin(t *testing.T) {
+	q := newTestQueue(t, Config{})
+	queueTenants(t, q, "a", "a", "a", "a", "a", "b", "b", "")
+	tenants := handOut(t, q, 8)
+	expected := []string{"", "a", "b", "a", "b", "a", "a", "a"}
+	if !slices.Equal(tenants, expected) {
+		t.Fatal(tenants)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	q := newTestQueue(t, Config{Weights: map[string]int{"a": 2}})
+	queueTenants(t, q, "a", "a", "a", "b", "b", "b")
+	tenants := handOut(t, q, 6)
+	expected := []string{"a", "b", "a", "a", "b", "b"}
+	if !slices.Equal(tenants, expected) {
+		t.Fatal(tenants)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	registry := &testRegistry{tenants: []string{"a"}}
+	q := newTestQueue(t, Config{Registry: registry})
+	if _, ok := q.subs["a"]; !ok {
+		t.Fatal("registered tenant not discovered")
+	}
+	queueTenants(t, q, "b")
+	if tenants, _ := registry.Tenants(context.Background(), "test"); !slices.Equal(tenants, []string{"a", "b"}) {
+		t.Fatal(tenants)
+	}
+	if err := q.Queue([]byte(`{"shove": {"tenant": "a:b"}, "payload": "x"}`)); err == nil {
+		t.Fatal("invalid tenant accepted")
+	}
+	if n, _ := q.Len(context.Background()); n != 1 {
+		t.Fatal(n)
+	}
+}
+
+func TestReadOnDemand(t *testing.T) {
+	q := newTestQueue(t, Config{})
+	queueTenants(t, q, "a", "a", "b", "b")
+	if tenants := handOut(t, q, 2); !slices.Equal(tenants, []string{"a", "b"}) {
+		t.Fatal(tenants)
+	}
+	// Nothing is taken off the sub-queues beyond what was asked for
+	if n, _ := q.Len(context.Background()); n != 2 {
+		t.Fatal(n)
+	}
+}
+
+func TestShutdownWhileWaiting(t *testing.T) {
+	q := newTestQueue(t, Config{})
+	done := make(chan error)
+	go func() {
+		_, err := q.Get(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Shutdown()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("message handed out after shutdown")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer not released by shutdown")
+	}
+}
@@ -0,0 +1,83 @@
+package queue
+
+import "github.com/mattstrayer/shove/pkg/wire"
+
+// The message format is defined by the wire package, so that clients outside
+// of this module can use it. It is re-exported here for the queues.
+
+// ErrDuplicate is returned when queueing a message with an idempotency key
+// that has already been queued within the idempotency window.
+var ErrDuplicate = wire.ErrDuplicate
+
+type (
+	Meta        = wire.Meta
+	Envelope    = wire.Envelope
+	Priority    = wire.Priority
+	Keyring     = wire.Keyring
+	ShardPicker = wire.ShardPicker
+)
+
+const (
+	PriorityHigh   = wire.PriorityHigh
+	PriorityNormal = wire.PriorityNormal
+	PriorityBulk   = wire.PriorityBulk
+)
+
+// Priorities lists the lanes of a queue, highest priority first.
+var Priorities = wire.Priorities
+
+func DecodeEnvelope(data []byte) Envelope {
+	return wire.DecodeEnvelope(data)
+}
+
+func NewID() (string, error) {
+	return wire.NewID()
+}
+
+func ParsePriority(s string) (Priority, error) {
+	return wire.ParsePriority(s)
+}
+
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	return wire.NewKeyring(primary, keys)
+}
+
+func ParseKeyring(s string) (*Keyring, error) {
+	return wire.ParseKeyring(s)
+}
+
+func Compress(env *Envelope, minSize int) (bool, error) {
+	return wire.Compress(env, minSize)
+}
+
+func Compressed(payload []byte) bool {
+	return wire.Compressed(payload)
+}
+
+func Decompress(env *Envelope) error {
+	return wire.Decompress(env)
+}
+
+func TenantID(id, tenant string) string {
+	return wire.TenantID(id, tenant)
+}
+
+func TenantPrefix(id string) string {
+	return wire.TenantPrefix(id)
+}
+
+func CheckTenant(tenant string) error {
+	return wire.CheckTenant(tenant)
+}
+
+func ShardID(id string, i int) string {
+	return wire.ShardID(id, i)
+}
+
+func ShardOf(key string, n int) int {
+	return wire.ShardOf(key, n)
+}
+
+func NewShardPicker(n int) *ShardPicker {
+	return wire.NewShardPicker(n)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+const defaultPeekLimit = 10
+
+// requireAdmin only lets requests carrying the admin token as bearer token
+// through to next.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + s.adminToken)
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleQueueAdmin serves the administration of the queue of a service:
+//   - GET /api/admin/queue/<service>: number of waiting messages and whether
+//     the workers are paused
+//   - GET /api/admin/queue/<service>/peek: the next waiting messages
+//   - POST /api/admin/queue/<service>/purge: remove all waiting messages
+//   - POST /api/admin/queue/<service>/pause: stop taking messages off the queue
+//   - POST /api/admin/queue/<service>/resume: continue taking messages
+//
+// Query params (peek):
+//   - limit: max number of messages to return (default 10)
+func (s *Server) handleQueueAdmin(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/admin/queue/")
+	service, action, _ := strings.Cut(path, "/")
+	wrk, ok := s.workers[service]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	method := "POST"
+	if action == "" || action == "peek" {
+		method = "GET"
+	}
+	if r.Method != method {
+		http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	switch action {
+	case "":
+		s.queueStatus(ctx, w, wrk)
+	case "peek":
+		limit := defaultPeekLimit
+		if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+			if parsed, err := strconv.Atoi(limitStr); err == nil && parsed > 0 {
+				limit = parsed
+			}
+		}
+		s.peekQueue(ctx, w, wrk, limit)
+	case "purge":
+		s.purgeQueue(ctx, w, wrk)
+	case "pause":
+		wrk.pump.Pause()
+		s.queueStatus(ctx, w, wrk)
+	case "resume":
+		wrk.pump.Resume()
+		s.queueStatus(ctx, w, wrk)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) queueStatus(ctx context.Context, w http.ResponseWriter, wrk *worker) {
+	depth, err := wrk.queue.Len(ctx)
+	if err != nil {
+		slog.Error("Failed to get queue length", "error", err, "service", wrk.service.ID())
+		http.Error(w, "Failed to get queue length", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, struct {
+		Service string `json:"service"`
+		Depth   int64  `json:"depth"`
+		Paused  bool   `json:"paused"`
+	}{Service: wrk.service.ID(), Depth: depth, Paused: wrk.pump.Paused()})
+}
+
+// peekedMessage is a queued message as shown by the admin API.
+type peekedMessage struct {
+	Meta    queue.Meta `json:"shove"`
+	Payload string     `json:"payload"`
+}
+
+func (s *Server) peekQueue(ctx context.Context, w http.ResponseWriter, wrk *worker, limit int) {
+	envs, err := wrk.queue.Peek(ctx, limit)
+	if err != nil {
+		slog.Error("Failed to peek queue", "error", err, "service", wrk.service.ID())
+		http.Error(w, "Failed to peek queue", http.StatusInternalServerError)
+		return
+	}
+
+	messages := make([]peekedMessage, len(envs))
+	for i, env := range envs {
+		messages[i] = peekedMessage{Meta: env.Meta, Payload: string(env.Payload)}
+	}
+	writeJSON(w, struct {
+		Messages []peekedMessage `json:"messages"`
+	}{Messages: messages})
+}
+
+func (s *Server) purgeQueue(ctx context.Context, w http.ResponseWriter, wrk *worker) {
+	count, err := wrk.queue.Purge(ctx)
+	if err != nil {
+		slog.Error("Failed to purge queue", "error", err, "service", wrk.service.ID())
+		http.Error(w, "Failed to purge queue", http.StatusInternalServerError)
+		return
+	}
+	slog.Warn("Purged queue", "service", wrk.service.ID(), "count", count)
+
+	writeJSON(w, struct {
+		Purged int64 `json:"purged"`
+	}{Purged: count})
+}
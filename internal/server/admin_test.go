@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mattstrayer/shove/internal/services"
+)
+
+type queueStatusResponse struct {
+	Service string `json:"service"`
+	Depth   int64  `json:"depth"`
+	Paused  bool   `json:"paused"`
+}
+
+func TestQueueAdminRequiresToken(t *testing.T) {
+	s, _ := newTestServer(t, services.PumpConfig{})
+	for _, token := range []string{"", "wrong"} {
+		w := serve(t, s, "GET", "/api/admin/queue/test", token, nil)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("token %q: status %d", token, w.Code)
+		}
+	}
+	if w := serve(t, s, "GET", "/api/admin/queue/test", testAdminToken, nil); w.Code != http.StatusOK {
+		t.Errorf("status %d", w.Code)
+	}
+}
+
+func TestQueueAdminDisabledWithoutToken(t *testing.T) {
+	s := NewServer(Config{}, nil, nil)
+	if w := serve(t, s, "GET", "/api/admin/queue/test", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("status %d", w.Code)
+	}
+}
+
+func TestQueueAdmin(t *testing.T) {
+	s, wrk := newTestServer(t, services.PumpConfig{})
+	queueMessage(t, wrk, `{"text":"a"}`)
+	queueMessage(t, wrk, `{"shove":{"priority":"high"},"payload":{"text":"b"}}`)
+
+	var status queueStatusResponse
+	serve(t, s, "GET", "/api/admin/queue/test", testAdminToken, &status)
+	if status.Service != "test" || status.Depth != 2 || status.Paused {
+		t.Errorf("status %+v", status)
+	}
+
+	var peeked struct {
+		Messages []peekedMessage `json:"messages"`
+	}
+	serve(t, s, "GET", "/api/admin/queue/test/peek?limit=1", testAdminToken, &peeked)
+	if len(peeked.Messages) != 1 || peeked.Messages[0].Payload != `{"text":"b"}` || peeked.Messages[0].Meta.Priority != "high" {
+		t.Errorf("peeked %+v", peeked.Messages)
+	}
+
+	var purged struct {
+		Purged int64 `json:"purged"`
+	}
+	if w := serve(t, s, "GET", "/api/admin/queue/test/purge", testAdminToken, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("purge by GET: status %d", w.Code)
+	}
+	serve(t, s, "POST", "/api/admin/queue/test/purge", testAdminToken, &purged)
+	if purged.Purged != 2 {
+		t.Errorf("%d messages purged, expected 2", purged.Purged)
+	}
+	serve(t, s, "GET", "/api/admin/queue/test", testAdminToken, &status)
+	if status.Depth != 0 {
+		t.Errorf("depth %d after purge", status.Depth)
+	}
+}
+
+func TestQueueAdminPause(t *testing.T) {
+	s, wrk := newTestServer(t, services.PumpConfig{})
+
+	var status queueStatusResponse
+	serve(t, s, "POST", "/api/admin/queue/test/pause", testAdminToken, &status)
+	if !status.Paused || !wrk.pump.Paused() {
+		t.Error("not paused")
+	}
+	serve(t, s, "GET", "/api/admin/queue/test", testAdminToken, &status)
+	if !status.Paused {
+		t.Error("pause not reported")
+	}
+	serve(t, s, "POST", "/api/admin/queue/test/resume", testAdminToken, &status)
+	if status.Paused || wrk.pump.Paused() {
+		t.Error("not resumed")
+	}
+}
+
+func TestQueueAdminUnknown(t *testing.T) {
+	s, _ := newTestServer(t, services.PumpConfig{})
+	if w := serve(t, s, "GET", "/api/admin/queue/unknown", testAdminToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown service: status %d", w.Code)
+	}
+	if w := serve(t, s, "POST", "/api/admin/queue/test/unknown", testAdminToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown action: status %d", w.Code)
+	}
+}
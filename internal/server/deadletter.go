@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+const defaultDeadLetterLimit = 100
+
+// handleDeadLetters serves the dead-letter queue of a service:
+//   - GET /api/dead/<service>: list dead letters without removing them
+//   - POST /api/dead/<service>/replay: move dead letters back into the live queue
+//   - POST /api/dead/<service>/purge: remove all dead letters
+//
+// Like the queue admin API, it requires the admin token.
+//
+// Query params (list and replay):
+//   - limit: max number of entries to process (default 100)
+func (s *Server) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/dead/")
+	service, action, _ := strings.Cut(path, "/")
+	wrk, ok := s.workers[service]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	limit := defaultDeadLetterLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if parsed, err := strconv.Atoi(limitStr); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	switch action {
+	case "":
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+			return
+		}
+		s.listDeadLetters(ctx, w, wrk, limit)
+	case "replay":
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+			return
+		}
+		s.replayDeadLetters(ctx, w, wrk, limit)
+	case "purge":
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+			return
+		}
+		s.purgeDeadLetters(ctx, w, wrk)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) listDeadLetters(ctx context.Context, w http.ResponseWriter, wrk *worker, limit int) {
+	letters, err := wrk.deadLetters.Peek(ctx, limit)
+	if err != nil {
+		slog.Error("Failed to peek dead letters", "error", err, "service", wrk.service.ID())
+		http.Error(w, "Failed to retrieve dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	count, _ := wrk.deadLetters.Len(ctx)
+
+	writeJSON(w, struct {
+		DeadLetters []queue.DeadLetter `json:"dead_letters"`
+		Total       int64              `json:"total"`
+	}{DeadLetters: letters, Total: count})
+}
+
+func (s *Server) replayDeadLetters(ctx context.Context, w http.ResponseWriter, wrk *worker, limit int) {
+	letters, err := wrk.deadLetters.Pop(ctx, limit)
+	if err != nil {
+		slog.Error("Failed to pop dead letters", "error", err, "service", wrk.service.ID())
+		http.Error(w, "Failed to retrieve dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	for i, dl := range letters {
+		if err = replay(wrk.queue, dl); err != nil {
+			slog.Error("Failed to replay dead letter", "error", err, "service", wrk.service.ID())
+			// Put back what has not been replayed
+			for _, dl := range letters[i:] {
+				if err := wrk.deadLetters.Push(ctx, dl); err != nil {
+					slog.Error("Failed to restore dead letter", "error", err, "service", wrk.service.ID(), "payload", dl.Payload)
+				}
+			}
+			http.Error(w, "Failed to replay dead letters", http.StatusInternalServerError)
+			return
+		}
+	}
+	slog.Info("Replayed dead letters", "service", wrk.service.ID(), "count", len(letters))
+
+	writeJSON(w, struct {
+		Replayed int `json:"replayed"`
+	}{Replayed: len(letters)})
+}
+
+// replay queues a dead letter again with the metadata it was queued with,
+// starting over with its attempts. Its idempotency key is dropped if it is
+// still taken by the message itself, as queued before it was given up on.
+func replay(q queue.Queue, dl queue.DeadLetter) error {
+	env := queue.Envelope{Meta: dl.Meta, Payload: []byte(dl.Payload)}
+	env.Meta.Attempts = 0
+	env.Meta.RetryAt = 0
+	data, err := env.Encode()
+	if err != nil {
+		// Not JSON, e.g. dead-lettered as invalid, so only the bare payload
+		// can be queued
+		return q.Queue(env.Payload)
+	}
+	err = q.Queue(data)
+	if errors.Is(err, queue.ErrDuplicate) {
+		env.Meta.IdempotencyKey = ""
+		if data, err = env.Encode(); err != nil {
+			return err
+		}
+		err = q.Queue(data)
+	}
+	return err
+}
+
+func (s *Server) purgeDeadLetters(ctx context.Context, w http.ResponseWriter, wrk *worker) {
+	count, err := wrk.deadLetters.Purge(ctx)
+	if err != nil {
+		slog.Error("Failed to purge dead letters", "error", err, "service", wrk.service.ID())
+		http.Error(w, "Failed to purge dead letters", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Purged dead letters", "service", wrk.service.ID(), "count", count)
+
+	writeJSON(w, struct {
+		Purged int64 `json:"purged"`
+	}{Purged: count})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
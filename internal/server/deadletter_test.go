@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/mattstrayer/shove/internal/queue/memory"
+	"github.com/mattstrayer/shove/internal/services"
+)
+
+type deadLettersResponse struct {
+	DeadLetters []queue.DeadLetter `json:"dead_letters"`
+	Total       int64              `json:"total"`
+}
+
+type replayResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+func pushDeadLetter(t *testing.T, wrk *worker, dl queue.DeadLetter) {
+	t.Helper()
+	if err := wrk.deadLetters.Push(context.Background(), dl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeadLettersRequireToken(t *testing.T) {
+	s, _ := newTestServer(t, services.PumpConfig{})
+	for _, path := range []string{"/api/dead/test", "/api/dead/test/replay", "/api/dead/test/purge"} {
+		if w := serve(t, s, "POST", path, "wrong", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d", path, w.Code)
+		}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	s, wrk := newTestServer(t, services.PumpConfig{})
+	pushDeadLetter(t, wrk, queue.DeadLetter{
+		Payload:  `{"text":"a"}`,
+		Meta:     queue.Meta{Tenant: "acme", Attempts: 10},
+		Reason:   "gave up after 10 attempts",
+		Response: "Too Many Requests",
+	})
+	pushDeadLetter(t, wrk, queue.DeadLetter{Payload: `{"text":"b"}`, Reason: "push failed"})
+
+	var list deadLettersResponse
+	if w := serve(t, s, "POST", "/api/dead/test", testAdminToken, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("list by POST: status %d", w.Code)
+	}
+	serve(t, s, "GET", "/api/dead/test?limit=1", testAdminToken, &list)
+	if list.Total != 2 || len(list.DeadLetters) != 1 {
+		t.Fatalf("%d of %d dead letters listed", len(list.DeadLetters), list.Total)
+	}
+	if dl := list.DeadLetters[0]; dl.Payload != `{"text":"a"}` || dl.Meta.Tenant != "acme" || dl.Response != "Too Many Requests" {
+		t.Errorf("dead letter %+v", dl)
+	}
+
+	var purged struct {
+		Purged int64 `json:"purged"`
+	}
+	serve(t, s, "POST", "/api/dead/test/purge", testAdminToken, &purged)
+	if n, _ := wrk.deadLetters.Len(context.Background()); purged.Purged != 2 || n != 0 {
+		t.Errorf("%d dead letters purged, %d left", purged.Purged, n)
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	s, wrk := newTestServer(t, services.PumpConfig{})
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	pushDeadLetter(t, wrk, queue.DeadLetter{
+		Payload: `{"text":"a"}`,
+		Meta: queue.Meta{
+			Tenant:         "acme",
+			Priority:       queue.PriorityHigh,
+			ExpiresAt:      expiresAt,
+			IdempotencyKey: "order-4711",
+			Attempts:       10,
+			RetryAt:        expiresAt,
+		},
+		Reason: "gave up after 10 attempts",
+	})
+	// Dead-lettered as invalid, so it cannot be wrapped in an envelope
+	pushDeadLetter(t, wrk, queue.DeadLetter{Payload: "not JSON", Reason: "invalid message"})
+
+	if w := serve(t, s, "GET", "/api/dead/test/replay", testAdminToken, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("replay by GET: status %d", w.Code)
+	}
+	var replayed replayResponse
+	serve(t, s, "POST", "/api/dead/test/replay", testAdminToken, &replayed)
+	if replayed.Replayed != 2 {
+		t.Fatalf("%d dead letters replayed, expected 2", replayed.Replayed)
+	}
+	if n, _ := wrk.deadLetters.Len(context.Background()); n != 0 {
+		t.Errorf("%d dead letters left", n)
+	}
+
+	envs, err := wrk.queue.Peek(context.Background(), 2)
+	if err != nil || len(envs) != 2 {
+		t.Fatal(envs, err)
+	}
+	meta := envs[0].Meta
+	if string(envs[0].Payload) != `{"text":"a"}` || meta.Tenant != "acme" || meta.Priority != queue.PriorityHigh ||
+		meta.ExpiresAt != expiresAt || meta.IdempotencyKey != "order-4711" {
+		t.Errorf("replayed as %s with %+v", envs[0].Payload, meta)
+	}
+	if meta.Attempts != 0 || meta.RetryAt != 0 {
+		t.Errorf("replayed with %d attempts, retry at %d", meta.Attempts, meta.RetryAt)
+	}
+	if string(envs[1].Payload) != "not JSON" {
+		t.Errorf("replayed as %q", envs[1].Payload)
+	}
+}
+
+func TestReplayDeadLetterWithTakenKey(t *testing.T) {
+	s, wrk := newTestServer(t, services.PumpConfig{})
+	q, err := memory.MemoryQueueFactory{IdempotencyWindow: time.Hour}.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Shutdown()
+	wrk.queue = q
+
+	// The key is still remembered from when the message was first queued
+	data := `{"shove":{"idempotency_key":"order-4711"},"payload":{"text":"a"}}`
+	queueMessage(t, wrk, data)
+	if _, err := q.Purge(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	env := queue.DecodeEnvelope([]byte(data))
+	pushDeadLetter(t, wrk, queue.DeadLetter{Payload: string(env.Payload), Meta: env.Meta, Reason: "push failed"})
+
+	var replayed replayResponse
+	serve(t, s, "POST", "/api/dead/test/replay", testAdminToken, &replayed)
+	if replayed.Replayed != 1 {
+		t.Fatalf("%d dead letters replayed, expected 1", replayed.Replayed)
+	}
+	if envs, _ := q.Peek(context.Background(), 1); len(envs) != 1 || string(envs[0].Payload) != `{"text":"a"}` {
+		t.Errorf("replayed as %v", envs)
+	}
+}
@@ -128,3 +128,27 @@ func (s *Server) ReplaceToken(serviceID, token, replacement string) {
 	}
 	slog.Info("Token replaced", "service", serviceID)
 }
+
+// MessageExpired counts a message that expired before it could be delivered,
+// and records feedback for its token, if known.
+func (s *Server) MessageExpired(serviceID, token string) {
+	pushExpiredCounter.WithLabelValues(serviceID).Inc()
+	if token == "" {
+		return
+	}
+	feedback := queue.TokenFeedback{
+		Service:   serviceID,
+		Token:     token,
+		Reason:    "expired",
+		Timestamp: time.Now().Unix(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.feedbackStore.Push(ctx, feedback); err != nil {
+		slog.Error("Failed to store expired message feedback", "error", err, "service", serviceID, "token", token)
+		return
+	}
+	slog.Info("Message expired", "service", serviceID, "token", token)
+}
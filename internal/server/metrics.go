@@ -20,6 +20,13 @@ var (
 	}, []string{
 		"service",
 	})
+
+	pushExpiredCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_push_expired_total",
+		Help: "The total number of push notifications dropped because they expired",
+	}, []string{
+		"service",
+	})
 )
 
 // CountPush ...
@@ -1,12 +1,19 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+
+	"github.com/mattstrayer/shove/internal/queue"
 )
 
+// queueFullRetryAfter is the number of seconds producers are asked to wait
+// before pushing to a full queue again.
+const queueFullRetryAfter = "5"
+
 func (s *Server) handlePush(w http.ResponseWriter, r *http.Request) {
 	service := strings.TrimPrefix(r.URL.Path, "/api/push/")
 	wrk, ok := s.workers[service]
@@ -25,7 +32,21 @@ func (s *Server) handlePush(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = wrk.push(body)
+	err = wrk.push(body, r.Header.Get("Idempotency-Key"))
+	if errors.Is(err, queue.ErrDuplicate) {
+		// Already accepted before, respond as we did back then
+		w.Header().Set("Idempotent-Replayed", "true")
+		err = nil
+	}
+	if errors.Is(err, errInvalidMessage) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, queue.ErrQueueFull) {
+		w.Header().Set("Retry-After", queueFullRetryAfter)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -2,8 +2,10 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 
 	"log/slog"
 
@@ -12,36 +14,58 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Config configures the server.
+type Config struct {
+	// Addr is the address the HTTP API listens on.
+	Addr string
+	// WorkerOnly disables the HTTP API, leaving only the workers.
+	WorkerOnly bool
+	// AdminToken is the bearer token required by the admin API, which is
+	// disabled if empty.
+	AdminToken string
+	// Namespace is the prefix of the queue names, as shown in log messages.
+	Namespace string
+}
+
 // Server ...
 type Server struct {
 	server        *http.Server
 	shuttingDown  bool
 	workerOnly    bool
+	adminToken    string
+	namespace     string
 	queueFactory  queue.QueueFactory
 	feedbackStore queue.FeedbackStore
 	workers       map[string]*worker
 }
 
 // NewServer ...
-func NewServer(addr string, qf queue.QueueFactory, fs queue.FeedbackStore, workerOnly bool) (s *Server) {
+func NewServer(config Config, qf queue.QueueFactory, fs queue.FeedbackStore) (s *Server) {
 	s = &Server{
 		queueFactory:  qf,
 		feedbackStore: fs,
-		workerOnly:    workerOnly,
+		workerOnly:    config.WorkerOnly,
+		adminToken:    config.AdminToken,
+		namespace:     config.Namespace,
 		workers:       make(map[string]*worker),
 	}
 
-	if !workerOnly {
+	if !s.workerOnly {
 		mux := http.NewServeMux()
 		s.server = &http.Server{
-			Addr:    addr,
+			Addr:    config.Addr,
 			Handler: mux,
 		}
 		mux.HandleFunc("/api/push/", s.handlePush)
 		mux.HandleFunc("/api/feedback", s.handleFeedback)
 		mux.HandleFunc("/api/feedback/peek", s.handleFeedbackPeek)
+		if s.adminToken != "" {
+			mux.HandleFunc("/api/dead/", s.requireAdmin(s.handleDeadLetters))
+			mux.HandleFunc("/api/admin/queue/", s.requireAdmin(s.handleQueueAdmin))
+		}
 		mux.Handle("/metrics", promhttp.Handler())
 		mux.HandleFunc("/health", s.handleHealth)
+		mux.HandleFunc("/health/breakers", s.handleBreakers)
 	}
 	return s
 }
@@ -59,47 +83,66 @@ func (s *Server) Serve() (err error) {
 	return
 }
 
-// Shutdown ...
+// Shutdown stops accepting messages, then drains the workers: the messages
+// being pushed are finished and the ones taken off the queues but not pushed
+// are requeued. Gives up on the workers once ctx is done.
 func (s *Server) Shutdown(ctx context.Context) (err error) {
 	s.shuttingDown = true
 
+	var errs []error
 	if s.server != nil {
-		if err = s.server.Shutdown(ctx); err != nil {
+		if err := s.server.Shutdown(ctx); err != nil {
 			slog.Error("Shutting down Shove server", "error", err)
-			return
+			errs = append(errs, err)
+		} else {
+			slog.Info("Shove server stopped")
 		}
-		slog.Info("Shove server stopped")
 	}
 
+	slog.Info("Draining workers")
+	var wg sync.WaitGroup
+	var lock sync.Mutex
 	for _, w := range s.workers {
-		err = w.shutdown()
-		if err != nil {
-			return
-		}
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			if err := w.shutdown(ctx); err != nil {
+				slog.Error("Shutting down worker", "service", w.service.ID(), "error", err)
+				lock.Lock()
+				errs = append(errs, err)
+				lock.Unlock()
+			}
+		}(w)
 	}
+	wg.Wait()
+
 	if s.feedbackStore != nil {
-		if err = s.feedbackStore.Close(); err != nil {
+		if err := s.feedbackStore.Close(); err != nil {
 			slog.Error("Failed to close feedback store", "error", err)
 		}
 	}
-	return
+	return errors.Join(errs...)
 }
 
 // AddService ...
-func (s *Server) AddService(pp services.PushService, workers int, squash services.SquashConfig) (err error) {
+func (s *Server) AddService(pp services.PushService, config services.PumpConfig) (err error) {
 	serviceID := pp.ID()
-	slog.Info("Initializing service", "service", serviceID, "workers", workers, "queue", fmt.Sprintf("shove:%s", serviceID))
+	slog.Info("Initializing service", "service", serviceID, "workers", config.Workers, "queue", fmt.Sprintf("%s:%s", s.namespace, serviceID))
 	q, err := s.queueFactory.NewQueue(serviceID)
 	if err != nil {
 		return
 	}
-	w, err := newWorker(pp, q)
+	dlq, err := s.queueFactory.NewDeadLetterQueue(serviceID)
 	if err != nil {
 		return
 	}
-	go w.serve(workers, squash, s)
+	w, err := newWorker(pp, q, dlq, config)
+	if err != nil {
+		return
+	}
+	go w.serve(s)
 	s.workers[serviceID] = w
-	slog.Info("Service started", "service", serviceID, "workers", workers)
+	slog.Info("Service started", "service", serviceID, "workers", config.Workers)
 	return
 }
 
@@ -107,3 +150,16 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
+
+// handleBreakers reports the state of the circuit breakers of the services
+// having one. An open circuit breaker means the provider is failing, not
+// Shove, so it does not fail the health check.
+func (s *Server) handleBreakers(w http.ResponseWriter, r *http.Request) {
+	breakers := make(map[string]string)
+	for id, wrk := range s.workers {
+		if state, ok := wrk.pump.BreakerState(); ok {
+			breakers[id] = state.String()
+		}
+	}
+	writeJSON(w, breakers)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue/memory"
+	"github.com/mattstrayer/shove/internal/services"
+)
+
+const testAdminToken = "secret"
+
+type testMessage string
+
+func (m testMessage) GetSquashKey() string {
+	return string(m)
+}
+
+// testService accepts any JSON message and pushes it successfully.
+type testService struct{}
+
+func (testService) ID() string {
+	return "test"
+}
+
+func (testService) String() string {
+	return "Test"
+}
+
+func (testService) Validate(data []byte) error {
+	if !json.Valid(data) {
+		return errors.New("not JSON")
+	}
+	return nil
+}
+
+func (testService) ConvertMessage(data []byte) (services.ServiceMessage, error) {
+	return testMessage(data), nil
+}
+
+func (testService) NewClient() (services.PumpClient, error) {
+	return nil, nil
+}
+
+func (testService) PushMessage(client services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushResult {
+	return services.Success()
+}
+
+func (testService) SquashAndPushMessage(client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushResult {
+	return services.Success()
+}
+
+func (testService) Logger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestServer creates a server with the admin API enabled and a worker for
+// testService, which is not started so that messages stay queued.
+func newTestServer(t *testing.T, config services.PumpConfig) (*Server, *worker) {
+	t.Helper()
+	f := memory.MemoryQueueFactory{}
+	s := NewServer(Config{AdminToken: testAdminToken}, f, nil)
+	q, err := f.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Shutdown() })
+	dlq, err := f.NewDeadLetterQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrk, err := newWorker(testService{}, q, dlq, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.workers["test"] = wrk
+	return s, wrk
+}
+
+// serve serves a request carrying the admin token, if not empty, and decodes
+// the JSON response into v, if not nil.
+func serve(t *testing.T, s *Server, method, path, token string, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, r)
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(err, w.Body.String())
+		}
+	}
+	return w
+}
+
+func queueMessage(t *testing.T, wrk *worker, data string) {
+	t.Helper()
+	if err := wrk.queue.Queue([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure testService implements services.PushService
+var _ services.PushService = testService{}
+
+func TestBreakers(t *testing.T) {
+	s, _ := newTestServer(t, services.PumpConfig{
+		Breaker: services.BreakerConfig{ErrorRate: 0.5, MinPushes: 10, Window: time.Minute, OpenDuration: time.Minute},
+	})
+	// Services without a circuit breaker are left out
+	plain, err := newWorker(testService{}, nil, nil, services.PumpConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.workers["plain"] = plain
+
+	var breakers map[string]string
+	if w := serve(t, s, "GET", "/health/breakers", "", &breakers); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if len(breakers) != 1 || breakers["test"] != "closed" {
+		t.Errorf("breakers %v", breakers)
+	}
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	"log/slog"
 
@@ -10,45 +12,99 @@ import (
 )
 
 type worker struct {
-	queue    queue.Queue
-	service  services.PushService
-	ctx      context.Context
-	cancel   context.CancelFunc
-	finished chan (bool)
+	queue       queue.Queue
+	deadLetters queue.DeadLetterQueue
+	service     services.PushService
+	pump        *services.Pump
+	ctx         context.Context
+	cancel      context.CancelFunc
+	finished    chan struct{}
 }
 
-func newWorker(pp services.PushService, queue queue.Queue) (w *worker, err error) {
+func newWorker(pp services.PushService, queue queue.Queue, deadLetters queue.DeadLetterQueue, config services.PumpConfig) (w *worker, err error) {
 	w = &worker{
-		queue:    queue,
-		service:  pp,
-		finished: make(chan bool),
+		queue:       queue,
+		deadLetters: deadLetters,
+		service:     pp,
+		pump:        services.NewPump(config, pp),
+		finished:    make(chan struct{}),
 	}
 	w.ctx, w.cancel = context.WithCancel(context.Background())
 	return
 }
 
-func (w *worker) push(msg []byte) (err error) {
-	if err = w.service.Validate(msg); err != nil {
-		return
+// errInvalidMessage is returned by push for messages that the client has to
+// fix before pushing them again.
+var errInvalidMessage = errors.New("invalid message")
+
+// validate checks the payload and the metadata of a message.
+func (w *worker) validate(env queue.Envelope) error {
+	if err := w.service.Validate(env.Payload); err != nil {
+		return err
+	}
+	if env.Meta.Priority != "" {
+		if _, err := queue.ParsePriority(string(env.Meta.Priority)); err != nil {
+			return err
+		}
+	}
+	return queue.CheckTenant(env.Meta.Tenant)
+}
+
+// push validates and queues a message. An idempotency key passed alongside
+// the message applies if the envelope does not specify one.
+func (w *worker) push(msg []byte, idempotencyKey string) (err error) {
+	env := queue.DecodeEnvelope(msg)
+	if err = w.validate(env); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidMessage, err)
+	}
+	changed := false
+	if env.Meta.IdempotencyKey == "" && idempotencyKey != "" {
+		env.Meta.IdempotencyKey = idempotencyKey
+		changed = true
+	}
+	// Fill in what the message itself implies
+	hint := services.HintedMeta(w.service, env.Payload)
+	if env.Meta.Priority == "" && hint.Priority != queue.PriorityNormal {
+		env.Meta.Priority = hint.Priority
+		changed = true
+	}
+	if env.Meta.ExpiresAt == 0 && env.Meta.TTL == 0 && hint.ExpiresAt > 0 {
+		env.Meta.ExpiresAt = hint.ExpiresAt
+		changed = true
+	}
+	if _, ok := w.queue.(queue.Sharded); ok && env.Meta.ShardKey == "" && hint.ShardKey != "" {
+		// Keep the messages of a token in order by keeping them in one shard
+		env.Meta.ShardKey = hint.ShardKey
+		changed = true
+	}
+	if changed {
+		if msg, err = env.Encode(); err != nil {
+			return
+		}
 	}
 	err = w.queue.Queue(msg)
 	return
 }
 
-func (w *worker) serve(workers int, squash services.SquashConfig, fc services.FeedbackCollector) {
-	pump := services.NewPump(workers, squash, w.service)
-	err := pump.Serve(w.ctx, w.queue, fc)
+func (w *worker) serve(fc services.FeedbackCollector) {
+	err := w.pump.Serve(w.ctx, w.queue, w.deadLetters, fc)
 	if err != nil {
 		slog.Error("Serve failed", "error", err)
 	}
-	w.finished <- true
+	close(w.finished)
 }
 
-func (w *worker) shutdown() (err error) {
-	if err = w.queue.Shutdown(); err != nil {
-		return
-	}
+// shutdown stops taking messages off the queue and waits until ctx is done
+// for the pump to finish the messages being pushed and to requeue the ones
+// it holds. The queue is shut down either way.
+func (w *worker) shutdown(ctx context.Context) error {
 	w.cancel()
-	<-w.finished
-	return
+	var err error
+	select {
+	case <-w.finished:
+	case <-ctx.Done():
+		slog.Warn("Timed out draining the workers, messages still being pushed may be lost", "service", w.service.ID())
+		err = ctx.Err()
+	}
+	return errors.Join(err, w.queue.Shutdown())
 }
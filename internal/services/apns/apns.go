@@ -7,6 +7,7 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"strings"
 	"time"
 
@@ -116,11 +117,11 @@ func (apns *APNS) String() string {
 	return "APNS-sandbox"
 }
 
-func (apns *APNS) SquashAndPushMessage(client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (apns *APNS) SquashAndPushMessage(client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushResult {
 	panic("not implemented")
 }
 
-func (apns *APNS) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
+func (apns *APNS) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) (result services.PushResult) {
 	client := pclient.(*apns2.Client)
 	notif := smsg.(apnsNotification)
 	t := time.Now()
@@ -129,24 +130,26 @@ func (apns *APNS) PushMessage(pclient services.PumpClient, smsg services.Service
 	sent := false
 	if err != nil {
 		apns.log.Error("Push message failed", "error", err)
-		status = services.PushStatusTempFail
+		result = services.TempFail("", err)
 	} else {
 		reason := resp.Reason
 		if reason == "" {
 			reason = "OK"
 		}
-		apns.log.Info("Pushed", "reason", reason, "duration", duration)
+		apns.log.Debug("Pushed", "reason", reason, "duration", duration)
 		sent = resp.Sent()
 		if resp.Reason == apns2.ReasonBadDeviceToken || resp.Reason == apns2.ReasonUnregistered {
 			fc.TokenInvalid(apns.ID(), notif.notification.DeviceToken)
 		}
-		retry := resp.StatusCode >= 500
+		// APNS asks to slow down with 429, the response carries no hint for
+		// how long though
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
 		if sent {
-			status = services.PushStatusSuccess
+			result = services.Success()
 		} else if retry {
-			status = services.PushStatusTempFail
+			result = services.TempFail(resp.Reason, nil)
 		} else {
-			status = services.PushStatusHardFail
+			result = services.HardFail(resp.Reason, nil)
 		}
 	}
 	fc.CountPush(apns.ID(), sent, duration)
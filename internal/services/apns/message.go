@@ -5,6 +5,7 @@ import (
 	"errors"
 	"time"
 
+	"github.com/mattstrayer/shove/internal/queue"
 	"github.com/mattstrayer/shove/internal/services"
 	"github.com/sideshow/apns2"
 )
@@ -23,6 +24,28 @@ func (notif apnsNotification) GetSquashKey() string {
 	panic("not implemented")
 }
 
+// PriorityHint maps apns-priority 10 (immediate delivery) to the high lane and
+// 1 (prioritize power) to the bulk lane.
+func (notif apnsNotification) PriorityHint() queue.Priority {
+	switch notif.notification.Priority {
+	case apns2.PriorityHigh:
+		return queue.PriorityHigh
+	case 1:
+		return queue.PriorityBulk
+	}
+	return queue.PriorityNormal
+}
+
+// ExpiryHint returns the apns-expiration, if any.
+func (notif apnsNotification) ExpiryHint() time.Time {
+	return notif.notification.Expiration
+}
+
+// FeedbackToken ...
+func (notif apnsNotification) FeedbackToken() string {
+	return notif.notification.DeviceToken
+}
+
 func (apns *APNS) ConvertMessage(data []byte) (smsg services.ServiceMessage, err error) {
 	var msg apnsMessage
 	if err = json.Unmarshal(data, &msg); err != nil {
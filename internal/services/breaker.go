@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var breakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "shove_circuit_breaker_state",
+	Help: "The state of the circuit breaker of the service: 0 closed, 1 half-open, 2 open",
+}, []string{
+	"service",
+})
+
+// BreakerConfig configures the circuit breaker of a pump, which stops pushing
+// while the provider is failing. The breaker is disabled if ErrorRate is 0.
+type BreakerConfig struct {
+	// ErrorRate is the share of pushes failing temporarily, between 0 and 1,
+	// at which the breaker opens.
+	ErrorRate float64
+	// MinPushes is the number of pushes within Window below which the
+	// breaker does not open, whatever the error rate.
+	MinPushes int
+	// Window is the period over which the error rate is measured.
+	Window time.Duration
+	// OpenDuration is how long the breaker stays open before a probe is let
+	// through.
+	OpenDuration time.Duration
+}
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all pushes through
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a single probe through, which decides whether the
+	// breaker closes or opens again
+	BreakerHalfOpen
+	// BreakerOpen stops all pushes
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// breaker is a circuit breaker around the pushes of a pump. Pushes failing
+// temporarily count as errors, while hard failures are the fault of the
+// message rather than the provider.
+type breaker struct {
+	config BreakerConfig
+	log    *slog.Logger
+	gauge  prometheus.Gauge
+
+	lock  sync.Mutex
+	state BreakerState
+	// openedAt is when the breaker opened last
+	openedAt time.Time
+	// probeAt is when the probe was let through while half-open, zero if
+	// none is under way
+	probeAt time.Time
+	// windowStart is when the current window of pushes began
+	windowStart      time.Time
+	pushes, failures int
+	// changed is closed and replaced whenever the state changes
+	changed chan struct{}
+}
+
+func newBreaker(config BreakerConfig, adapter PumpAdapter) *breaker {
+	b := &breaker{
+		config:  config,
+		log:     adapter.Logger(),
+		gauge:   breakerStateGauge.WithLabelValues(adapter.ID()),
+		changed: make(chan struct{}),
+	}
+	b.gauge.Set(float64(BreakerClosed))
+	return b
+}
+
+// State returns the current state.
+func (b *breaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// setState changes the state, waking up those waiting for it to change.
+func (b *breaker) setState(state BreakerState, now time.Time) {
+	if state == b.state {
+		return
+	}
+	b.state = state
+	b.gauge.Set(float64(state))
+	switch state {
+	case BreakerOpen:
+		b.openedAt = now
+		b.log.Warn("Circuit breaker opened", "pushes", b.pushes, "failures", b.failures, "open_duration", b.config.OpenDuration)
+	case BreakerHalfOpen:
+		b.log.Info("Circuit breaker half-open, probing")
+	case BreakerClosed:
+		b.log.Info("Circuit breaker closed")
+	}
+	b.probeAt = time.Time{}
+	b.windowStart = now
+	b.pushes, b.failures = 0, 0
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// wait blocks until pushes may be made. While closed, it returns right away.
+// While open, it waits until OpenDuration has passed, and claims the probe of
+// the half-open breaker, which it also waits for when another probe is under
+// way. Returns whether a probe has been claimed, and false for ok if ctx is
+// done before.
+func (b *breaker) wait(ctx context.Context) (probe bool, ok bool) {
+	for {
+		b.lock.Lock()
+		now := time.Now()
+		var delay time.Duration
+		switch b.state {
+		case BreakerClosed:
+			b.lock.Unlock()
+			return false, true
+		case BreakerOpen:
+			delay = b.openedAt.Add(b.config.OpenDuration).Sub(now)
+			if delay <= 0 {
+				b.setState(BreakerHalfOpen, now)
+				delay = 0
+			}
+		case BreakerHalfOpen:
+			// A probe that never reported back, e.g. because its message
+			// expired, is given up on after OpenDuration
+			if !b.probeAt.IsZero() {
+				delay = b.probeAt.Add(b.config.OpenDuration).Sub(now)
+			}
+		}
+		if b.state == BreakerHalfOpen && delay <= 0 {
+			b.probeAt = now
+			b.lock.Unlock()
+			return true, true
+		}
+		changed := b.changed
+		b.lock.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return false, false
+		}
+		timer.Stop()
+	}
+}
+
+// record counts the result of a push, opening the breaker once the error rate
+// is reached, or deciding on the state of the half-open breaker.
+func (b *breaker) record(result PushResult) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	failed := result.Status == PushStatusTempFail
+	switch b.state {
+	case BreakerOpen:
+		// Pushed before the breaker opened
+		return
+	case BreakerHalfOpen:
+		if failed {
+			b.setState(BreakerOpen, now)
+		} else {
+			b.setState(BreakerClosed, now)
+		}
+		return
+	}
+	if now.Sub(b.windowStart) > b.config.Window {
+		b.windowStart = now
+		b.pushes, b.failures = 0, 0
+	}
+	b.pushes++
+	if failed {
+		b.failures++
+	}
+	if b.pushes >= max(b.config.MinPushes, 1) && float64(b.failures) >= b.config.ErrorRate*float64(b.pushes) {
+		b.setState(BreakerOpen, now)
+	}
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(BreakerConfig{
+		ErrorRate:    0.5,
+		MinPushes:    4,
+		Window:       time.Minute,
+		OpenDuration: 50 * time.Millisecond,
+	}, &testAdapter{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Hard failures are the fault of the message and do not count
+	b.record(HardFail("BadDeviceToken", nil))
+	b.record(TempFail("", nil))
+	b.record(Success())
+	b.record(Success())
+	b.record(TempFail("", nil))
+	if state := b.State(); state != BreakerClosed {
+		t.Fatal(state)
+	}
+	b.record(TempFail("", nil))
+	if state := b.State(); state != BreakerOpen {
+		t.Fatal(state)
+	}
+
+	// Stays open for OpenDuration, then lets a single probe through
+	start := time.Now()
+	probe, ok := b.wait(ctx)
+	if !ok || !probe || time.Since(start) < 40*time.Millisecond {
+		t.Fatal("no probe after open duration", probe, ok, time.Since(start))
+	}
+	if state := b.State(); state != BreakerHalfOpen {
+		t.Fatal(state)
+	}
+	short, cancelShort := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelShort()
+	if _, ok := b.wait(short); ok {
+		t.Fatal("second probe let through")
+	}
+
+	// A failing probe opens the breaker again, a successful one closes it
+	b.record(TempFail("", nil))
+	if state := b.State(); state != BreakerOpen {
+		t.Fatal(state)
+	}
+	if probe, ok = b.wait(ctx); !ok || !probe {
+		t.Fatal("no probe", probe, ok)
+	}
+	b.record(Success())
+	if state := b.State(); state != BreakerClosed {
+		t.Fatal(state)
+	}
+	if probe, ok = b.wait(ctx); !ok || probe {
+		t.Fatal("closed breaker waited", probe, ok)
+	}
+}
@@ -28,6 +28,10 @@ func (em email) GetSquashKey() string {
 	return em.To[0]
 }
 
+func (em email) Destination() string {
+	return em.To[0]
+}
+
 func (es *EmailService) ConvertMessage(data []byte) (services.ServiceMessage, error) {
 	var em email
 	if err := json.Unmarshal(data, &em); err != nil {
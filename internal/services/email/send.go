@@ -2,13 +2,27 @@ package email
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/smtp"
+	"net/textproto"
 	"time"
 
 	"github.com/mattstrayer/shove/internal/services"
 )
 
+var errInvalidAddress = errors.New("invalid address")
+
+// isPermanentError tells whether retrying to send an email would not help.
+func isPermanentError(err error) bool {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		// SMTP 5xx replies are permanent negative completions
+		return tpErr.Code >= 500
+	}
+	return errors.Is(err, errInvalidAddress)
+}
+
 func (ec EmailConfig) send(from string, to []string, body []byte, fc services.FeedbackCollector) error {
 	t := time.Now()
 	addr := fmt.Sprintf("%s:%d", ec.EmailHost, ec.EmailPort)
@@ -21,7 +35,9 @@ func (ec EmailConfig) send(from string, to []string, body []byte, fc services.Fe
 
 	var err error
 	from, to, err = encodeSMTPAddresses(from, to)
-	if err == nil {
+	if err != nil {
+		err = fmt.Errorf("%w: %v", errInvalidAddress, err)
+	} else {
 		if !ec.TLS {
 			err = smtp.SendMail(addr, auth, from, to, body)
 		} else {
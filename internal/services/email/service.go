@@ -46,32 +46,35 @@ func (es *EmailService) NewClient() (services.PumpClient, error) {
 	return nil, nil
 }
 
-func (es *EmailService) SquashAndPushMessage(client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (es *EmailService) SquashAndPushMessage(client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushResult {
 	emails := make([]email, len(smsgs))
 	for i, smsg := range smsgs {
 		emails[i] = smsg.(email)
 	}
 	body, err := encodeEmailDigest(emails)
 	if err != nil {
-		return services.PushStatusHardFail
+		return services.HardFail("encoding digest failed", err)
 	}
 	return es.push(emails[0].From, emails[0].To, body, fc)
 }
 
-func (es *EmailService) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
+func (es *EmailService) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushResult {
 	email := smsg.(email)
-	es.config.Log.Info("Sending email")
+	es.config.Log.Debug("Sending email")
 	body, err := encodeEmail(email)
 	if err != nil {
-		return services.PushStatusHardFail
+		return services.HardFail("encoding email failed", err)
 	}
 	return es.push(email.From, email.To, body, fc)
 }
-func (es *EmailService) push(from string, to []string, body []byte, fc services.FeedbackCollector) services.PushStatus {
+func (es *EmailService) push(from string, to []string, body []byte, fc services.FeedbackCollector) services.PushResult {
 	err := es.config.send(from, to, body, fc)
 	if err != nil {
 		es.config.Log.Error("Failed to send email", "error", err)
-		return services.PushStatusHardFail // TODO: smtp down is not a hard failure
+		if isPermanentError(err) {
+			return services.HardFail("", err)
+		}
+		return services.TempFail("", err)
 	}
-	return services.PushStatusSuccess
+	return services.Success()
 }
@@ -119,11 +119,11 @@ type fcmResponse struct {
 	} `json:"results"`
 }
 
-func (fcm *FCM) SquashAndPushMessage(services.PumpClient, []services.ServiceMessage, services.FeedbackCollector) services.PushStatus {
+func (fcm *FCM) SquashAndPushMessage(services.PumpClient, []services.ServiceMessage, services.FeedbackCollector) services.PushResult {
 	panic("not implemented")
 }
 
-func (fcm *FCM) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (fcm *FCM) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushResult {
 	msg := smsg.(fcmMessage)
 	startedAt := time.Now()
 
@@ -131,7 +131,7 @@ func (fcm *FCM) PushMessage(pclient services.PumpClient, smsg services.ServiceMe
 	err := json.Unmarshal(msg.rawData, &message)
 	if err != nil {
 		fcm.log.Error("error unmarshalling message", "error", err)
-		return services.PushStatusHardFail
+		return services.HardFail("invalid message", err)
 	}
 
 	message.Token = msg.To
@@ -142,7 +142,7 @@ func (fcm *FCM) PushMessage(pclient services.PumpClient, smsg services.ServiceMe
 	// registration token.
 	response, err := fcm.client.Send(context.Background(), &message)
 
-	fcm.log.Info("Sending", "response", response, "error", err)
+	fcm.log.Debug("Sending", "response", response, "error", err)
 	if err != nil {
 		fcm.log.Error("sending failed", "error", err)
 
@@ -150,11 +150,11 @@ func (fcm *FCM) PushMessage(pclient services.PumpClient, smsg services.ServiceMe
 		// all others will be temp failed by default
 		// https://github.com/firebase/firebase-admin-go/blob/master/internal/errors.go#L68
 		if errorutils.IsInvalidArgument(err) {
-			return services.PushStatusHardFail
+			return services.HardFail("", err)
 		}
 
 		if errorutils.IsDataLoss(err) {
-			return services.PushStatusHardFail
+			return services.HardFail("", err)
 		}
 
 		if errorutils.IsNotFound(err) {
@@ -164,10 +164,12 @@ func (fcm *FCM) PushMessage(pclient services.PumpClient, smsg services.ServiceMe
 			// broadcast receiver configured to receive
 			// com.google.android.c2dm.intent.RECEIVE intents.
 			fc.TokenInvalid(fcm.ID(), msg.To)
-			return services.PushStatusHardFail
+			return services.HardFail("", err)
 		}
 
-		return services.PushStatusTempFail
+		// Quota exceeded (429) and unavailable (503) responses may tell
+		// when to try again
+		return services.TempFail("", err).After(services.RetryAfterHeader(errorutils.HTTPResponse(err)))
 	}
 
 	duration := time.Since(startedAt)
@@ -176,8 +178,8 @@ func (fcm *FCM) PushMessage(pclient services.PumpClient, smsg services.ServiceMe
 		fc.CountPush(fcm.ID(), success, duration)
 	}()
 
-	fcm.log.Info("Pushed", "duration", duration)
+	fcm.log.Debug("Pushed", "duration", duration)
 
 	success = true
-	return services.PushStatusSuccess
+	return services.Success()
 }
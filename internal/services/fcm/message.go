@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 
+	"github.com/mattstrayer/shove/internal/queue"
 	"github.com/mattstrayer/shove/internal/services"
 )
 
 type fcmMessage struct {
 	To              string   `json:"to"`
 	RegistrationIDs []string `json:"registration_ids"`
+	Priority        string   `json:"priority"`
 	rawData         []byte
 }
 
@@ -17,6 +19,19 @@ func (fcmMessage) GetSquashKey() string {
 	panic("not implemented")
 }
 
+// PriorityHint maps high priority messages to the high lane.
+func (msg fcmMessage) PriorityHint() queue.Priority {
+	if msg.Priority == "high" {
+		return queue.PriorityHigh
+	}
+	return queue.PriorityNormal
+}
+
+// FeedbackToken returns the token of messages sent to a single device.
+func (msg fcmMessage) FeedbackToken() string {
+	return msg.To
+}
+
 func (fcm *FCM) ConvertMessage(data []byte) (smsg services.ServiceMessage, err error) {
 	var msg fcmMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
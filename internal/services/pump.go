@@ -2,7 +2,6 @@ package services
 
 import (
 	"context"
-	"math"
 	"sync"
 	"time"
 
@@ -14,8 +13,26 @@ import (
 type Pump struct {
 	wg       sync.WaitGroup
 	adapter  PumpAdapter
-	workers  int
+	config   PumpConfig
 	squasher *squasher
+	breaker  *breaker
+	throttle *throttle
+
+	pauseLock sync.Mutex
+	// resumed is non-nil while paused, and closed on resume
+	resumed chan struct{}
+}
+
+// PumpConfig ...
+type PumpConfig struct {
+	Workers int
+	// BatchSize is the maximum number of messages taken off the queue at a
+	// time, the number of workers by default.
+	BatchSize int
+	Squash    SquashConfig
+	Retry     RetryConfig
+	Breaker   BreakerConfig
+	Throttle  ThrottleConfig
 }
 
 type ServiceMessage interface {
@@ -37,73 +54,223 @@ type PumpClient interface {
 }
 
 type PumpAdapter interface {
+	ID() string
 	ConvertMessage([]byte) (ServiceMessage, error)
 	NewClient() (PumpClient, error)
-	PushMessage(client PumpClient, smsg ServiceMessage, fc FeedbackCollector) PushStatus
-	SquashAndPushMessage(client PumpClient, smsgs []ServiceMessage, fc FeedbackCollector) PushStatus
+	PushMessage(client PumpClient, smsg ServiceMessage, fc FeedbackCollector) PushResult
+	SquashAndPushMessage(client PumpClient, smsgs []ServiceMessage, fc FeedbackCollector) PushResult
 	Logger() *slog.Logger
 }
 
 // NewPump
-func NewPump(workers int, squash SquashConfig, adapter PumpAdapter) (p *Pump) {
+func NewPump(config PumpConfig, adapter PumpAdapter) (p *Pump) {
 	p = &Pump{
-		workers: workers,
+		config:  config,
 		adapter: adapter,
 	}
-	if squash.RateMax > 0 {
-		p.squasher = newSquasher(squash, adapter)
+	if config.Squash.RateMax > 0 {
+		p.squasher = newSquasher(config.Squash, config.Retry, adapter)
+	}
+	if config.Breaker.ErrorRate > 0 {
+		p.breaker = newBreaker(config.Breaker, adapter)
+	}
+	if config.Throttle.Amount > 0 {
+		p.throttle = newThrottle(config.Throttle)
 	}
 	return p
 }
 
-func (p *Pump) push(q queue.Queue, qm queue.QueuedMessage, client PumpClient, smsg ServiceMessage, fc FeedbackCollector) (status PushStatus, squashed bool) {
+// BreakerState returns the state of the circuit breaker, ok is false if there
+// is none.
+func (p *Pump) BreakerState() (state BreakerState, ok bool) {
+	if p.breaker == nil {
+		return BreakerClosed, false
+	}
+	return p.breaker.State(), true
+}
+
+// breakerOpen tells whether the circuit breaker stops all pushes.
+func (p *Pump) breakerOpen() bool {
+	return p.breaker != nil && p.breaker.State() == BreakerOpen
+}
+
+// Pause stops the workers from taking further messages off the queue, until
+// Resume is called. Messages already being pushed are finished.
+func (p *Pump) Pause() {
+	p.pauseLock.Lock()
+	defer p.pauseLock.Unlock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+		p.adapter.Logger().Info("Paused")
+	}
+}
+
+// Resume lets paused workers continue.
+func (p *Pump) Resume() {
+	p.pauseLock.Lock()
+	defer p.pauseLock.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+		p.adapter.Logger().Info("Resumed")
+	}
+}
+
+// Paused tells whether the workers are paused.
+func (p *Pump) Paused() bool {
+	p.pauseLock.Lock()
+	defer p.pauseLock.Unlock()
+	return p.resumed != nil
+}
+
+// waitUntilResumed blocks while the pump is paused. Returns false if ctx is
+// done before.
+func (p *Pump) waitUntilResumed(ctx context.Context) bool {
+	p.pauseLock.Lock()
+	resumed := p.resumed
+	p.pauseLock.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *Pump) push(q queue.Queue, dlq queue.DeadLetterQueue, qm queue.QueuedMessage, client PumpClient, smsg ServiceMessage, fc FeedbackCollector) (result PushResult, squashed bool) {
 	if p.squasher != nil {
-		squashed = p.squasher.prepareToPush(q, qm, client, smsg)
+		squashed = p.squasher.prepareToPush(q, qm, smsg)
 		if squashed {
 			return
 		}
 	}
-	status = p.adapter.PushMessage(client, smsg, fc)
+	result = p.adapter.PushMessage(client, smsg, fc)
+	if p.breaker != nil {
+		p.breaker.record(result)
+	}
+	if p.squasher != nil && result.Status == PushStatusTempFail && result.RetryAfter > 0 {
+		// Hold back the other messages to the destination as well
+		p.squasher.hold(smsg.GetSquashKey(), result.RetryAfter)
+	}
 	return
 }
 
-func (p *Pump) serveClient(ctx context.Context, q queue.Queue, client PumpClient, fc FeedbackCollector) {
-	defer func() {
-		p.wg.Done()
-	}()
-	failureCount := 0
-	log := p.adapter.Logger()
+// fetch takes batches of messages off the queue and hands them out to the
+// workers one at a time, until ctx is done or reading from the queue fails.
+// The channel is closed when done. Messages not handed out by then are
+// requeued. While the circuit breaker is open, no messages are taken off the
+// queue, and while it is half-open only the probe. When throttling the whole
+// service, no more messages are taken off the queue than may be pushed.
+func (p *Pump) fetch(ctx context.Context, q queue.Queue, messages chan<- queue.QueuedMessage) {
+	defer close(messages)
+	batchSize := p.config.BatchSize
+	if batchSize <= 0 {
+		batchSize = p.config.Workers
+	}
 	for ctx.Err() == nil {
-		qm, err := q.Get(ctx)
+		if !p.waitUntilResumed(ctx) {
+			return
+		}
+		size := batchSize
+		if p.breaker != nil {
+			probe, ok := p.breaker.wait(ctx)
+			if !ok {
+				return
+			}
+			if probe {
+				size = 1
+			}
+		}
+		throttled := p.throttle != nil && !p.throttle.config.PerDestination
+		if throttled {
+			var ok bool
+			if size, ok = p.throttle.wait(ctx, "", size); !ok {
+				return
+			}
+		}
+		batch, err := q.GetBatch(ctx, size)
 		if err != nil {
-			slog.Error("Unable to read from queue", "error", err)
+			if ctx.Err() == nil {
+				slog.Error("Unable to read from queue", "error", err)
+			}
 			return
 		}
+		if throttled {
+			p.throttle.take("", len(batch))
+		}
+		for i, qm := range batch {
+			if p.Paused() || p.breakerOpen() {
+				// Paused or tripped while waiting for the messages, leave
+				// them to be pushed later
+				requeue(q, batch[i:])
+				break
+			}
+			if ctx.Err() != nil {
+				requeue(q, batch[i:])
+				return
+			}
+			select {
+			case messages <- qm:
+			case <-ctx.Done():
+				requeue(q, batch[i:])
+				return
+			}
+		}
+	}
+}
+
+func requeue(q queue.Queue, qms []queue.QueuedMessage) {
+	for _, qm := range qms {
+		if err := q.Requeue(qm); err != nil {
+			slog.Error("Unable to requeue", "error", err)
+		}
+	}
+}
+
+func (p *Pump) serveClient(q queue.Queue, dlq queue.DeadLetterQueue, messages <-chan queue.QueuedMessage, client PumpClient, fc FeedbackCollector) {
+	defer func() {
+		p.wg.Done()
+	}()
+	log := p.adapter.Logger()
+	for qm := range messages {
 		msg := qm.Message()
 		smsg, err := p.adapter.ConvertMessage(msg)
 		if err != nil {
 			slog.Error("Bad message", "error", err)
-			removeFromQueue(q, qm, log)
+			deadLetter(q, dlq, qm, "invalid message: "+err.Error(), "", log)
 			continue
 		}
-		status, squashed := p.push(q, qm, client, smsg, fc)
-		if squashed {
-			// Message should remain in pending queue
+		if qm.Envelope().Meta.Expired(time.Now()) {
+			dropExpired(p.adapter, q, qm, smsg, fc)
 			continue
 		}
-		if status == PushStatusSuccess || status == PushStatusHardFail {
-			removeFromQueue(q, qm, log)
-		} else {
-			if err = q.Requeue(qm); err != nil {
-				slog.Error("Unable to requeue", "error", err)
+		if p.breakerOpen() {
+			// Tripped since the message was handed out, keep it queued
+			// without counting an attempt
+			requeue(q, []queue.QueuedMessage{qm})
+			continue
+		}
+		if p.throttle != nil && p.throttle.config.PerDestination {
+			if wait := p.throttle.tryTake(destination(smsg)); wait > 0 {
+				postpone(q, qm, wait, log)
+				continue
 			}
 		}
-		if status == PushStatusTempFail {
-			p.backoff(ctx, failureCount)
-			failureCount++
-
-		} else {
-			failureCount = 0
+		result, squashed := p.push(q, dlq, qm, client, smsg, fc)
+		if squashed {
+			// The squasher took the message over
+			continue
+		}
+		switch result.Status {
+		case PushStatusSuccess:
+			removeFromQueue(q, qm, log)
+		case PushStatusHardFail:
+			deadLetter(q, dlq, qm, "push failed", result.Description(), log)
+		default:
+			retry(p.adapter, p.config.Retry, q, dlq, qm, smsg, fc, result)
 		}
 	}
 }
@@ -114,44 +281,124 @@ func removeFromQueue(q queue.Queue, qm queue.QueuedMessage, log *slog.Logger) {
 	}
 }
 
-func (p *Pump) backoff(ctx context.Context, failureCount int) {
-	sleep := time.Duration(float64(time.Second) * math.Min(30, math.Pow(2., float64(failureCount))))
-	p.adapter.Logger().Info("Backing off", "duration", sleep)
-	ctx, cancel := context.WithTimeout(ctx, sleep)
+// retry requeues a message that failed temporarily to be attempted again after
+// a backoff, or as long as the provider asked to wait if longer, unless it has
+// run out of retries, in which case it is moved to the dead-letter queue, or
+// has expired. The worker moves on to the next message in the meantime.
+func retry(adapter PumpAdapter, config RetryConfig, q queue.Queue, dlq queue.DeadLetterQueue, qm queue.QueuedMessage, smsg ServiceMessage, fc FeedbackCollector, result PushResult) {
+	log := adapter.Logger()
+	now := time.Now()
+	env := qm.Envelope()
+	env.Stamp(now)
+	if env.Meta.Expired(now) {
+		dropExpired(adapter, q, qm, smsg, fc)
+		return
+	}
+	env.Meta.Attempts++
+	if reason := config.giveUpReason(env.Meta, now); reason != "" {
+		log.Warn("Giving up on message", "reason", reason)
+		deadLetter(q, dlq, qm, reason, result.Description(), log)
+		return
+	}
+	delay := max(retryDelay(env.Meta.Attempts), result.RetryAfter)
+	// Round up, so that the message is not retried before the provider
+	// allows it
+	env.Meta.RetryAt = now.Add(delay + time.Second - 1).Unix()
+	log.Info("Retrying later", "attempts", env.Meta.Attempts, "delay", delay, "retry_after", result.RetryAfter, "reason", result.Description())
+	if err := q.Requeue(qm); err != nil {
+		slog.Error("Unable to requeue", "error", err)
+	}
+}
+
+// postpone requeues a message to be pushed after the given delay, without
+// counting an attempt.
+func postpone(q queue.Queue, qm queue.QueuedMessage, delay time.Duration, log *slog.Logger) {
+	env := qm.Envelope()
+	// Round up, so that the message is not pushed before
+	env.Meta.RetryAt = time.Now().Add(delay + time.Second - 1).Unix()
+	log.Debug("Throttled, postponed", "delay", delay)
+	if err := q.Requeue(qm); err != nil {
+		slog.Error("Unable to requeue", "error", err)
+	}
+}
+
+// dropExpired removes a message that expired before it could be delivered
+// from the queue.
+func dropExpired(adapter PumpAdapter, q queue.Queue, qm queue.QueuedMessage, smsg ServiceMessage, fc FeedbackCollector) {
+	log := adapter.Logger()
+	log.Info("Dropping expired message", "expires_at", qm.Envelope().Meta.ExpiresAt)
+	fc.MessageExpired(adapter.ID(), feedbackToken(smsg))
+	removeFromQueue(q, qm, log)
+}
+
+// deadLetter moves a message that could not be delivered from the queue to the
+// dead-letter queue, along with its metadata so that it can be replayed as it
+// was queued. reason tells why it was given up on, response what the provider
+// replied, if anything. The message is kept queued, to be retried after a
+// backoff, if the dead letter cannot be stored.
+func deadLetter(q queue.Queue, dlq queue.DeadLetterQueue, qm queue.QueuedMessage, reason, response string, log *slog.Logger) {
+	env := qm.Envelope()
+	dl := queue.DeadLetter{
+		Payload:   string(env.Payload),
+		Meta:      env.Meta,
+		Reason:    reason,
+		Response:  response,
+		Timestamp: time.Now().Unix(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	<-ctx.Done()
+	if err := dlq.Push(ctx, dl); err != nil {
+		log.Error("Unable to move message to the dead-letter queue", "error", err)
+		env.Meta.RetryAt = time.Now().Add(retryDelay(env.Meta.Attempts)).Unix()
+		if err := q.Requeue(qm); err != nil {
+			slog.Error("Unable to requeue", "error", err)
+		}
+		return
+	}
+	removeFromQueue(q, qm, log)
 }
 
-func (p *Pump) Serve(ctx context.Context, q queue.Queue, fc FeedbackCollector) (err error) {
+// Serve pushes the messages of the queue until ctx is done. It then stops
+// taking messages off the queue and returns once the messages being pushed
+// are finished, after requeueing those it has taken but not pushed, including
+// the ones waiting in squashed batches kept in memory.
+func (p *Pump) Serve(ctx context.Context, q queue.Queue, dlq queue.DeadLetterQueue, fc FeedbackCollector) (err error) {
 	log := p.adapter.Logger()
-	if p.squasher != nil {
-		p.wg.Add(1)
-		go func() {
-			log.Info("Squasher started")
-			p.squasher.serve(fc)
-			log.Info("Squasher stopped")
-			p.wg.Add(-1)
-		}()
-	}
-	clients := make([]PumpClient, p.workers)
-	for i := 0; i < p.workers; i++ {
+	clients := make([]PumpClient, p.config.Workers)
+	for i := 0; i < p.config.Workers; i++ {
 		clients[i], err = p.adapter.NewClient()
 		if err != nil {
 			return
 		}
 	}
 
-	for i := 0; i < p.workers; i++ {
-		go func(client PumpClient) {
-			p.serveClient(ctx, q, client, fc)
-			if p.squasher != nil {
-				p.squasher.requestShutdown()
-			}
-		}(clients[i])
+	var squashing sync.WaitGroup
+	if p.squasher != nil {
+		client, err := p.adapter.NewClient()
+		if err != nil {
+			return err
+		}
+		squashing.Add(1)
+		go func() {
+			log.Info("Squasher started")
+			p.squasher.serve(q, dlq, client, fc)
+			log.Info("Squasher stopped")
+			squashing.Done()
+		}()
+	}
+	messages := make(chan queue.QueuedMessage)
+	go p.fetch(ctx, q, messages)
+	for i := 0; i < p.config.Workers; i++ {
 		p.wg.Add(1)
+		go p.serveClient(q, dlq, messages, clients[i], fc)
 	}
-	slog.Info("Workers started", "worker_count", p.workers)
+	slog.Info("Workers started", "worker_count", p.config.Workers)
 	p.wg.Wait()
+	if p.squasher != nil {
+		// Only now, as the workers may squash messages until they are done
+		p.squasher.requestShutdown()
+		squashing.Wait()
+	}
 	slog.Info("Workers stopped")
 
 	return
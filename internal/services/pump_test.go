@@ -0,0 +1,303 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+	"github.com/mattstrayer/shove/internal/queue/memory"
+)
+
+type testMessage string
+
+func (m testMessage) GetSquashKey() string {
+	return "destination"
+}
+
+// testAdapter pushes messages successfully, counting them.
+type testAdapter struct {
+	lock   sync.Mutex
+	pushed int
+}
+
+func (a *testAdapter) ID() string {
+	return "test"
+}
+
+func (a *testAdapter) ConvertMessage(data []byte) (ServiceMessage, error) {
+	return testMessage(data), nil
+}
+
+func (a *testAdapter) NewClient() (PumpClient, error) {
+	return nil, nil
+}
+
+func (a *testAdapter) PushMessage(client PumpClient, smsg ServiceMessage, fc FeedbackCollector) PushResult {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.pushed++
+	return Success()
+}
+
+func (a *testAdapter) SquashAndPushMessage(client PumpClient, smsgs []ServiceMessage, fc FeedbackCollector) PushResult {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.pushed += len(smsgs)
+	return Success()
+}
+
+func (a *testAdapter) Logger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+type nopFeedbackCollector struct{}
+
+func (nopFeedbackCollector) TokenInvalid(serviceID, token string)                             {}
+func (nopFeedbackCollector) ReplaceToken(serviceID, token, replacement string)                {}
+func (nopFeedbackCollector) CountPush(serviceID string, success bool, duration time.Duration) {}
+func (nopFeedbackCollector) MessageExpired(serviceID, token string)                           {}
+
+func TestServeRequeuesSquashedOnShutdown(t *testing.T) {
+	f := memory.MemoryQueueFactory{}
+	q, _ := f.NewQueue("test")
+	dlq, _ := f.NewDeadLetterQueue("test")
+	for _, msg := range []string{"a", "b", "c"} {
+		if err := q.Queue([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	adapter := &testAdapter{}
+	p := NewPump(PumpConfig{
+		Workers: 2,
+		Squash:  SquashConfig{RateMax: 1, RatePer: time.Hour},
+	}, adapter)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.Serve(ctx, q, dlq, nopFeedbackCollector{})
+	}()
+
+	// One message goes out, the others are held back by the rate limit
+	store := p.squasher.store.(*memorySquashStore)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		store.lock.Lock()
+		squashed := 0
+		if b, ok := store.batches["destination"]; ok {
+			squashed = len(b.qms)
+		}
+		store.lock.Unlock()
+		if squashed == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages squashed, expected 2", squashed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+	if adapter.pushed != 1 {
+		t.Errorf("%d messages pushed, expected 1", adapter.pushed)
+	}
+	if n, _ := q.Len(context.Background()); n != 2 {
+		t.Errorf("%d messages requeued, expected 2", n)
+	}
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	f := memory.MemoryQueueFactory{}
+	q, _ := f.NewQueue("test")
+	dlq, _ := f.NewDeadLetterQueue("test")
+	if err := q.Queue([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qm, err := q.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	result := TempFail("throttled", nil).After(time.Minute)
+	retry(&testAdapter{}, RetryConfig{}, q, dlq, qm, testMessage("a"), nopFeedbackCollector{}, result)
+	envs, _ := q.Peek(context.Background(), 1)
+	if len(envs) != 1 {
+		t.Fatal("message not requeued")
+	}
+	if retryAt := envs[0].Meta.RetryAt; retryAt < now.Add(time.Minute).Unix() {
+		t.Errorf("retrying at %d, before the minute asked for", retryAt-now.Unix())
+	}
+}
+
+func TestSquasherHold(t *testing.T) {
+	f := memory.MemoryQueueFactory{}
+	q, _ := f.NewQueue("test")
+	store := newMemorySquashStore()
+	d := newSquasher(SquashConfig{RateMax: 10, RatePer: time.Second, Store: store}, RetryConfig{}, &testAdapter{})
+	if d.prepareToPush(q, nil, testMessage("a")) {
+		t.Fatal("squashed below the rate")
+	}
+	d.hold("destination", time.Hour)
+	if !d.prepareToPush(q, nil, testMessage("b")) {
+		t.Fatal("pushed to a held destination")
+	}
+	if due := store.batches["destination"].due; time.Until(due) < 59*time.Minute {
+		t.Errorf("batch due in %v", time.Until(due))
+	}
+}
+
+func TestSquasherSharedStore(t *testing.T) {
+	f := memory.MemoryQueueFactory{}
+	q, _ := f.NewQueue("test")
+	store := newMemorySquashStore()
+	config := SquashConfig{RateMax: 1, RatePer: time.Hour, Store: store}
+	d1 := newSquasher(config, RetryConfig{}, &testAdapter{})
+	d2 := newSquasher(config, RetryConfig{}, &testAdapter{})
+	if d1.prepareToPush(q, nil, testMessage("a")) {
+		t.Fatal("squashed below the rate")
+	}
+	// The other replica sees the push made by the first one
+	if !d2.prepareToPush(q, nil, testMessage("b")) {
+		t.Fatal("rate exceeded across replicas")
+	}
+	if due := store.batches["destination"].due; time.Until(due) < 59*time.Minute {
+		t.Errorf("batch due in %v", time.Until(due))
+	}
+}
+
+// failingAdapter fails to push squashed messages temporarily, counting the
+// attempts.
+type failingAdapter struct {
+	testAdapter
+	attempts int
+}
+
+func (a *failingAdapter) SquashAndPushMessage(client PumpClient, smsgs []ServiceMessage, fc FeedbackCollector) PushResult {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.attempts++
+	return TempFail("unavailable", nil)
+}
+
+func TestSquasherRetriesBatch(t *testing.T) {
+	f := memory.MemoryQueueFactory{}
+	q, _ := f.NewQueue("test")
+	dlq, _ := f.NewDeadLetterQueue("test")
+	for _, msg := range []string{"a", "b"} {
+		if err := q.Queue([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qms, err := q.GetBatch(ctx, 2)
+	if err != nil || len(qms) != 2 {
+		t.Fatal(len(qms), err)
+	}
+
+	adapter := &failingAdapter{}
+	store := newMemorySquashStore()
+	d := newSquasher(SquashConfig{RateMax: 1, RatePer: time.Millisecond, MaxAttempts: 2, Store: store}, RetryConfig{}, adapter)
+
+	// The first failure postpones the whole batch
+	d.sendBatch(q, dlq, nil, "destination", qms, 0, nopFeedbackCollector{})
+	retried, ok := store.batches["destination"]
+	if !ok || retried.attempts != 1 || len(retried.qms) != 2 {
+		t.Fatal("batch not postponed", ok)
+	}
+	if n, _ := q.Len(context.Background()); n != 0 {
+		t.Fatalf("%d messages requeued after the first attempt", n)
+	}
+
+	// Once out of attempts, the originals are requeued
+	delete(store.batches, "destination")
+	d.sendBatch(q, dlq, nil, "destination", retried.qms, retried.attempts, nopFeedbackCollector{})
+	if _, ok := store.batches["destination"]; ok {
+		t.Fatal("batch postponed after the last attempt")
+	}
+	if n, _ := q.Len(context.Background()); n != 2 {
+		t.Errorf("%d messages requeued, expected 2", n)
+	}
+	if adapter.attempts != 2 {
+		t.Errorf("%d attempts, expected 2", adapter.attempts)
+	}
+}
+
+func TestDeadLetterResponse(t *testing.T) {
+	f := memory.MemoryQueueFactory{}
+	q, _ := f.NewQueue("test")
+	dlq, _ := f.NewDeadLetterQueue("test")
+	if err := q.Queue([]byte(`{"shove":{"tenant":"acme","priority":"high"},"payload":"a"}`)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qm, err := q.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := HardFail("BadDeviceToken", errors.New("status 400"))
+	deadLetter(q, dlq, qm, "push failed", result.Description(), (&testAdapter{}).Logger())
+	dls, _ := dlq.Peek(ctx, 1)
+	if len(dls) != 1 {
+		t.Fatal("message not dead-lettered")
+	}
+	if dls[0].Reason != "push failed" || dls[0].Response != "BadDeviceToken: status 400" {
+		t.Errorf("reason %q, response %q", dls[0].Reason, dls[0].Response)
+	}
+	if dls[0].Payload != `"a"` || dls[0].Meta.Tenant != "acme" || dls[0].Meta.Priority != queue.PriorityHigh {
+		t.Errorf("payload %q, meta %+v", dls[0].Payload, dls[0].Meta)
+	}
+	if n, _ := q.Len(ctx); n != 0 {
+		t.Errorf("%d messages left in the queue", n)
+	}
+}
+
+// failingDeadLetterQueue fails to store dead letters.
+type failingDeadLetterQueue struct {
+	queue.DeadLetterQueue
+}
+
+func (failingDeadLetterQueue) Push(ctx context.Context, dl queue.DeadLetter) error {
+	return errors.New("unavailable")
+}
+
+func TestDeadLetterKeptQueued(t *testing.T) {
+	f := memory.MemoryQueueFactory{}
+	q, _ := f.NewQueue("test")
+	if err := q.Queue([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qm, err := q.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadLetter(q, failingDeadLetterQueue{}, qm, "push failed", "", (&testAdapter{}).Logger())
+	envs, _ := q.Peek(ctx, 1)
+	if len(envs) != 1 || string(envs[0].Payload) != "a" {
+		t.Fatal("message lost", envs)
+	}
+	if envs[0].Meta.RetryAt <= time.Now().Unix() {
+		t.Error("message requeued without a backoff")
+	}
+}
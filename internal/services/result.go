@@ -0,0 +1,73 @@
+package services
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PushResult is the verdict of the provider on a push.
+type PushResult struct {
+	Status PushStatus
+	// RetryAfter is how long the provider asked to wait before trying again,
+	// 0 if it gave no hint.
+	RetryAfter time.Duration
+	// Reason is why the provider did not accept the message, as reported by
+	// the provider.
+	Reason string
+	// Err is the error the push failed with, if any.
+	Err error
+}
+
+// Success reports a push that has been accepted by the provider.
+func Success() PushResult {
+	return PushResult{Status: PushStatusSuccess}
+}
+
+// TempFail reports a push that failed, but may succeed when retried.
+func TempFail(reason string, err error) PushResult {
+	return PushResult{Status: PushStatusTempFail, Reason: reason, Err: err}
+}
+
+// HardFail reports a push that failed, and would fail again when retried.
+func HardFail(reason string, err error) PushResult {
+	return PushResult{Status: PushStatusHardFail, Reason: reason, Err: err}
+}
+
+// After sets how long the provider asked to wait before trying again.
+func (r PushResult) After(d time.Duration) PushResult {
+	r.RetryAfter = d
+	return r
+}
+
+// Description describes why the push failed, for logs and dead letters.
+func (r PushResult) Description() string {
+	switch {
+	case r.Reason != "" && r.Err != nil:
+		return r.Reason + ": " + r.Err.Error()
+	case r.Reason != "":
+		return r.Reason
+	case r.Err != nil:
+		return r.Err.Error()
+	}
+	return ""
+}
+
+// RetryAfterHeader returns the delay asked for by the Retry-After header of
+// resp, given either in seconds or as HTTP date, or 0 if there is none.
+func RetryAfterHeader(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
@@ -0,0 +1,26 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfterHeader(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"":      0,
+		"120":   2 * time.Minute,
+		"-1":    0,
+		"later": 0,
+		time.Now().Add(time.Hour).UTC().Format(http.TimeFormat): time.Hour,
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Retry-After", value)
+		if d := RetryAfterHeader(resp); d > expected || d < expected-time.Second {
+			t.Errorf("%q: %v, expected %v", value, d, expected)
+		}
+	}
+	if d := RetryAfterHeader(nil); d != 0 {
+		t.Error(d)
+	}
+}
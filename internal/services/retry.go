@@ -0,0 +1,49 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+const (
+	// retryBackoff is the delay before the first retry of a message, doubling
+	// with every further attempt
+	retryBackoff = time.Second
+	// maxRetryBackoff caps the delay between retries of a message
+	maxRetryBackoff = 30 * time.Second
+)
+
+// RetryConfig bounds how often a temporarily failing message is retried
+// before it is moved to the dead-letter queue. Zero values mean unlimited.
+type RetryConfig struct {
+	MaxAttempts int
+	MaxAge      time.Duration
+}
+
+// giveUpReason returns why no further attempt should be made to deliver a
+// message, or an empty string if it should be retried.
+func (c RetryConfig) giveUpReason(meta queue.Meta, now time.Time) string {
+	if c.MaxAttempts > 0 && meta.Attempts >= c.MaxAttempts {
+		return fmt.Sprintf("gave up after %d attempts", meta.Attempts)
+	}
+	if c.MaxAge > 0 {
+		// Scheduled messages only start aging once they are due
+		since := max(meta.EnqueuedAt, meta.SendAt)
+		if age := now.Sub(time.Unix(since, 0)); age > c.MaxAge {
+			return fmt.Sprintf("gave up after %v", age.Round(time.Second))
+		}
+	}
+	return ""
+}
+
+// retryDelay returns how long to wait before attempting to deliver a message
+// again that has failed the given number of times.
+func retryDelay(attempts int) time.Duration {
+	delay := retryBackoff
+	for i := 1; i < attempts && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryBackoff)
+}
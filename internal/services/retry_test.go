@@ -0,0 +1,44 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+func TestGiveUpReason(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	config := RetryConfig{MaxAttempts: 3, MaxAge: time.Hour}
+	if reason := config.giveUpReason(queue.Meta{Attempts: 2, EnqueuedAt: now.Unix()}, now); reason != "" {
+		t.Fatal(reason)
+	}
+	if reason := config.giveUpReason(queue.Meta{Attempts: 3, EnqueuedAt: now.Unix()}, now); reason == "" {
+		t.Fatal("expected to give up after max. attempts")
+	}
+	old := now.Add(-2 * time.Hour).Unix()
+	if reason := config.giveUpReason(queue.Meta{Attempts: 1, EnqueuedAt: old}, now); reason == "" {
+		t.Fatal("expected to give up after max. age")
+	}
+	// Age of scheduled messages counts from their due time
+	if reason := config.giveUpReason(queue.Meta{Attempts: 1, EnqueuedAt: old, SendAt: now.Unix()}, now); reason != "" {
+		t.Fatal(reason)
+	}
+	if reason := (RetryConfig{}).giveUpReason(queue.Meta{Attempts: 100, EnqueuedAt: old}, now); reason != "" {
+		t.Fatal(reason)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, expected := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		5:  16 * time.Second,
+		6:  30 * time.Second,
+		50: 30 * time.Second,
+	} {
+		if delay := retryDelay(attempts); delay != expected {
+			t.Error(attempts, delay, expected)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package services
 import (
 	"fmt"
 	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
 )
 
 // FeedbackCollector ...
@@ -10,12 +12,79 @@ type FeedbackCollector interface {
 	TokenInvalid(serviceID, token string)
 	ReplaceToken(serviceID, token, replacement string)
 	CountPush(serviceID string, success bool, duration time.Duration)
+	// MessageExpired reports a message that was dropped because it expired
+	// before it could be delivered. The token is empty if the message does
+	// not address a single token.
+	MessageExpired(serviceID, token string)
 }
 
 // PushService ...
 type PushService interface {
 	PumpAdapter
 	fmt.Stringer
-	ID() string
 	Validate([]byte) error
 }
+
+// PriorityHinter is implemented by service messages that carry a priority of
+// their own, such as the APNS apns-priority header.
+type PriorityHinter interface {
+	PriorityHint() queue.Priority
+}
+
+// ExpiryHinter is implemented by service messages that carry an expiry time of
+// their own, such as the APNS apns-expiration header. It returns the zero time
+// if the message does not expire.
+type ExpiryHinter interface {
+	ExpiryHint() time.Time
+}
+
+// TokenHolder is implemented by service messages that address a single token,
+// so that feedback about the message can refer to it.
+type TokenHolder interface {
+	FeedbackToken() string
+}
+
+// DestinationHolder is implemented by service messages that know where they
+// are pushed to, e.g. the host of a webhook, so that pushes to the same
+// destination can be throttled. Messages addressing a single token are
+// throttled by the token otherwise.
+type DestinationHolder interface {
+	Destination() string
+}
+
+// HintedMeta returns the queue metadata implied by a message itself, which
+// applies when it is queued without explicit metadata.
+func HintedMeta(adapter PumpAdapter, data []byte) (meta queue.Meta) {
+	meta.Priority = queue.PriorityNormal
+	smsg, err := adapter.ConvertMessage(data)
+	if err != nil {
+		return
+	}
+	if h, ok := smsg.(PriorityHinter); ok {
+		meta.Priority = h.PriorityHint()
+	}
+	if h, ok := smsg.(ExpiryHinter); ok {
+		if exp := h.ExpiryHint(); !exp.IsZero() {
+			meta.ExpiresAt = exp.Unix()
+		}
+	}
+	meta.ShardKey = feedbackToken(smsg)
+	return
+}
+
+// feedbackToken returns the token addressed by a message, if any.
+func feedbackToken(smsg ServiceMessage) string {
+	if t, ok := smsg.(TokenHolder); ok {
+		return t.FeedbackToken()
+	}
+	return ""
+}
+
+// destination returns the destination of a message, or an empty string if
+// unknown.
+func destination(smsg ServiceMessage) string {
+	if d, ok := smsg.(DestinationHolder); ok {
+		return d.Destination()
+	}
+	return feedbackToken(smsg)
+}
@@ -1,182 +1,258 @@
 package services
 
 import (
-	"sync"
+	"context"
 	"time"
 
 	"github.com/mattstrayer/shove/internal/queue"
 )
 
-type batch struct {
-	key         string
-	serviceMsgs []ServiceMessage
-	due         time.Time
-	queuedMsgs  []queue.QueuedMessage
-	q           queue.Queue
-	client      PumpClient
-}
+// defaultSquashMaxAttempts is the number of times a batch is sent by default
+const defaultSquashMaxAttempts = 3
+
+// squashPollInterval is how often the store is checked for batches that have
+// become due, e.g. squashed by other replicas
+const squashPollInterval = 500 * time.Millisecond
 
 type SquashConfig struct {
 	RateMax int
 	RatePer time.Duration
+	// MaxAttempts is the number of times a batch is sent before its messages
+	// are retried one by one, defaultSquashMaxAttempts if 0.
+	MaxAttempts int
+	// Store keeps the rate windows and the batches, in memory if nil.
+	// Replicas consuming the same queue need to share a store for the rate
+	// to hold across them.
+	Store SquashStore
 }
 
 type squasher struct {
-	pushedAt     map[string][]time.Time
-	batches      map[string]batch
-	config       SquashConfig
-	cond         *sync.Cond
-	lock         sync.Mutex
-	shuttingDown bool
-	adapter      PumpAdapter
+	store       SquashStore
+	config      SquashConfig
+	retryConfig RetryConfig
+	adapter     PumpAdapter
+	// wake is poked when a message has been squashed
+	wake chan struct{}
+	// stop is closed when shutting down
+	stop chan struct{}
+}
+
+// sourceQueue is the queue the messages of the batches were taken off. It is
+// named so that batchQueue can embed it along with its Queue method.
+type sourceQueue = queue.Queue
+
+// batchQueue is the queue of the messages of the batches, which are removed
+// and requeued through the store keeping them.
+type batchQueue struct {
+	sourceQueue
+	store SquashStore
+}
+
+func (q batchQueue) Remove(qm queue.QueuedMessage) error {
+	return q.store.Remove(q.sourceQueue, qm)
 }
 
-func newSquasher(config SquashConfig, adapter PumpAdapter) (d *squasher) {
+func (q batchQueue) Requeue(qm queue.QueuedMessage) error {
+	return q.store.Requeue(q.sourceQueue, qm)
+}
+
+func newSquasher(config SquashConfig, retryConfig RetryConfig, adapter PumpAdapter) (d *squasher) {
 	d = new(squasher)
 	d.adapter = adapter
 	d.config = config
-	d.pushedAt = make(map[string][]time.Time)
-	d.batches = make(map[string]batch)
-	d.cond = sync.NewCond(&d.lock)
+	d.retryConfig = retryConfig
+	d.store = config.Store
+	if d.store == nil {
+		d.store = newMemorySquashStore()
+	}
+	d.wake = make(chan struct{}, 1)
+	d.stop = make(chan struct{})
 	return d
 }
 
-func (d *squasher) flushAndGetRate(key string) (sendCount int, sentAt time.Time) {
-	var flushedTimes []time.Time
-	times := d.pushedAt[key]
-	var didFlush = false
-	for _, t := range times {
-		if time.Since(t) > d.config.RatePer {
-			didFlush = true
-			continue
-		}
-		flushedTimes = append(flushedTimes, t)
-		sendCount++
+// claim claims a push to a destination from the store, returning how long
+// to wait otherwise. Pushes are not held back if the store fails.
+func (d *squasher) claim(key string) (claimed bool, wait time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), squashStoreTimeout)
+	defer cancel()
+	claimed, wait, err := d.store.Claim(ctx, key, d.config.RateMax, d.config.RatePer)
+	if err != nil {
+		d.adapter.Logger().Error("Failed to claim push from squash store", "destination", key, "error", err)
+		return true, 0
 	}
-	if didFlush {
-		d.pushedAt[key] = flushedTimes
+	return claimed, wait
+}
+
+func (d *squasher) prepareToPush(q queue.Queue, qm queue.QueuedMessage, smsg ServiceMessage) (squashed bool) {
+	key := smsg.GetSquashKey()
+	claimed, wait := d.claim(key)
+	if claimed {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), squashStoreTimeout)
+	defer cancel()
+	if err := d.store.Squash(ctx, q, key, qm, wait); err != nil {
+		d.adapter.Logger().Error("Failed to squash message, pushing it", "destination", key, "error", err)
+		return false
 	}
-	if len(flushedTimes) > 0 {
-		sentAt = flushedTimes[0]
+	d.adapter.Logger().Debug("Rate exceeded, squashed", "destination", key)
+	select {
+	case d.wake <- struct{}{}:
+	default:
 	}
-	return
+	return true
 }
 
-func (d *squasher) recordPush(key string) {
-	times := d.pushedAt[key]
-	times = append(times, time.Now())
-	d.pushedAt[key] = times
+func (d *squasher) maxAttempts() int {
+	if d.config.MaxAttempts > 0 {
+		return d.config.MaxAttempts
+	}
+	return defaultSquashMaxAttempts
 }
 
-func (d *squasher) prepareToPush(q queue.Queue, qm queue.QueuedMessage, client PumpClient, smsg ServiceMessage) (squashed bool) {
-	d.cond.L.Lock()
-	defer d.cond.L.Unlock()
-
-	key := smsg.GetSquashKey()
-	sendCount, firstSendAt := d.flushAndGetRate(key)
-	if sendCount < d.config.RateMax {
-		d.recordPush(key)
+// postpone puts back a batch that may not be sent yet. If the store fails,
+// its messages are requeued to be pushed on their own, and false is returned.
+func (d *squasher) postpone(q queue.Queue, key string, qms []queue.QueuedMessage, attempts int, wait time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), squashStoreTimeout)
+	defer cancel()
+	if err := d.store.Postpone(ctx, key, qms, attempts, wait); err != nil {
+		d.adapter.Logger().Error("Failed to postpone batch, requeueing the messages", "destination", key, "error", err)
+		requeue(q, qms)
 		return false
 	}
-	d.adapter.Logger().Info("Rate exceeded, squashed", "destination", key)
-
-	batch, ok := d.batches[key]
-	if ok {
-		if batch.q != q {
-			panic("squasher cannot handle mixed queues")
-		}
-	} else {
-		batch.q = q
-		batch.client = client
-	}
-	batch.key = key
-	batch.serviceMsgs = append(batch.serviceMsgs, smsg)
-	batch.queuedMsgs = append(batch.queuedMsgs, qm)
-	batch.due = firstSendAt.Add(d.config.RatePer)
-	d.batches[key] = batch
-	d.cond.Signal()
 	return true
 }
 
-func (d *squasher) getNextBatch() (b batch, stopped bool) {
-	for {
-		d.cond.L.Lock()
-		if len(d.batches) == 0 {
-			d.cond.Wait()
-		}
-		if d.shuttingDown {
-			d.cond.L.Unlock()
-			stopped = true
-			return
-		}
-		var minDueBatch batch
-		var minDueBatchKey string
-		for key, batch := range d.batches {
-			if minDueBatch.due.IsZero() || minDueBatch.due.After(batch.due) {
-				minDueBatch = batch
-				minDueBatchKey = key
-			}
-		}
-		now := time.Now()
-		if now.After(minDueBatch.due) {
-			delete(d.batches, minDueBatchKey)
-			d.cond.L.Unlock()
-			return minDueBatch, false
-		}
-		d.cond.L.Unlock()
+// done releases a batch whose messages have been dealt with.
+func (d *squasher) done(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), squashStoreTimeout)
+	defer cancel()
+	if err := d.store.Done(ctx, key); err != nil {
+		d.adapter.Logger().Error("Failed to release batch in squash store", "destination", key, "error", err)
+	}
+}
 
-		zzz := minDueBatch.due.Sub(now)
-		maxZzz := time.Millisecond * 500
-		if zzz > maxZzz {
-			zzz = maxZzz
-		}
-		time.Sleep(zzz)
+// hold squashes the messages to a destination for the given duration, as the
+// provider asked to wait before pushing to it again.
+func (d *squasher) hold(key string, wait time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), squashStoreTimeout)
+	defer cancel()
+	if err := d.store.Hold(ctx, key, wait); err != nil {
+		d.adapter.Logger().Error("Failed to hold destination in squash store", "destination", key, "error", err)
 	}
 }
 
-func (d *squasher) requestShutdown() {
-	d.cond.L.Lock()
-	d.shuttingDown = true
-	d.cond.Signal()
-	d.cond.L.Unlock()
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
 }
 
-func (d *squasher) shutdown() {
-	d.cond.L.Lock()
-	defer d.cond.L.Unlock()
+// take takes the next batch that is due off the store. If there is none, it
+// returns how long to wait before looking again.
+func (d *squasher) take() (key string, qms []queue.QueuedMessage, attempts int, wait time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), squashStoreTimeout)
+	defer cancel()
+	key, qms, attempts, wait, err := d.store.Take(ctx, d.config.RateMax, d.config.RatePer)
+	if err != nil {
+		d.adapter.Logger().Error("Failed to take batch from squash store", "error", err)
+		return "", nil, 0, squashPollInterval
+	}
+	if wait < 0 || wait > squashPollInterval {
+		wait = squashPollInterval
+	}
+	return key, qms, attempts, wait
+}
 
-	d.adapter.Logger().Info("Shutting down squasher", "unsent_batch_count", len(d.batches))
+func (d *squasher) requestShutdown() {
+	close(d.stop)
 }
 
-func (d *squasher) serve(fc FeedbackCollector) {
+// shutdown requeues the messages of the batches kept in memory, so that they
+// are pushed after a restart. A shared store keeps them for the other
+// replicas.
+func (d *squasher) shutdown(q queue.Queue) {
+	store, ok := d.store.(*memorySquashStore)
+	if !ok {
+		d.adapter.Logger().Info("Shutting down squasher")
+		return
+	}
+	batches, qms := store.drain()
+	requeue(q, qms)
+	d.adapter.Logger().Info("Shutting down squasher", "unsent_batch_count", batches, "requeued_count", len(qms))
+}
+
+func (d *squasher) serve(q queue.Queue, dlq queue.DeadLetterQueue, client PumpClient, fc FeedbackCollector) {
 	for {
-		batch, stopped := d.getNextBatch()
-		if stopped {
-			d.shutdown()
+		key, qms, attempts, wait := d.take()
+		if key != "" {
+			if !d.sendBatch(q, dlq, client, key, qms, attempts, fc) {
+				d.done(key)
+			}
+			continue
+		}
+		select {
+		case <-d.stop:
+			d.shutdown(q)
 			return
+		case <-d.wake:
+		case <-time.After(wait):
 		}
-		d.sendBatch(batch, fc)
-
 	}
 }
 
-func (d *squasher) sendBatch(b batch, fc FeedbackCollector) {
-	d.adapter.Logger().Info("Sending batch", "batch_size", len(b.serviceMsgs))
-	d.cond.L.Lock()
-	d.recordPush(b.key)
-	d.cond.L.Unlock()
+// sendBatch sends a batch taken off the store, returning whether it has been
+// put back to be sent again later.
+func (d *squasher) sendBatch(q queue.Queue, dlq queue.DeadLetterQueue, client PumpClient, key string, qms []queue.QueuedMessage, attempts int, fc FeedbackCollector) (postponed bool) {
+	log := d.adapter.Logger()
+	bq := batchQueue{sourceQueue: q, store: d.store}
+	now := time.Now()
+	var queuedMsgs []queue.QueuedMessage
+	var serviceMsgs []ServiceMessage
+	for _, qm := range qms {
+		smsg, err := d.adapter.ConvertMessage(qm.Message())
+		if err != nil {
+			deadLetter(bq, dlq, qm, "invalid message: "+err.Error(), "", log)
+			continue
+		}
+		if qm.Envelope().Meta.Expired(now) {
+			dropExpired(d.adapter, bq, qm, smsg, fc)
+			continue
+		}
+		queuedMsgs = append(queuedMsgs, qm)
+		serviceMsgs = append(serviceMsgs, smsg)
+	}
+	if len(serviceMsgs) == 0 {
+		return false
+	}
+	log.Info("Sending batch", "batch_size", len(serviceMsgs))
 
-	status := d.adapter.SquashAndPushMessage(b.client, b.serviceMsgs, fc)
-	switch status {
+	result := d.adapter.SquashAndPushMessage(client, serviceMsgs, fc)
+	switch result.Status {
 	case PushStatusTempFail:
-		// TODO: We should actually attempt to retry this with a backoff
-		fallthrough
+		if result.RetryAfter > 0 {
+			d.hold(key, result.RetryAfter)
+		}
+		attempts++
+		if attempts < d.maxAttempts() {
+			delay := max(retryDelay(attempts), result.RetryAfter)
+			log.Warn("Failed to send batch, retrying", "reason", result.Description(), "attempts", attempts, "delay", delay)
+			return d.postpone(bq, key, queuedMsgs, attempts, delay)
+		}
+		log.Error("Failed to send batch, retrying the messages", "reason", result.Description(), "attempts", attempts)
+		for i, qm := range queuedMsgs {
+			retry(d.adapter, d.retryConfig, bq, dlq, qm, serviceMsgs[i], fc, result)
+		}
 	case PushStatusHardFail:
-		d.adapter.Logger().Error("Failed to send batch")
-		fallthrough
+		log.Error("Failed to send batch", "reason", result.Description())
+		for _, qm := range queuedMsgs {
+			deadLetter(bq, dlq, qm, "squashed push failed", result.Description(), log)
+		}
 	case PushStatusSuccess:
-		for _, qm := range b.queuedMsgs {
-			removeFromQueue(b.q, qm, d.adapter.Logger())
+		for _, qm := range queuedMsgs {
+			removeFromQueue(bq, qm, log)
 		}
 	}
+	return false
 }
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mattstrayer/shove/internal/queue"
+)
+
+// squashStoreTimeout bounds the calls made to the squash store
+const squashStoreTimeout = 5 * time.Second
+
+// SquashStore keeps the rate windows of the destinations of a squasher, how
+// long their provider asked to hold them back, and the batches of messages
+// squashed to them. A store shared by all replicas consuming the same queue
+// makes the rate limit hold across them, and lets any replica send a batch
+// once it is due.
+type SquashStore interface {
+	// Claim records a push to a destination, unless max pushes have been
+	// made to it within per, it is held back, or a batch to it is pending.
+	// In that case it returns how long to wait before the next push may be
+	// made.
+	Claim(ctx context.Context, key string, max int, per time.Duration) (claimed bool, wait time.Duration, err error)
+	// Hold holds back the pushes to a destination for the given duration.
+	Hold(ctx context.Context, key string, wait time.Duration) error
+	// Squash adds a message taken off q to the batch pending for a
+	// destination, which becomes due after wait unless pending already. The
+	// store takes the message over, either leaving it in flight or moving it
+	// out of q.
+	Squash(ctx context.Context, q queue.Queue, key string, qm queue.QueuedMessage, wait time.Duration) error
+	// Take takes the batch that is due first, claiming a push to its
+	// destination, or postpones it if the rate window or a hold of the
+	// destination does not allow for it yet. If no batch is taken, it
+	// returns how long to wait before the next one may be due, or a
+	// negative wait if no batch is pending.
+	Take(ctx context.Context, max int, per time.Duration) (key string, qms []queue.QueuedMessage, attempts int, wait time.Duration, err error)
+	// Postpone puts back a batch that has been taken but could not be sent,
+	// ahead of the messages squashed to the destination in the meantime, to
+	// become due after wait. attempts is the number of times sending it
+	// failed.
+	Postpone(ctx context.Context, key string, qms []queue.QueuedMessage, attempts int, wait time.Duration) error
+	// Done releases a batch that has been taken, once its messages have been
+	// sent, dead-lettered or requeued. A store may put back the batches that
+	// are not released in time, e.g. as the replica sending them died.
+	Done(ctx context.Context, key string) error
+	// Remove removes a message of a batch once it has been dealt with.
+	Remove(q queue.Queue, qm queue.QueuedMessage) error
+	// Requeue puts a message of a batch back into q, to be pushed on its
+	// own.
+	Requeue(q queue.Queue, qm queue.QueuedMessage) error
+}
+
+// memorySquashStore is the SquashStore of a single replica. It keeps the
+// squashed messages in flight in their queue.
+type memorySquashStore struct {
+	lock      sync.Mutex
+	pushedAt  map[string][]time.Time
+	heldUntil map[string]time.Time
+	batches   map[string]*memoryBatch
+}
+
+type memoryBatch struct {
+	qms      []queue.QueuedMessage
+	due      time.Time
+	attempts int
+}
+
+func newMemorySquashStore() *memorySquashStore {
+	return &memorySquashStore{
+		pushedAt:  make(map[string][]time.Time),
+		heldUntil: make(map[string]time.Time),
+		batches:   make(map[string]*memoryBatch),
+	}
+}
+
+// flushAndGetRate forgets the pushes made before the rate window, returning
+// the number of pushes within it and when the oldest one was made. The lock
+// must be held.
+func (s *memorySquashStore) flushAndGetRate(key string, per time.Duration, now time.Time) (sendCount int, sentAt time.Time) {
+	var flushedTimes []time.Time
+	for _, t := range s.pushedAt[key] {
+		if now.Sub(t) > per {
+			continue
+		}
+		flushedTimes = append(flushedTimes, t)
+		sendCount++
+	}
+	if len(flushedTimes) > 0 {
+		s.pushedAt[key] = flushedTimes
+		sentAt = flushedTimes[0]
+	} else {
+		delete(s.pushedAt, key)
+	}
+	return
+}
+
+// allowedAt returns when the next push to a destination may be made, which
+// is now if it may be made right away. The lock must be held.
+func (s *memorySquashStore) allowedAt(key string, max int, per time.Duration, now time.Time) time.Time {
+	at := now
+	if heldUntil, held := s.heldUntil[key]; held {
+		if now.Before(heldUntil) {
+			at = heldUntil
+		} else {
+			delete(s.heldUntil, key)
+		}
+	}
+	if sendCount, firstSendAt := s.flushAndGetRate(key, per, now); sendCount >= max {
+		at = later(at, firstSendAt.Add(per))
+	}
+	return at
+}
+
+func (s *memorySquashStore) Claim(ctx context.Context, key string, max int, per time.Duration) (claimed bool, wait time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	at := s.allowedAt(key, max, per, now)
+	if b, pending := s.batches[key]; pending {
+		return false, later(at, b.due).Sub(now), nil
+	}
+	if at.After(now) {
+		return false, at.Sub(now), nil
+	}
+	s.pushedAt[key] = append(s.pushedAt[key], now)
+	return true, 0, nil
+}
+
+func (s *memorySquashStore) Hold(ctx context.Context, key string, wait time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.heldUntil[key] = later(s.heldUntil[key], time.Now().Add(wait))
+	return nil
+}
+
+func (s *memorySquashStore) Squash(ctx context.Context, q queue.Queue, key string, qm queue.QueuedMessage, wait time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, pending := s.batches[key]
+	if !pending {
+		b = &memoryBatch{due: time.Now().Add(wait)}
+		s.batches[key] = b
+	}
+	b.qms = append(b.qms, qm)
+	return nil
+}
+
+func (s *memorySquashStore) Take(ctx context.Context, max int, per time.Duration) (key string, qms []queue.QueuedMessage, attempts int, wait time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for {
+		var next *memoryBatch
+		for k, b := range s.batches {
+			if next == nil || b.due.Before(next.due) {
+				key, next = k, b
+			}
+		}
+		if next == nil {
+			return "", nil, 0, -1, nil
+		}
+		if next.due.After(now) {
+			return "", nil, 0, next.due.Sub(now), nil
+		}
+		if at := s.allowedAt(key, max, per, now); at.After(now) {
+			next.due = at
+			continue
+		}
+		s.pushedAt[key] = append(s.pushedAt[key], now)
+		delete(s.batches, key)
+		return key, next.qms, next.attempts, 0, nil
+	}
+}
+
+func (s *memorySquashStore) Postpone(ctx context.Context, key string, qms []queue.QueuedMessage, attempts int, wait time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b := &memoryBatch{qms: qms, due: time.Now().Add(wait), attempts: attempts}
+	if squashed, pending := s.batches[key]; pending {
+		b.qms = append(b.qms, squashed.qms...)
+	}
+	s.batches[key] = b
+	return nil
+}
+
+// Done does nothing, as the messages of a batch are kept in flight in their
+// queue until dealt with.
+func (s *memorySquashStore) Done(ctx context.Context, key string) error {
+	return nil
+}
+
+func (s *memorySquashStore) Remove(q queue.Queue, qm queue.QueuedMessage) error {
+	return q.Remove(qm)
+}
+
+func (s *memorySquashStore) Requeue(q queue.Queue, qm queue.QueuedMessage) error {
+	return q.Requeue(qm)
+}
+
+// drain takes the messages of all batches off the store.
+func (s *memorySquashStore) drain() (batches int, qms []queue.QueuedMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, b := range s.batches {
+		qms = append(qms, b.qms...)
+	}
+	batches = len(s.batches)
+	s.batches = make(map[string]*memoryBatch)
+	return batches, qms
+}
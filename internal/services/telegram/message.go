@@ -29,6 +29,12 @@ func (msg telegramMessage) GetSquashKey() string {
 	return msg.parsedPayload.ChatID
 }
 
+// FeedbackToken returns the chat ID, which also serves as token in the
+// feedback about unreachable chats.
+func (msg telegramMessage) FeedbackToken() string {
+	return msg.parsedPayload.ChatID
+}
+
 func (tg *TelegramService) ConvertMessage(data []byte) (services.ServiceMessage, error) {
 	var msg telegramMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
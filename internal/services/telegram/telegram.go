@@ -50,7 +50,7 @@ func (tg *TelegramService) NewClient() (services.PumpClient, error) {
 	return client, nil
 }
 
-func (tg *TelegramService) SquashAndPushMessage(pclient services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
+func (tg *TelegramService) SquashAndPushMessage(pclient services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushResult {
 	client := pclient.(*http.Client)
 	msgs := make([]telegramMessage, len(smsgs))
 	for i, smsg := range smsgs {
@@ -59,18 +59,18 @@ func (tg *TelegramService) SquashAndPushMessage(pclient services.PumpClient, sms
 	dmsg, err := squashMessages(msgs)
 	if err != nil {
 		tg.log.Error("Squashing failed", "error", err)
-		return services.PushStatusHardFail
+		return services.HardFail("squashing failed", err)
 	}
 	return tg.pushMessage(client, dmsg.Method, dmsg.parsedPayload.ChatID, dmsg.Payload, fc)
 }
 
-func (tg *TelegramService) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
+func (tg *TelegramService) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushResult {
 	client := pclient.(*http.Client)
 	msg := smsg.(telegramMessage)
 	return tg.pushMessage(client, msg.Method, msg.parsedPayload.ChatID, msg.Payload, fc)
 }
 
-func (tg *TelegramService) pushMessage(client *http.Client, method string, chatID string, payload json.RawMessage, fc services.FeedbackCollector) (status services.PushStatus) {
+func (tg *TelegramService) pushMessage(client *http.Client, method string, chatID string, payload json.RawMessage, fc services.FeedbackCollector) services.PushResult {
 	startedAt := time.Now()
 	var success bool
 
@@ -78,13 +78,13 @@ func (tg *TelegramService) pushMessage(client *http.Client, method string, chatI
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
 	if err != nil {
 		tg.log.Error("Failure creating request", "error", err)
-		return services.PushStatusHardFail
+		return services.HardFail("", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := client.Do(req)
 	if err != nil {
 		tg.log.Error("Posting failed", "error", err)
-		return services.PushStatusTempFail
+		return services.TempFail("", err)
 	}
 	duration := time.Now().Sub(startedAt)
 
@@ -94,21 +94,25 @@ func (tg *TelegramService) pushMessage(client *http.Client, method string, chatI
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 429 {
-		tg.log.Error("Throttled, too many requests", "status", 429)
-		return services.PushStatusTempFail
-	}
-
 	var respData struct {
 		OK          bool   `json:"ok"`
 		ErrorCode   int    `json:"error_code"`
 		Description string `json:"description"`
+		Parameters  struct {
+			// RetryAfter is the number of seconds to wait when throttled
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
 	}
 
 	err = json.NewDecoder(resp.Body).Decode(&respData)
+	if resp.StatusCode == 429 {
+		retryAfter := time.Duration(respData.Parameters.RetryAfter) * time.Second
+		tg.log.Error("Throttled, too many requests", "status", 429, "retry_after", retryAfter)
+		return services.TempFail(respData.Description, nil).After(retryAfter)
+	}
 	if err != nil {
 		tg.log.Error("Unable to decode response", "error", err)
-		return services.PushStatusTempFail
+		return services.TempFail("", err)
 	}
 
 	// It's a bit odd that an invalid chat ID results in a 400 instead of a
@@ -119,12 +123,12 @@ func (tg *TelegramService) pushMessage(client *http.Client, method string, chatI
 	}
 	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
 		tg.log.Error("Rejected", "description", respData.Description, "error_code", respData.ErrorCode, "status", resp.StatusCode)
-		return services.PushStatusHardFail
+		return services.HardFail(respData.Description, nil)
 	}
 	if resp.StatusCode >= 500 && resp.StatusCode < 600 {
 		tg.log.Error("Upstream failure", "status", resp.StatusCode)
-		return services.PushStatusTempFail
+		return services.TempFail(respData.Description, nil)
 	}
-	tg.log.Info("Pushed", "duration", duration)
-	return services.PushStatusSuccess
+	tg.log.Debug("Pushed", "duration", duration)
+	return services.Success()
 }
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// throttlePruneInterval is how often the buckets of destinations that have
+// been idle long enough to be full again are forgotten
+const throttlePruneInterval = time.Minute
+
+// ThrottleConfig limits the rate at which messages are pushed, without
+// squashing them, using a token bucket. The throttle is disabled if Amount is
+// 0.
+type ThrottleConfig struct {
+	// Amount is the number of messages pushed per Per, which may go out at
+	// once after a pause.
+	Amount int
+	Per    time.Duration
+	// PerDestination limits the rate per destination, e.g. device token or
+	// webhook host, instead of for the whole service.
+	PerDestination bool
+}
+
+type tokenBucket struct {
+	tokens float64
+	// updatedAt is when tokens was last refilled
+	updatedAt time.Time
+}
+
+// throttle hands out the tokens of a bucket per destination, or of a single
+// bucket for the whole service.
+type throttle struct {
+	config ThrottleConfig
+	// rate is the number of tokens added per second
+	rate     float64
+	lock     sync.Mutex
+	buckets  map[string]*tokenBucket
+	prunedAt time.Time
+}
+
+func newThrottle(config ThrottleConfig) *throttle {
+	per := config.Per
+	if per <= 0 {
+		per = time.Second
+	}
+	return &throttle{
+		config:  config,
+		rate:    float64(config.Amount) / per.Seconds(),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// bucket returns the bucket of a destination, refilled up to now. The lock
+// must be held.
+func (t *throttle) bucket(key string, now time.Time) *tokenBucket {
+	if now.Sub(t.prunedAt) > throttlePruneInterval {
+		for k, b := range t.buckets {
+			if t.refill(b, now) >= float64(t.config.Amount) {
+				delete(t.buckets, k)
+			}
+		}
+		t.prunedAt = now
+	}
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(t.config.Amount), updatedAt: now}
+		t.buckets[key] = b
+	}
+	t.refill(b, now)
+	return b
+}
+
+func (t *throttle) refill(b *tokenBucket, now time.Time) float64 {
+	b.tokens = min(b.tokens+now.Sub(b.updatedAt).Seconds()*t.rate, float64(t.config.Amount))
+	b.updatedAt = now
+	return b.tokens
+}
+
+// available returns how many of n tokens the bucket of a destination holds,
+// and if none, how long it takes for the next one to be added. The lock must
+// be held.
+func (t *throttle) available(key string, n int) (available int, wait time.Duration) {
+	b := t.bucket(key, time.Now())
+	if b.tokens < 1 {
+		return 0, time.Duration((1 - b.tokens) / t.rate * float64(time.Second))
+	}
+	return min(n, int(b.tokens)), 0
+}
+
+// take takes n tokens of the bucket of a destination.
+func (t *throttle) take(key string, n int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.bucket(key, time.Now()).tokens -= float64(n)
+}
+
+// tryTake takes a token of the bucket of a destination if there is one.
+// Otherwise it returns how long it takes for the next one to be added.
+func (t *throttle) tryTake(key string) (wait time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, wait = t.available(key, 1); wait == 0 {
+		t.bucket(key, time.Now()).tokens--
+	}
+	return wait
+}
+
+// wait waits until the bucket of a destination holds a token, without taking
+// it. Returns how many of n tokens it holds, or false if ctx is done before.
+func (t *throttle) wait(ctx context.Context, key string, n int) (available int, ok bool) {
+	for {
+		t.lock.Lock()
+		available, wait := t.available(key, n)
+		t.lock.Unlock()
+		if available > 0 {
+			return available, true
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, false
+		}
+	}
+}
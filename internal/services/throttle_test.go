@@ -0,0 +1,40 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(ThrottleConfig{Amount: 2, Per: 100 * time.Millisecond})
+
+	// A full bucket lets a burst through, then one message per 50ms
+	for i := 0; i < 2; i++ {
+		if wait := th.tryTake("a"); wait != 0 {
+			t.Fatal(i, wait)
+		}
+	}
+	wait := th.tryTake("a")
+	if wait <= 0 || wait > 50*time.Millisecond {
+		t.Fatal(wait)
+	}
+	// Destinations have buckets of their own
+	if wait := th.tryTake("b"); wait != 0 {
+		t.Fatal(wait)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	available, ok := th.wait(ctx, "a", 10)
+	if !ok || available != 1 || time.Since(start) < wait-time.Millisecond {
+		t.Fatal(available, ok, time.Since(start))
+	}
+	th.take("a", available)
+	short, cancelShort := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelShort()
+	if _, ok := th.wait(short, "a", 1); ok {
+		t.Fatal("token available right after taking it")
+	}
+}
@@ -21,6 +21,16 @@ func (webhookMessage) GetSquashKey() string {
 	panic("not implemented")
 }
 
+// Destination returns the host posted to, as partners limit the rate per
+// host rather than per URL.
+func (msg webhookMessage) Destination() string {
+	u, err := url.Parse(msg.URL)
+	if err != nil {
+		return msg.URL
+	}
+	return u.Host
+}
+
 func (wh *Webhook) ConvertMessage(data []byte) (smsg services.ServiceMessage, err error) {
 	var msg webhookMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
@@ -47,11 +47,11 @@ func (fcm *Webhook) NewClient() (services.PumpClient, error) {
 	return client, nil
 }
 
-func (wh *Webhook) SquashAndPushMessage(services.PumpClient, []services.ServiceMessage, services.FeedbackCollector) services.PushStatus {
+func (wh *Webhook) SquashAndPushMessage(services.PumpClient, []services.ServiceMessage, services.FeedbackCollector) services.PushResult {
 	panic("not implemented")
 }
 
-func (wh *Webhook) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (wh *Webhook) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushResult {
 	msg := smsg.(webhookMessage)
 	startedAt := time.Now()
 	var success bool
@@ -60,7 +60,7 @@ func (wh *Webhook) PushMessage(pclient services.PumpClient, smsg services.Servic
 	req, err := http.NewRequest("POST", msg.URL, bytes.NewBuffer(msg.postData))
 	if err != nil {
 		wh.log.Error("Failed to create request", "error", err)
-		return services.PushStatusHardFail
+		return services.HardFail("", err)
 	}
 	for k, v := range msg.Headers {
 		req.Header.Set(k, v)
@@ -70,7 +70,7 @@ func (wh *Webhook) PushMessage(pclient services.PumpClient, smsg services.Servic
 	resp, err := client.Do(req)
 	if err != nil {
 		wh.log.Error("Failed to post", "error", err)
-		return services.PushStatusHardFail
+		return services.TempFail("", err)
 	}
 	duration := time.Now().Sub(startedAt)
 
@@ -86,17 +86,19 @@ func (wh *Webhook) PushMessage(pclient services.PumpClient, smsg services.Servic
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter := services.RetryAfterHeader(resp)
+		wh.log.Error("Throttled, too many requests", "status", resp.StatusCode, "retry_after", retryAfter)
+		return services.TempFail(resp.Status, nil).After(retryAfter)
+	}
 	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
 		wh.log.Error("Rejected", "status", resp.StatusCode)
-		return services.PushStatusHardFail
+		return services.HardFail(resp.Status, nil)
 	}
 	if resp.StatusCode >= 500 && resp.StatusCode < 600 {
 		wh.log.Error("Upstream failure", "status", resp.StatusCode)
-		// A retry might help, but currently retries are not limitted to
-		// a certain number of attempts, meaning, we would keep trying
-		// indefinitely.
-		return services.PushStatusHardFail
+		return services.TempFail(resp.Status, nil).After(services.RetryAfterHeader(resp))
 	}
 	success = true
-	return services.PushStatusSuccess
+	return services.Success()
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 
 	wpg "github.com/SherClockHolmes/webpush-go"
+	"github.com/mattstrayer/shove/internal/queue"
 	"github.com/mattstrayer/shove/internal/services"
 )
 
@@ -25,6 +26,23 @@ func (msg webPushMessage) GetSquashKey() string {
 	panic("not implemented")
 }
 
+// PriorityHint maps the high urgency to the high lane, and the low and
+// very-low urgencies to the bulk lane.
+func (msg webPushMessage) PriorityHint() queue.Priority {
+	switch msg.options.Urgency {
+	case wpg.UrgencyHigh:
+		return queue.PriorityHigh
+	case wpg.UrgencyLow, wpg.UrgencyVeryLow:
+		return queue.PriorityBulk
+	}
+	return queue.PriorityNormal
+}
+
+// FeedbackToken ...
+func (msg webPushMessage) FeedbackToken() string {
+	return msg.Token
+}
+
 func (wp *WebPush) ConvertMessage(data []byte) (services.ServiceMessage, error) {
 	var msg webPushMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
@@ -5,6 +5,8 @@ import (
 	"log/slog"
 	"os"
 	"testing"
+
+	"github.com/mattstrayer/shove/internal/queue"
 )
 
 const subscription = `{
@@ -41,6 +43,9 @@ func TestConvert(t *testing.T) {
 	if msg.Token != subscription {
 		t.Fatal("Token not derived from subscription")
 	}
+	if msg.PriorityHint() != queue.PriorityBulk {
+		t.Fatal("Low urgency not mapped to bulk lane")
+	}
 }
 
 func TestConvertWithToken(t *testing.T) {
@@ -1,7 +1,9 @@
 package webpush
 
 import (
+	"errors"
 	"net/http"
+	"net/url"
 	"time"
 
 	"log/slog"
@@ -53,11 +55,11 @@ func (wp *WebPush) String() string {
 	return "WebPush"
 }
 
-func (wp *WebPush) SquashAndPushMessage(client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (wp *WebPush) SquashAndPushMessage(client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushResult {
 	panic("not implemented")
 }
 
-func (wp *WebPush) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (wp *WebPush) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushResult {
 	success := false
 	msg := smsg.(webPushMessage)
 	msg.options.HTTPClient = pclient.(*http.Client)
@@ -66,11 +68,17 @@ func (wp *WebPush) PushMessage(pclient services.PumpClient, smsg services.Servic
 	resp, err := wpg.SendNotification(msg.Payload, &msg.subscription, &msg.options)
 	if err != nil {
 		wp.log.Error("Failed to send", "error", err)
-		return services.PushStatusHardFail
+		// Transport errors are worth a retry, whereas errors encrypting
+		// the payload for the subscription are not.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return services.TempFail("", err)
+		}
+		return services.HardFail("", err)
 	}
 	defer resp.Body.Close()
 	duration := time.Now().Sub(startedAt)
-	wp.log.Info("Pushed", "status", resp.StatusCode, "duration", duration)
+	wp.log.Debug("Pushed", "status", resp.StatusCode, "duration", duration)
 	defer func() {
 		fc.CountPush(wp.ID(), success, duration)
 	}()
@@ -78,18 +86,18 @@ func (wp *WebPush) PushMessage(pclient services.PumpClient, smsg services.Servic
 	case 201:
 		//  201 Created. The request to send a push message was received and accepted.
 		success = true
-		return services.PushStatusSuccess
+		return services.Success()
 
 	case 429:
 		// 429 Too many requests. Meaning your application server has
 		// reached a rate limit with a push service. The push service
 		// should include a 'Retry-After' header to indicate how long
 		// before another request can be made.
-		return services.PushStatusTempFail
+		return services.TempFail(resp.Status, nil).After(services.RetryAfterHeader(resp))
 
 	case 400:
 		// 400 Invalid request. This generally means one of your headers is invalid or improperly formatted.
-		return services.PushStatusHardFail
+		return services.HardFail(resp.Status, nil)
 
 	case 404:
 		// 404 Not Found. This is an indication that the subscription is
@@ -102,11 +110,15 @@ func (wp *WebPush) PushMessage(pclient services.PumpClient, smsg services.Servic
 		// removed from application server. This can be reproduced by
 		// calling `unsubscribe()` on a `PushSubscription`.
 		fc.TokenInvalid(wp.ID(), msg.Token)
-		return services.PushStatusHardFail
+		return services.HardFail(resp.Status, nil)
 
 	default:
+		if resp.StatusCode >= 500 {
+			// The push service is having trouble, try again later.
+			return services.TempFail(resp.Status, nil).After(services.RetryAfterHeader(resp))
+		}
 		// 413 Payload size too large. The minimum size payload a push service must support is 4096 bytes (or 4kb).
-		return services.PushStatusHardFail
+		return services.HardFail(resp.Status, nil)
 	}
 }
 
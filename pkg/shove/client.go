@@ -2,23 +2,278 @@ package shove
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"time"
 
+	"github.com/mattstrayer/shove/pkg/wire"
+	shoveredis "github.com/mattstrayer/shove/pkg/wire/redis"
 	"github.com/redis/go-redis/v9"
 )
 
 // Client ...
 type Client interface {
-	PushRaw(serviceID string, data []byte) (err error)
+	PushRaw(serviceID string, data []byte, opts ...PushOption) (err error)
+}
+
+// PushOption customizes how a message is queued.
+type PushOption func(*pushOptions)
+
+// DefaultIdempotencyWindow is how long idempotency keys are remembered, unless
+// set otherwise using the IdempotencyWindow option. It matches the default of
+// the server.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+type pushOptions struct {
+	sendAt            time.Time
+	expiresAt         time.Time
+	ttl               time.Duration
+	priority          Priority
+	idempotencyKey    string
+	idempotencyWindow time.Duration
+	shardKey          string
+	tenant            string
+}
+
+// Priority selects the lane of the service queue a message is queued in.
+type Priority string
+
+const (
+	// PriorityHigh is meant for time-sensitive messages, e.g. one-time codes
+	PriorityHigh Priority = "high"
+	// PriorityNormal is the default priority
+	PriorityNormal Priority = "normal"
+	// PriorityBulk is meant for mass mailings that may be delayed
+	PriorityBulk Priority = "bulk"
+)
+
+// SendAt schedules the message to be delivered at the given time instead of
+// right away.
+func SendAt(t time.Time) PushOption {
+	return func(o *pushOptions) {
+		o.sendAt = t
+	}
+}
+
+// ExpiresAt drops the message instead of delivering it after the given time.
+func ExpiresAt(t time.Time) PushOption {
+	return func(o *pushOptions) {
+		o.expiresAt = t
+	}
+}
+
+// TTL drops the message instead of delivering it once it has been due for the
+// given duration, which is rounded up to whole seconds.
+func TTL(d time.Duration) PushOption {
+	return func(o *pushOptions) {
+		o.ttl = d
+	}
+}
+
+// IdempotencyKey makes sure the message is only queued once, even if it is
+// pushed repeatedly, e.g. when retrying after a timeout. Pushing a message with
+// a key that has been pushed before within the idempotency window succeeds
+// without queueing the message again.
+func IdempotencyKey(key string) PushOption {
+	return func(o *pushOptions) {
+		o.idempotencyKey = key
+	}
+}
+
+// IdempotencyWindow sets how long the idempotency key of the message is
+// remembered, instead of DefaultIdempotencyWindow.
+func IdempotencyWindow(d time.Duration) PushOption {
+	return func(o *pushOptions) {
+		o.idempotencyWindow = d
+	}
+}
+
+// ShardKey sends all messages with the same key, e.g. the device token, to the
+// same shard when using a sharded client. Without one, messages are spread
+// round-robin, unless they have an idempotency key.
+func ShardKey(key string) PushOption {
+	return func(o *pushOptions) {
+		o.shardKey = key
+	}
+}
+
+// WithPriority queues the message in the lane of the given priority. Unlike
+// messages pushed through the HTTP API, messages pushed directly to Redis do
+// not derive a default priority from service specific headers.
+func WithPriority(p Priority) PushOption {
+	return func(o *pushOptions) {
+		o.priority = p
+	}
+}
+
+// Tenant queues the message in the sub-queue of the given tenant, which is
+// served in turn with the other tenants. Tenants consist of letters, digits,
+// '-' and '_'. The server must be running with tenant queues enabled, or the
+// messages of tenants are not delivered.
+func Tenant(tenant string) PushOption {
+	return func(o *pushOptions) {
+		o.tenant = tenant
+	}
+}
+
+// ClientOption customizes a client.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	namespace       string
+	keyring         *Keyring
+	compressMinSize int
+}
+
+// Keyring holds the AES keys payloads are encrypted with, by key ID.
+type Keyring = wire.Keyring
+
+// ParseKeyring creates a keyring from comma separated id:key pairs, the keys
+// being base64 encoded 16, 24 or 32 byte AES keys. The first key is used for
+// encrypting. This is the format of the ENCRYPTION_KEYS server setting.
+func ParseKeyring(s string) (*Keyring, error) {
+	return wire.ParseKeyring(s)
+}
+
+// Namespace sets the prefix of the Redis keys, which must match the namespace
+// of the server. Defaults to "shove".
+func Namespace(namespace string) ClientOption {
+	return func(o *clientOptions) {
+		o.namespace = namespace
+	}
+}
+
+// WithKeyring encrypts the payloads with the primary key of the keyring, which
+// the server must have in its keyring as well. The metadata of the messages,
+// e.g. the delivery time, is not encrypted.
+func WithKeyring(k *Keyring) ClientOption {
+	return func(o *clientOptions) {
+		o.keyring = k
+	}
+}
+
+// WithCompression compresses payloads of at least minSize bytes using gzip,
+// unless they do not get smaller. Servers decompress payloads regardless of
+// their own compression setting.
+func WithCompression(minSize int) ClientOption {
+	return func(o *clientOptions) {
+		o.compressMinSize = max(minSize, 1)
+	}
+}
+
+func newClientOptions(opts []ClientOption) clientOptions {
+	var o clientOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// shards holds the Redis clients of the shards of the queues. With a single
+// shard, the queues are not sharded.
+type shards struct {
+	clients []redis.UniversalClient
+	picker  *wire.ShardPicker
+}
+
+func newShards(clients []redis.UniversalClient) shards {
+	return shards{
+		clients: clients,
+		picker:  wire.NewShardPicker(len(clients)),
+	}
+}
+
+// pick returns the client and the queue ID of the shard data belongs to, and
+// strips the shard key, which is of no use once the shard has been chosen.
+func (s shards) pick(id string, data []byte) (redis.UniversalClient, string, []byte, error) {
+	env := wire.DecodeEnvelope(data)
+	shard := s.picker.Pick(env.Meta)
+	if env.Meta.ShardKey != "" {
+		env.Meta.ShardKey = ""
+		var err error
+		if data, err = env.Encode(); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	return s.clients[shard], wire.ShardID(id, shard), data, nil
+}
+
+// encodePayload compresses and then encrypts the payload of data, as far as
+// enabled.
+func (o clientOptions) encodePayload(data []byte) ([]byte, error) {
+	if o.compressMinSize == 0 && o.keyring == nil {
+		return data, nil
+	}
+	env := wire.DecodeEnvelope(data)
+	if o.compressMinSize > 0 {
+		if _, err := wire.Compress(&env, o.compressMinSize); err != nil {
+			return nil, err
+		}
+	}
+	if o.keyring != nil {
+		if err := o.keyring.Encrypt(&env); err != nil {
+			return nil, err
+		}
+	}
+	return env.Encode()
 }
 
 type redisClient struct {
-	client *redis.Client
+	shards
+	clientOptions
+}
+
+type redisStreamClient struct {
+	shards
+	maxLen int64
+	clientOptions
 }
 
 // NewRedisClient ...
-func NewRedisClient(redisURL string) Client {
+func NewRedisClient(redisURL string, opts ...ClientOption) Client {
+	return NewUniversalRedisClient(newRedisClient(redisURL), opts...)
+}
+
+// NewUniversalRedisClient creates a client using an existing Redis client,
+// which may also be a Sentinel (failover) or cluster client.
+func NewUniversalRedisClient(client redis.UniversalClient, opts ...ClientOption) Client {
+	return NewShardedRedisClient([]redis.UniversalClient{client}, opts...)
+}
+
+// NewShardedRedisClient creates a client for servers spreading their queues
+// over several shards. clients holds the Redis client of each shard, in the
+// order of the shards of the server; shards sharing a Redis instance share a
+// client.
+func NewShardedRedisClient(clients []redis.UniversalClient, opts ...ClientOption) Client {
+	return &redisClient{
+		shards:        newShards(clients),
+		clientOptions: newClientOptions(opts),
+	}
+}
+
+// NewRedisStreamClient creates a client for servers using the Redis Streams
+// queue backend. The stream is approximately capped at maxLen entries (0 for
+// unlimited), which should match the server configuration.
+func NewRedisStreamClient(redisURL string, maxLen int64, opts ...ClientOption) Client {
+	return NewUniversalRedisStreamClient(newRedisClient(redisURL), maxLen, opts...)
+}
+
+// NewUniversalRedisStreamClient is the NewRedisStreamClient counterpart of
+// NewUniversalRedisClient.
+func NewUniversalRedisStreamClient(client redis.UniversalClient, maxLen int64, opts ...ClientOption) Client {
+	return NewShardedRedisStreamClient([]redis.UniversalClient{client}, maxLen, opts...)
+}
+
+// NewShardedRedisStreamClient is the NewShardedRedisClient counterpart of
+// NewUniversalRedisStreamClient.
+func NewShardedRedisStreamClient(clients []redis.UniversalClient, maxLen int64, opts ...ClientOption) Client {
+	return &redisStreamClient{
+		shards:        newShards(clients),
+		maxLen:        maxLen,
+		clientOptions: newClientOptions(opts),
+	}
+}
+
+func newRedisClient(redisURL string) *redis.Client {
 	opt, err := redis.ParseURL(redisURL)
 	if err != nil {
 		panic(err)
@@ -29,19 +284,109 @@ func NewRedisClient(redisURL string) Client {
 	opt.WriteTimeout = 10 * time.Second // Timeout for write operations
 	opt.DialTimeout = 5 * time.Second   // Timeout for establishing connections
 
-	client := redis.NewClient(opt)
-	return &redisClient{
-		client: client,
+	return redis.NewClient(opt)
+}
+
+func newPushOptions(opts []PushOption) pushOptions {
+	o := pushOptions{
+		idempotencyWindow: DefaultIdempotencyWindow,
+	}
+	for _, opt := range opts {
+		opt(&o)
 	}
+	return o
 }
 
-func queueName(id string) string {
-	return fmt.Sprintf("shove:%s", id)
+// encode wraps data in an envelope reflecting the push options.
+func (o pushOptions) encode(data []byte) ([]byte, error) {
+	env := wire.Envelope{Payload: data}
+	if !o.sendAt.IsZero() {
+		env.Meta.SendAt = o.sendAt.Unix()
+	}
+	if !o.expiresAt.IsZero() {
+		env.Meta.ExpiresAt = o.expiresAt.Unix()
+	}
+	if o.ttl > 0 {
+		env.Meta.TTL = int64((o.ttl + time.Second - 1) / time.Second)
+	}
+	if o.priority != "" && o.priority != PriorityNormal {
+		p, err := wire.ParsePriority(string(o.priority))
+		if err != nil {
+			return nil, err
+		}
+		env.Meta.Priority = p
+	}
+	env.Meta.IdempotencyKey = o.idempotencyKey
+	env.Meta.ShardKey = o.shardKey
+	if err := wire.CheckTenant(o.tenant); err != nil {
+		return nil, err
+	}
+	env.Meta.Tenant = o.tenant
+	return env.Encode()
+}
+
+// queueID returns the ID of the queue of the shard with the given ID to push
+// to, which is the sub-queue of the tenant if any. The tenant is registered,
+// so that the server finds its sub-queue.
+func (o pushOptions) queueID(ctx context.Context, client redis.UniversalClient, namespace, shardID string) (string, error) {
+	if o.tenant == "" {
+		return shardID, nil
+	}
+	if err := shoveredis.RegisterTenant(ctx, client, shoveredis.QueueKey(client, namespace, shardID), o.tenant); err != nil {
+		return "", err
+	}
+	return wire.TenantID(shardID, o.tenant), nil
 }
 
 // PushRaw ...
-func (rc *redisClient) PushRaw(id string, data []byte) (err error) {
-	waitingList := queueName(id)
+func (rc *redisClient) PushRaw(id string, data []byte, opts ...PushOption) (err error) {
+	o := newPushOptions(opts)
+	if data, err = o.encode(data); err != nil {
+		return
+	}
+	client, shardID, data, err := rc.pick(id, data)
+	if err != nil {
+		return
+	}
+	if data, err = rc.encodePayload(data); err != nil {
+		return
+	}
 	ctx := context.Background()
-	return rc.client.LPush(ctx, waitingList, data).Err()
+	queueID, err := o.queueID(ctx, client, rc.namespace, shardID)
+	if err != nil {
+		return
+	}
+	waitingList := shoveredis.QueueKey(client, rc.namespace, queueID)
+	err = shoveredis.Push(ctx, client, waitingList, data, o.idempotencyWindow)
+	if errors.Is(err, wire.ErrDuplicate) {
+		// Queued before
+		err = nil
+	}
+	return
+}
+
+// PushRaw ...
+func (rc *redisStreamClient) PushRaw(id string, data []byte, opts ...PushOption) (err error) {
+	o := newPushOptions(opts)
+	if data, err = o.encode(data); err != nil {
+		return
+	}
+	client, shardID, data, err := rc.pick(id, data)
+	if err != nil {
+		return
+	}
+	if data, err = rc.encodePayload(data); err != nil {
+		return
+	}
+	ctx := context.Background()
+	queueID, err := o.queueID(ctx, client, rc.namespace, shardID)
+	if err != nil {
+		return
+	}
+	err = shoveredis.StreamPush(ctx, client, shoveredis.StreamKey(client, rc.namespace, queueID), data, rc.maxLen, o.idempotencyWindow)
+	if errors.Is(err, wire.ErrDuplicate) {
+		// Queued before
+		err = nil
+	}
+	return
 }
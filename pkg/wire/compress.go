@@ -0,0 +1,77 @@
+package wire
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// compressionMagic starts every compressed payload, followed by the gzip
+// stream. Its length is a multiple of 3, so that base64 encoded payloads
+// start with compressedPrefix.
+const compressionMagic = "SHZ"
+
+// compressedPrefix starts the JSON encoding of compressed payloads.
+var compressedPrefix = []byte(`"` + base64.StdEncoding.EncodeToString([]byte(compressionMagic)))
+
+// Compress replaces the payload of the envelope by its gzip compressed form,
+// as JSON string holding the magic bytes and the gzip stream, base64 encoded.
+// Payloads shorter than minSize, or that do not get smaller, are left as they
+// are. Returns whether the payload has been compressed.
+func Compress(env *Envelope, minSize int) (bool, error) {
+	if len(env.Payload) < minSize || Compressed(env.Payload) {
+		return false, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString(compressionMagic)
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(env.Payload); err != nil {
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	payload, err := json.Marshal(base64.StdEncoding.EncodeToString(buf.Bytes()))
+	if err != nil {
+		return false, err
+	}
+	if len(payload) >= len(env.Payload) {
+		return false, nil
+	}
+	env.Payload = payload
+	return true, nil
+}
+
+// Compressed tells whether a payload has been compressed by Compress.
+func Compressed(payload []byte) bool {
+	return bytes.HasPrefix(payload, compressedPrefix)
+}
+
+// Decompress restores a payload compressed by Compress. Payloads that are not
+// compressed are left as they are.
+func Decompress(env *Envelope) error {
+	if !Compressed(env.Payload) {
+		return nil
+	}
+	var encoded string
+	if err := json.Unmarshal(env.Payload, &encoded); err != nil {
+		return err
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data[len(compressionMagic):]))
+	if err != nil {
+		return fmt.Errorf("decompressing payload: %w", err)
+	}
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("decompressing payload: %w", err)
+	}
+	env.Payload = payload
+	return nil
+}
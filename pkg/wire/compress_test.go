@@ -0,0 +1,53 @@
+package wire
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	payload := []byte(`{"body":"` + strings.Repeat("hello ", 200) + `"}`)
+	env := Envelope{Meta: Meta{ID: "1"}, Payload: payload}
+	compressed, err := Compress(&env, 100)
+	if err != nil || !compressed {
+		t.Fatal(compressed, err)
+	}
+	if len(env.Payload) >= len(payload) || !Compressed(env.Payload) {
+		t.Fatal(string(env.Payload))
+	}
+	// The envelope remains valid JSON
+	data, err := env.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env = DecodeEnvelope(data)
+	if env.Meta.ID != "1" {
+		t.Fatal(string(data))
+	}
+	if err := Decompress(&env); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(env.Payload, payload) {
+		t.Fatal(string(env.Payload))
+	}
+}
+
+func TestCompressSkipped(t *testing.T) {
+	for _, payload := range []string{
+		// Too short
+		`{"body":"hello hello hello hello"}`,
+		// Does not get smaller
+		`"aGVsbG8gd29ybGQsIHRoaXMgaXMgbm90IGNvbXByZXNzaWJsZQ=="`,
+	} {
+		env := Envelope{Payload: []byte(payload)}
+		compressed, err := Compress(&env, 40)
+		if err != nil || compressed || string(env.Payload) != payload {
+			t.Fatal(payload, compressed, err)
+		}
+		// Legacy payloads are left alone
+		if err := Decompress(&env); err != nil || string(env.Payload) != payload {
+			t.Fatal(payload, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package wire
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Meta holds the bookkeeping shove keeps alongside a queued payload.
+type Meta struct {
+	// ID distinguishes otherwise identical messages, e.g. in a Redis set.
+	ID string `json:"id,omitempty"`
+	// SendAt is the Unix time before which the message must not be delivered.
+	SendAt int64 `json:"send_at,omitempty"`
+	// EnqueuedAt is the Unix time at which the message was first queued.
+	EnqueuedAt int64 `json:"enqueued_at,omitempty"`
+	// Attempts is the number of failed delivery attempts so far.
+	Attempts int `json:"attempts,omitempty"`
+	// RetryAt is the Unix time before which a message that failed temporarily
+	// must not be attempted again.
+	RetryAt int64 `json:"retry_at,omitempty"`
+	// Priority selects the lane the message is queued in.
+	Priority Priority `json:"priority,omitempty"`
+	// ExpiresAt is the Unix time after which the message is dropped instead
+	// of delivered.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// TTL is the number of seconds the message may be delivered for, counting
+	// from when it is due. It is converted to ExpiresAt when queued.
+	TTL int64 `json:"ttl,omitempty"`
+	// IdempotencyKey identifies the message to the producer. A message is
+	// not queued again if its key has been seen recently.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// ShardKey selects the shard of a sharded queue, e.g. the device token,
+	// so that all messages with the same key end up in the same shard. It is
+	// only used for routing and not stored.
+	ShardKey string `json:"shard_key,omitempty"`
+	// Tenant is the producer the message belongs to. Queues keeping a
+	// sub-queue per tenant serve the tenants in turn, so that a tenant
+	// flooding the queue does not hold up the others.
+	Tenant string `json:"tenant,omitempty"`
+	// KeyID names the key the payload is encrypted with, see Keyring. The
+	// payload is not encrypted if empty.
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// Envelope is a service payload together with its queue metadata. It is
+// stored as {"shove": {...}, "payload": ...}. Data that is not in this format,
+// such as messages pushed by older clients, is treated as a bare payload.
+type Envelope struct {
+	Meta    Meta
+	Payload []byte
+}
+
+type envelopeJSON struct {
+	Meta    *Meta           `json:"shove"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// DecodeEnvelope unwraps data into an envelope.
+func DecodeEnvelope(data []byte) Envelope {
+	var wire envelopeJSON
+	if err := json.Unmarshal(data, &wire); err != nil || wire.Meta == nil {
+		return Envelope{Payload: data}
+	}
+	return Envelope{Meta: *wire.Meta, Payload: wire.Payload}
+}
+
+// Encode serializes the envelope. Envelopes without metadata are encoded as
+// the bare payload, so that they remain readable by older versions.
+func (e Envelope) Encode() ([]byte, error) {
+	if e.Meta == (Meta{}) {
+		return e.Payload, nil
+	}
+	return json.Marshal(envelopeJSON{
+		Meta:    &e.Meta,
+		Payload: json.RawMessage(e.Payload),
+	})
+}
+
+// Stamp records now as the time of enqueueing, unless already recorded, and
+// resolves the TTL into an expiry time.
+func (e *Envelope) Stamp(now time.Time) {
+	if e.Meta.EnqueuedAt == 0 {
+		e.Meta.EnqueuedAt = now.Unix()
+	}
+	if e.Meta.TTL > 0 {
+		if e.Meta.ExpiresAt == 0 {
+			e.Meta.ExpiresAt = max(e.Meta.EnqueuedAt, e.Meta.SendAt) + e.Meta.TTL
+		}
+		e.Meta.TTL = 0
+	}
+}
+
+// Expired tells whether the message must no longer be delivered.
+func (m Meta) Expired(now time.Time) bool {
+	return m.ExpiresAt > 0 && now.Unix() >= m.ExpiresAt
+}
+
+// Due returns the Unix time before which the message must not be delivered,
+// or 0 if it may be delivered right away.
+func (m Meta) Due() int64 {
+	return max(m.SendAt, m.RetryAt)
+}
+
+// NewID returns a random message identifier.
+func NewID() (string, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
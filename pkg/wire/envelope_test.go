@@ -0,0 +1,73 @@
+package wire
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeEnvelope(t *testing.T) {
+	env := DecodeEnvelope([]byte(`{"shove": {"send_at": 1700000000}, "payload": {"token": "abc"}}`))
+	if env.Meta.SendAt != 1700000000 {
+		t.Fatal(env.Meta.SendAt)
+	}
+	if string(env.Payload) != `{"token": "abc"}` {
+		t.Fatal(string(env.Payload))
+	}
+}
+
+func TestDecodeBarePayload(t *testing.T) {
+	for _, data := range []string{
+		`{"token": "abc", "payload": {"aps": {}}}`,
+		`not json`,
+	} {
+		env := DecodeEnvelope([]byte(data))
+		if env.Meta != (Meta{}) {
+			t.Fatal(data)
+		}
+		if string(env.Payload) != data {
+			t.Fatal(string(env.Payload))
+		}
+	}
+}
+
+func TestEncodeEnvelope(t *testing.T) {
+	payload := []byte(`{"token":"abc"}`)
+	data, err := Envelope{Payload: payload}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(payload) {
+		t.Fatal(string(data))
+	}
+	data, err = Envelope{Meta: Meta{SendAt: 42}, Payload: payload}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := DecodeEnvelope(data)
+	if env.Meta.SendAt != 42 || string(env.Payload) != string(payload) {
+		t.Fatal(string(data))
+	}
+}
+
+func TestStampTTL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	env := DecodeEnvelope([]byte(`{"shove": {"ttl": 60}, "payload": {}}`))
+	env.Stamp(now)
+	if env.Meta.ExpiresAt != 1700000060 || env.Meta.TTL != 0 {
+		t.Fatal(env.Meta)
+	}
+	if env.Meta.Expired(now.Add(59*time.Second)) || !env.Meta.Expired(now.Add(60*time.Second)) {
+		t.Fatal("wrong expiry")
+	}
+
+	// Scheduled messages only start to live once due
+	env = DecodeEnvelope([]byte(`{"shove": {"ttl": 60, "send_at": 1700003600}, "payload": {}}`))
+	env.Stamp(now)
+	if env.Meta.ExpiresAt != 1700003660 {
+		t.Fatal(env.Meta)
+	}
+
+	if (Meta{}).Expired(now) {
+		t.Fatal("message without expiry expired")
+	}
+}
@@ -0,0 +1,146 @@
+package wire
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Keyring holds the AES keys payloads are encrypted with, by key ID. New
+// payloads are encrypted with the primary key, while the other keys are kept
+// to decrypt payloads encrypted before the primary key was rotated. It is safe
+// for concurrent use.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring creates a keyring encrypting with the key named primary. Keys
+// must be 16, 24 or 32 bytes long, selecting AES-128, AES-192 or AES-256.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("primary key %q not in keyring", primary)
+	}
+	k := &Keyring{
+		primary: primary,
+		aeads:   make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		if id == "" {
+			return nil, errors.New("empty key ID")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		if k.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+	}
+	return k, nil
+}
+
+// ParseKeyring creates a keyring from comma separated id:key pairs, the keys
+// being base64 encoded. The first key is the primary key.
+func ParseKeyring(s string) (*Keyring, error) {
+	var primary string
+	keys := make(map[string][]byte)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, errors.New("keys must be of the form id:key")
+		}
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("duplicate key ID %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		if primary == "" {
+			primary = id
+		}
+		keys[id] = key
+	}
+	if primary == "" {
+		return nil, errors.New("no keys")
+	}
+	return NewKeyring(primary, keys)
+}
+
+// Seal encrypts plaintext with the primary key, returning the key ID and the
+// nonce followed by the ciphertext.
+func (k *Keyring) Seal(plaintext []byte) (keyID string, sealed []byte, err error) {
+	aead := k.aeads[k.primary]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	return k.primary, aead.Seal(nonce, nonce, plaintext, []byte(k.primary)), nil
+}
+
+// Open decrypts what Seal returned.
+func (k *Keyring) Open(keyID string, sealed []byte) ([]byte, error) {
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", keyID)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(keyID))
+}
+
+// Encrypt encrypts the payload of the envelope, unless already encrypted. The
+// payload becomes a JSON string holding the sealed payload, base64 encoded,
+// while the metadata stays readable by the queues.
+func (k *Keyring) Encrypt(env *Envelope) error {
+	if env.Meta.KeyID != "" {
+		return nil
+	}
+	keyID, sealed, err := k.Seal(env.Payload)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(base64.StdEncoding.EncodeToString(sealed))
+	if err != nil {
+		return err
+	}
+	env.Meta.KeyID = keyID
+	env.Payload = payload
+	return nil
+}
+
+// Decrypt restores the payload of an envelope encrypted by Encrypt. Envelopes
+// that are not encrypted, e.g. queued before encryption was enabled, are left
+// as they are.
+func (k *Keyring) Decrypt(env *Envelope) error {
+	if env.Meta.KeyID == "" {
+		return nil
+	}
+	var encoded string
+	if err := json.Unmarshal(env.Payload, &encoded); err != nil {
+		return err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	payload, err := k.Open(env.Meta.KeyID, sealed)
+	if err != nil {
+		return err
+	}
+	env.Meta.KeyID = ""
+	env.Payload = payload
+	return nil
+}
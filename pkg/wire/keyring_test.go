@@ -0,0 +1,80 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old, err := ParseKeyring("k1:" + testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Envelope{Meta: Meta{Priority: PriorityHigh}, Payload: []byte(`{"text":"secret"}`)}
+	if err := old.Encrypt(&env); err != nil {
+		t.Fatal(err)
+	}
+	data, err := env.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) || !bytes.Contains(data, []byte(`"priority":"high"`)) {
+		t.Fatal(string(data))
+	}
+
+	// After rotating, new payloads use k2 and old ones remain readable
+	rotated, err := ParseKeyring("k2:" + testKey(2) + ", k1:" + testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env = DecodeEnvelope(data)
+	if err := rotated.Decrypt(&env); err != nil {
+		t.Fatal(err)
+	}
+	if string(env.Payload) != `{"text":"secret"}` || env.Meta.KeyID != "" {
+		t.Fatal(env)
+	}
+	if err := rotated.Encrypt(&env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Meta.KeyID != "k2" {
+		t.Fatal(env.Meta.KeyID)
+	}
+	if err := old.Decrypt(&env); err == nil {
+		t.Fatal("decrypted with unknown key")
+	}
+}
+
+func TestKeyringPlaintext(t *testing.T) {
+	k, err := ParseKeyring("k1:" + testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := DecodeEnvelope([]byte(`{"text":"legacy"}`))
+	if err := k.Decrypt(&env); err != nil {
+		t.Fatal(err)
+	}
+	if string(env.Payload) != `{"text":"legacy"}` {
+		t.Fatal(string(env.Payload))
+	}
+
+}
+
+func TestParseKeyring(t *testing.T) {
+	for _, s := range []string{
+		"",
+		testKey(1),
+		"k1:not base64",
+		"k1:" + base64.StdEncoding.EncodeToString([]byte("short")),
+		"k1:" + testKey(1) + ",k1:" + testKey(2),
+	} {
+		if _, err := ParseKeyring(s); err == nil {
+			t.Error("accepted", s)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package wire
+
+import "fmt"
+
+// Priority selects the lane of a service queue a message is queued in.
+type Priority string
+
+const (
+	// PriorityHigh is meant for time-sensitive messages, e.g. one-time codes
+	PriorityHigh Priority = "high"
+	// PriorityNormal is the lane of messages that do not specify a priority
+	PriorityNormal Priority = "normal"
+	// PriorityBulk is meant for mass mailings that may be delayed
+	PriorityBulk Priority = "bulk"
+)
+
+// Priorities lists the lanes of a queue, highest priority first. The position
+// of a priority in this list is its lane index.
+var Priorities = []Priority{PriorityHigh, PriorityNormal, PriorityBulk}
+
+// ParsePriority checks the priority of a message. An empty priority is
+// treated as PriorityNormal.
+func ParsePriority(s string) (Priority, error) {
+	if s == "" {
+		return PriorityNormal, nil
+	}
+	for _, p := range Priorities {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown priority %q", s)
+}
+
+// Lane returns the lane index of the priority. Unknown priorities end up in
+// the normal lane.
+func (p Priority) Lane() int {
+	switch p {
+	case PriorityHigh:
+		return 0
+	case PriorityBulk:
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,22 @@
+package wire
+
+import (
+	"testing"
+)
+
+func TestParsePriority(t *testing.T) {
+	for s, expected := range map[string]Priority{
+		"":       PriorityNormal,
+		"high":   PriorityHigh,
+		"normal": PriorityNormal,
+		"bulk":   PriorityBulk,
+	} {
+		p, err := ParsePriority(s)
+		if err != nil || p != expected {
+			t.Fatal(s, p, err)
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Fatal("unknown priority accepted")
+	}
+}
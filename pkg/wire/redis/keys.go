@@ -0,0 +1,67 @@
+// Package redis defines the Redis keys the queues of the server are kept at,
+// and pushes messages to them the way the server expects.
+package redis
+
+import (
+	"fmt"
+
+	"github.com/mattstrayer/shove/pkg/wire"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultNamespace prefixes all keys, unless configured otherwise.
+const DefaultNamespace = "shove"
+
+// StreamField is the name of the stream entry field holding the message.
+const StreamField = "data"
+
+// QueueKey returns the key of the queue of a service within namespace (or
+// DefaultNamespace if empty). All other keys of the service are derived from
+// it. On a cluster, the service ID is used as hash tag, so that all keys of a
+// service end up in the same slot.
+func QueueKey(client redis.UniversalClient, namespace, id string) string {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	if _, ok := client.(*redis.ClusterClient); ok {
+		return fmt.Sprintf("%s:{%s}", namespace, id)
+	}
+	return fmt.Sprintf("%s:%s", namespace, id)
+}
+
+// StreamKey returns the key of the stream holding the messages of a service,
+// within namespace as for QueueKey.
+func StreamKey(client redis.UniversalClient, namespace, id string) string {
+	return QueueKey(client, namespace, id) + ":stream"
+}
+
+// LaneKey returns the key of a priority lane of the queue stored at key. The
+// normal lane is stored at key itself, so that queues created before lanes
+// existed keep working.
+func LaneKey(key string, p wire.Priority) string {
+	switch p.Lane() {
+	case wire.PriorityHigh.Lane():
+		return key + ":high"
+	case wire.PriorityBulk.Lane():
+		return key + ":bulk"
+	}
+	return key
+}
+
+// ScheduledKey returns the key of the sorted set holding the messages of the
+// queue stored at key that are not due yet, scored by their due time.
+func ScheduledKey(key string) string {
+	return key + ":scheduled"
+}
+
+// TenantsKey returns the key of the set of tenants of the queue stored at
+// key.
+func TenantsKey(key string) string {
+	return key + ":tenants"
+}
+
+// idempotencyKey returns the key remembering an idempotency key of the queue
+// stored at key.
+func idempotencyKey(key, idempotencyKey string) string {
+	return key + ":idempotency:" + idempotencyKey
+}
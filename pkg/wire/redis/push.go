@@ -0,0 +1,120 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/mattstrayer/shove/pkg/wire"
+	"github.com/redis/go-redis/v9"
+)
+
+// Push adds data, which may be an encoded wire.Envelope, to its priority lane
+// of the queue stored at key. Messages that are not due yet are parked in a
+// sorted set scored by their due time, from which they are promoted by the
+// queue consumers. Messages with an idempotency key that has been pushed within
+// idempotencyWindow are rejected with wire.ErrDuplicate.
+func Push(ctx context.Context, client redis.Cmdable, key string, data []byte, idempotencyWindow time.Duration) (err error) {
+	env := wire.DecodeEnvelope(data)
+	env.Stamp(time.Now())
+	data, scheduled, err := encodeForQueue(&env)
+	if err != nil {
+		return
+	}
+	release, err := claimIdempotencyKey(ctx, client, key, env, idempotencyWindow)
+	if err != nil {
+		return
+	}
+	if !scheduled {
+		err = client.LPush(ctx, LaneKey(key, env.Meta.Priority), data).Err()
+	} else {
+		err = client.ZAdd(ctx, ScheduledKey(key), scheduledMember(env, data)).Err()
+	}
+	if err != nil {
+		release()
+	}
+	return
+}
+
+// StreamPush adds data, which may be an encoded wire.Envelope, to the stream
+// of its priority lane of the queue stored at key, or to its scheduled set if
+// the message is not due yet. Idempotency keys are handled as by Push.
+func StreamPush(ctx context.Context, client redis.Cmdable, key string, data []byte, maxLen int64, idempotencyWindow time.Duration) error {
+	now := time.Now()
+	env := wire.DecodeEnvelope(data)
+	env.Stamp(now)
+	if env.Meta.Due() > now.Unix() {
+		return Push(ctx, client, key, data, idempotencyWindow)
+	}
+	data, err := env.Encode()
+	if err != nil {
+		return err
+	}
+	release, err := claimIdempotencyKey(ctx, client, key, env, idempotencyWindow)
+	if err != nil {
+		return err
+	}
+	if err = client.XAdd(ctx, streamArgs(LaneKey(key, env.Meta.Priority), data, maxLen)).Err(); err != nil {
+		release()
+	}
+	return err
+}
+
+// RegisterTenant adds a tenant to the set of tenants of the queue stored at
+// key, for producers pushing to the sub-queue of a tenant directly.
+func RegisterTenant(ctx context.Context, client redis.Cmdable, key, tenant string) error {
+	return client.SAdd(ctx, TenantsKey(key), tenant).Err()
+}
+
+// encodeForQueue encodes env and tells whether it is not due yet, and thus
+// has to be parked in the scheduled set.
+func encodeForQueue(env *wire.Envelope) (data []byte, scheduled bool, err error) {
+	scheduled = env.Meta.Due() > time.Now().Unix()
+	if scheduled && env.Meta.ID == "" {
+		// Without an ID, identical messages would collapse into one member.
+		if env.Meta.ID, err = wire.NewID(); err != nil {
+			return
+		}
+	}
+	data, err = env.Encode()
+	return
+}
+
+func scheduledMember(env wire.Envelope, data []byte) redis.Z {
+	return redis.Z{
+		Score:  float64(env.Meta.Due()),
+		Member: data,
+	}
+}
+
+func streamArgs(key string, data []byte, maxLen int64) *redis.XAddArgs {
+	return &redis.XAddArgs{
+		Stream: key,
+		MaxLen: maxLen,
+		Approx: true,
+		Values: []any{StreamField, data},
+	}
+}
+
+// claimIdempotencyKey remembers the idempotency key of env, if any, for window
+// using SET NX. Returns wire.ErrDuplicate if the key is already known. The
+// returned function forgets the key again, for when the message could not be
+// queued after all.
+func claimIdempotencyKey(ctx context.Context, client redis.Cmdable, key string, env wire.Envelope, window time.Duration) (release func(), err error) {
+	release = func() {}
+	if env.Meta.IdempotencyKey == "" || window <= 0 {
+		return
+	}
+	k := idempotencyKey(key, env.Meta.IdempotencyKey)
+	ok, err := client.SetNX(ctx, k, env.Meta.EnqueuedAt, window).Result()
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = wire.ErrDuplicate
+		return
+	}
+	release = func() {
+		client.Del(context.Background(), k)
+	}
+	return
+}
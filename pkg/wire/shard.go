@@ -0,0 +1,60 @@
+package wire
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync/atomic"
+)
+
+// ShardID returns the queue ID of shard i of the queue with the given ID. The
+// first shard keeps the ID, so that an unsharded queue becomes the first shard
+// when sharding is enabled.
+func ShardID(id string, i int) string {
+	if i == 0 {
+		return id
+	}
+	return id + ":shard:" + strconv.Itoa(i)
+}
+
+// ShardOf returns which of n shards a key belongs to. It uses jump consistent
+// hashing, so that only about 1/n of the keys move when a shard is added.
+func ShardOf(key string, n int) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	k := h.Sum64()
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		k = k*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((k>>33)+1)))
+	}
+	return int(b)
+}
+
+// ShardPicker chooses the shards of messages. Messages with a shard key, or
+// else an idempotency key, always go to the same shard, so that their order
+// is kept and duplicates are detected. Other messages are spread round-robin.
+// It is safe for concurrent use.
+type ShardPicker struct {
+	n    int
+	next atomic.Uint64
+}
+
+// NewShardPicker creates a picker for n shards.
+func NewShardPicker(n int) *ShardPicker {
+	return &ShardPicker{n: n}
+}
+
+// Pick returns the shard of a message.
+func (p *ShardPicker) Pick(meta Meta) int {
+	if p.n <= 1 {
+		return 0
+	}
+	switch {
+	case meta.ShardKey != "":
+		return ShardOf(meta.ShardKey, p.n)
+	case meta.IdempotencyKey != "":
+		return ShardOf(meta.IdempotencyKey, p.n)
+	}
+	return int((p.next.Add(1) - 1) % uint64(p.n))
+}
@@ -0,0 +1,48 @@
+package wire
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestShardOf(t *testing.T) {
+	moved := 0
+	for i := range 10000 {
+		key := "token-" + strconv.Itoa(i)
+		before, after := ShardOf(key, 4), ShardOf(key, 5)
+		if before < 0 || before >= 4 || after < 0 || after >= 5 {
+			t.Fatal(key, before, after)
+		}
+		if before != after {
+			if after != 4 {
+				t.Fatal("moved between existing shards", key, before, after)
+			}
+			moved++
+		}
+	}
+	// About a fifth of the keys move to the new shard
+	if moved < 1500 || moved > 2500 {
+		t.Fatal(moved)
+	}
+}
+
+func TestShardPicker(t *testing.T) {
+	p := NewShardPicker(3)
+	for i := range 6 {
+		if shard := p.Pick(Meta{}); shard != i%3 {
+			t.Fatal(i, shard)
+		}
+	}
+	shard := p.Pick(Meta{ShardKey: "a"})
+	for range 10 {
+		if p.Pick(Meta{ShardKey: "a"}) != shard {
+			t.Fatal("shard key not sticky")
+		}
+	}
+	if p.Pick(Meta{IdempotencyKey: "a"}) != shard {
+		t.Fatal("idempotency key not used")
+	}
+	if NewShardPicker(1).Pick(Meta{ShardKey: "a"}) != 0 {
+		t.Fatal("single shard")
+	}
+}
@@ -0,0 +1,38 @@
+package wire
+
+import "fmt"
+
+// maxTenantLength limits the length of tenant names, which end up in queue
+// IDs.
+const maxTenantLength = 64
+
+// TenantID returns the queue ID of the sub-queue of a tenant of the queue with
+// the given ID. Messages without tenant stay in the queue itself.
+func TenantID(id, tenant string) string {
+	if tenant == "" {
+		return id
+	}
+	return TenantPrefix(id) + tenant
+}
+
+// TenantPrefix returns the start of the queue IDs of the sub-queues of the
+// tenants of the queue with the given ID.
+func TenantPrefix(id string) string {
+	return id + ":tenant:"
+}
+
+// CheckTenant checks the tenant of a message, which may consist of letters,
+// digits, '-' and '_'.
+func CheckTenant(tenant string) error {
+	if len(tenant) > maxTenantLength {
+		return fmt.Errorf("tenant longer than %d characters", maxTenantLength)
+	}
+	for _, c := range tenant {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return fmt.Errorf("invalid character %q in tenant %q", c, tenant)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+// Package wire defines the format of queued messages, which the server shares
+// with the clients pushing to its queues directly: the envelope holding a
+// payload along with its metadata, and how payloads are compressed, encrypted
+// and spread over shards and tenants.
+package wire
+
+import "errors"
+
+// ErrDuplicate is returned when queueing a message with an idempotency key
+// that has already been queued within the idempotency window.
+var ErrDuplicate = errors.New("duplicate message")